@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"chaincodedev/chaincode/liqi/hwxf/payload"
+	"chaincodedev/chaincode/liqi/hwxf/settlement"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+type Attestation = settlement.Attestation
+
+// OracleAttestation is an attestation submitted by one oracle, with its signature or approval
+type OracleAttestation struct {
+	Attestation Attestation
+	Digest      string // hex SHA-256 of the signed payload, equal attestations have equal digests
+	Signature   []byte
+	Approval    *Approval `json:",omitempty"`
+}
+
+// ChunkJudgedEvent tells the settlement workers a chunk is ready to be attested
+type ChunkJudgedEvent struct {
+	LogId     string
+	Revision  int
+	Defaulted []string
+}
+
+func getAttestationPayload(stub shim.ChaincodeStubInterface, attestation Attestation) ([]byte, error) {
+	domain, err := getSigningDomain(stub)
+	if err != nil {
+		return nil, err
+	}
+	return attestation.Encode(domain), nil
+}
+
+func getAttestations(stub shim.ChaincodeStubInterface, logId string) (map[string]OracleAttestation, error) {
+	attestations := make(map[string]OracleAttestation)
+	attestationsAsBytes, err := stub.GetState(logId + "_attestations")
+	if err != nil {
+		return nil, err
+	}
+	if attestationsAsBytes == nil {
+		return attestations, nil
+	}
+	err = json.Unmarshal(attestationsAsBytes, &attestations)
+	return attestations, err
+}
+
+// checkAttestation checks an attestation is about the chunk as it was judged:
+// the current revision of the log and the results committed by every anticheat
+func checkAttestation(attestation Attestation, contract Contract, mediaLogSubmit MediaLogSubmit) error {
+	log := mediaLogSubmit.Log
+	if attestation.Revision != log.Revision {
+		return fmt.Errorf("attestation is for revision %d, log is at revision %d", attestation.Revision, log.Revision)
+	}
+	if attestation.LogDigest != log.Digest {
+		return fmt.Errorf("attestation log digest %s differs from the submitted %s", attestation.LogDigest, log.Digest)
+	}
+	antiCheatIds := contract.AntiCheatIds
+	revealed := 0
+	for _, id := range antiCheatIds {
+		commitment, ok := mediaLogSubmit.AntiCheatResultCommitment[id]
+		if !ok {
+			//defaulted on the chunk
+			if _, ok := attestation.ResultDigests[id]; ok {
+				return fmt.Errorf("attestation has a result of %s, which defaulted", id)
+			}
+			continue
+		}
+		revealed++
+		if attestation.ResultDigests[id] != commitment.Digest {
+			return fmt.Errorf("attestation result digest of %s differs from the committed %s", id, commitment.Digest)
+		}
+	}
+	if len(attestation.ResultDigests) != revealed {
+		return fmt.Errorf("attestation has %d result digests for %d revealed results", len(attestation.ResultDigests), revealed)
+	}
+	tally := attestation.Tally
+	if len(tally.CountArray) != len(antiCheatIds) {
+		return fmt.Errorf("attestation counts %d anticheats, contract has %d", len(tally.CountArray), len(antiCheatIds))
+	}
+	if attestation.Report.ImpressionCount != log.ImpressionCount {
+		return fmt.Errorf("attestation has %d impressions, submitted %d", attestation.Report.ImpressionCount, log.ImpressionCount)
+	}
+	if tally.RealFlow < 0 || tally.FakeFlow < 0 || tally.RealFlow+tally.FakeFlow > float64(log.ImpressionCount) {
+		return fmt.Errorf("attestation flow %g real, %g fake out of range, %d impressions", tally.RealFlow, tally.FakeFlow, log.ImpressionCount)
+	}
+	return nil
+}
+
+// submitAttestation records the attestation of an oracle and settles the
+// chunk once a quorum of oracles submitted the same one
+// args[0]:attestation JSON
+// args[1]:signature of the attestation payload, hex, empty for X509 accounts
+func submitAttestation(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", fmt.Errorf("Incorrect arguments. Expecting 2 value")
+	}
+	var attestation Attestation
+	err := json.Unmarshal([]byte(args[0]), &attestation)
+	if err != nil {
+		return "", fmt.Errorf("attestation format error: %s", err)
+	}
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return "", fmt.Errorf("could not get ID: %w", err)
+	}
+	governance, err := getGovernanceInfo(stub)
+	if err != nil {
+		return "", err
+	}
+	if !governance.isOracle(id) {
+		return "", fmt.Errorf("%s is not an oracle", id)
+	}
+	logId := attestation.LogId
+	contractId, chunkIndex, err := splitLogId(logId)
+	if err != nil {
+		return "", err
+	}
+	progress, err := getChunkProgress(stub, contractId)
+	if err != nil {
+		return "", err
+	}
+	if progress == nil || chunkIndex >= progress.ChunkCount {
+		return "", fmt.Errorf("no chunk %d submitted for contract %s", chunkIndex, contractId)
+	}
+	if progress.Settled[chunkIndex] {
+		//a late attestation changes nothing
+		return getSettlementRecordJson(stub, contractId)
+	}
+	sc, err := getSignatureContract(stub, contractId)
+	if err != nil {
+		return "", err
+	}
+	mediaLogSubmit, err := getMediaLogSubmit(stub, logId)
+	if err != nil {
+		return "", err
+	}
+	if !mediaLogSubmit.Judged {
+		return "", fmt.Errorf("log %s is not judged yet", logId)
+	}
+	err = checkAttestation(attestation, sc.Contract, mediaLogSubmit)
+	if err != nil {
+		return "", err
+	}
+	attestationPayload, err := getAttestationPayload(stub, attestation)
+	if err != nil {
+		return "", err
+	}
+	signature, approval, err := acceptSignature(stub, id, attestationPayload, args[1])
+	if err != nil {
+		return "", err
+	}
+	attestations, err := getAttestations(stub, logId)
+	if err != nil {
+		return "", err
+	}
+	digest := payload.Digest(attestationPayload)
+	attestations[id] = OracleAttestation{Attestation: attestation, Digest: digest, Signature: signature, Approval: approval}
+	attestationsAsBytes, _ := json.Marshal(attestations)
+	stub.PutState(logId+"_attestations", attestationsAsBytes)
+
+	agreed := 0
+	for _, a := range attestations {
+		if a.Digest == digest {
+			agreed++
+		}
+	}
+	if agreed >= governance.OracleQuorum {
+		return settleChunk(stub, logId)
+	}
+	return "", nil
+}
+
+// getAgreedAttestation returns the attestation a quorum of the current
+// oracles signed for the current revision of a chunk, with its digest and
+// the oracles that signed it
+func getAgreedAttestation(stub shim.ChaincodeStubInterface, logId string, contract Contract, mediaLogSubmit MediaLogSubmit) (*Attestation, string, []string, error) {
+	governance, err := getGovernanceInfo(stub)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	attestations, err := getAttestations(stub, logId)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	//oracles in order, so every endorser picks the same attestation
+	oracleIds := make([]string, 0, len(attestations))
+	for oracleId := range attestations {
+		oracleIds = append(oracleIds, oracleId)
+	}
+	sort.Strings(oracleIds)
+	agreed := make(map[string][]string)
+	for _, oracleId := range oracleIds {
+		a := attestations[oracleId]
+		if !governance.isOracle(oracleId) {
+			continue
+		}
+		if checkAttestation(a.Attestation, contract, mediaLogSubmit) != nil {
+			continue
+		}
+		attestationPayload, err := getAttestationPayload(stub, a.Attestation)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if payload.Digest(attestationPayload) != a.Digest {
+			continue
+		}
+		if verifyWithAccount(stub, oracleId, attestationPayload, a.Signature, a.Approval) != nil {
+			continue
+		}
+		agreed[a.Digest] = append(agreed[a.Digest], oracleId)
+		if len(agreed[a.Digest]) >= governance.OracleQuorum {
+			attestation := a.Attestation
+			return &attestation, a.Digest, agreed[a.Digest], nil
+		}
+	}
+	return nil, "", nil, fmt.Errorf("no %d oracles agree on the settlement of log %s", governance.OracleQuorum, logId)
+}
+
+// getAttestationList returns the attestations submitted for a chunk
+// args[0]: log id of the chunk
+func getAttestationList(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("Incorrect arguments. Expecting 1 argument")
+	}
+	attestations, err := stub.GetState(args[0] + "_attestations")
+	if err != nil {
+		return "", err
+	}
+	return string(attestations), nil
+}
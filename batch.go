@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// A batch runs many signatures, judgements and settlements in one
+// transaction. Every operation runs over an overlay of the state, so an
+// account or balance the operations share is read and written once per
+// batch instead of conflicting between transactions.
+const (
+	BATCH_ATOMIC = "atomic" // any failed operation fails the batch
+	BATCH_EACH   = "each"   // failed operations are reported and left out
+)
+
+// operations a batch may carry, all run as the identity submitting the batch
+var batchOperations = map[string]func(shim.ChaincodeStubInterface, []string) (string, error){
+	"mediaAntiConfirm":  noResult(mediaAntiConfirm),
+	"anticheatCommit":   noResult(anticheatCommit),
+	"anticheatConfirm":  noResult(anticheatConfirm),
+	"closeReveal":       noResult(closeReveal),
+	"submitAttestation": submitAttestation,
+	"settleAccount":     settleAccount,
+	"releaseSettlement": releaseSettlement,
+}
+
+func noResult(fn func(shim.ChaincodeStubInterface, []string) error) func(shim.ChaincodeStubInterface, []string) (string, error) {
+	return func(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+		return "", fn(stub, args)
+	}
+}
+
+type BatchOperation struct {
+	Fn   string
+	Args []string
+}
+
+type BatchResult struct {
+	Fn     string
+	Result string
+	Error  string
+}
+
+// args[0]: JSON list of BatchOperation
+// args[1]: atomic or each
+func batch(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", fmt.Errorf("Incorrect arguments. Expecting 2 value")
+	}
+	var operations []BatchOperation
+	err := json.Unmarshal([]byte(args[0]), &operations)
+	if err != nil {
+		return "", fmt.Errorf("batch format error: %s", err)
+	}
+	if args[1] != BATCH_ATOMIC && args[1] != BATCH_EACH {
+		return "", fmt.Errorf("unknown batch mode %s", args[1])
+	}
+	for i, operation := range operations {
+		if _, ok := batchOperations[operation.Fn]; !ok {
+			return "", fmt.Errorf("batch operation %d: %s can not be batched", i, operation.Fn)
+		}
+	}
+	overlay := newOverlayStub(stub)
+	results := make([]BatchResult, len(operations))
+	for i, operation := range operations {
+		results[i].Fn = operation.Fn
+		//each operation on its own overlay, so a failed one leaves nothing behind
+		item := newOverlayStub(overlay)
+		result, err := batchOperations[operation.Fn](item, operation.Args)
+		if err == nil {
+			err = item.flush()
+		}
+		if err != nil {
+			if args[1] == BATCH_ATOMIC {
+				return "", fmt.Errorf("batch operation %d, %s: %s", i, operation.Fn, err)
+			}
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].Result = result
+	}
+	err = overlay.flush()
+	if err != nil {
+		return "", err
+	}
+	resultsAsBytes, _ := json.Marshal(results)
+	return string(resultsAsBytes), nil
+}
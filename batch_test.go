@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// events drains the events set since the last call
+func (f *fixture) events() []string {
+	var names []string
+	for {
+		select {
+		case event := <-f.stub.ChaincodeEventsChannel:
+			names = append(names, event.EventName)
+		default:
+			return names
+		}
+	}
+}
+
+// Both chunks default on every anticheat, each closeReveal of the batch
+// reads the credit the one before it wrote
+func TestBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		logIds  []string // closed after the first chunk, "" for the second chunk, "first" for the first again
+		fns     []string // operations without arguments after the closeReveals
+		mode    string
+		wantErr string
+		errors  []bool // operations reported failed
+		judged  []bool
+		credit  string // of each anticheat
+		events  []string
+	}{
+		{
+			name:   "atomic",
+			logIds: []string{""},
+			mode:   BATCH_ATOMIC,
+			errors: []bool{false, false},
+			judged: []bool{true, true},
+			credit: "-2E+02",
+			events: []string{"batch"},
+		},
+		{
+			name:    "atomic with a failed operation",
+			logIds:  []string{"nope"},
+			mode:    BATCH_ATOMIC,
+			wantErr: "batch operation 1, closeReveal",
+			judged:  []bool{false, false},
+			credit:  "0",
+		},
+		{
+			name:   "each with a failed operation",
+			logIds: []string{"nope", ""},
+			mode:   BATCH_EACH,
+			errors: []bool{false, true, false},
+			judged: []bool{true, true},
+			credit: "-2E+02",
+			events: []string{"batch"},
+		},
+		{
+			name:   "each closing a chunk twice",
+			logIds: []string{"first"},
+			mode:   BATCH_EACH,
+			errors: []bool{false, true},
+			judged: []bool{true, false},
+			credit: "-1E+02",
+			events: []string{"chunkJudged"},
+		},
+		{
+			name:    "not batchable",
+			fns:     []string{"setGovernance"},
+			mode:    BATCH_EACH,
+			wantErr: "can not be batched",
+			judged:  []bool{false, false},
+			credit:  "0",
+		},
+		{
+			name:    "unknown mode",
+			mode:    "some",
+			wantErr: "unknown batch mode",
+			judged:  []bool{false, false},
+			credit:  "0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, nil)
+			contractId := f.contract(ContractOptions{})
+			chunks := []string{f.submit(contractId, 0, 2, testMediaLog), f.submit(contractId, 1, 2, testMediaLog)}
+			f.now += DEFAULT_COMMIT_WINDOW + DEFAULT_REVEAL_WINDOW
+			f.events()
+
+			operations := []BatchOperation{{Fn: "closeReveal", Args: []string{chunks[0]}}}
+			for _, logId := range tt.logIds {
+				switch logId {
+				case "":
+					logId = chunks[1]
+				case "first":
+					logId = chunks[0]
+				}
+				operations = append(operations, BatchOperation{Fn: "closeReveal", Args: []string{logId}})
+			}
+			for _, fn := range tt.fns {
+				operations = append(operations, BatchOperation{Fn: fn})
+			}
+			operationsAsBytes, _ := json.Marshal(operations)
+			result, err := f.invoke("media", "batch", string(operationsAsBytes), tt.mode)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				var results []BatchResult
+				if err := json.Unmarshal([]byte(result), &results); err != nil {
+					t.Fatal(err)
+				}
+				if len(results) != len(tt.errors) {
+					t.Fatalf("got %d results", len(results))
+				}
+				for i, failed := range tt.errors {
+					if results[i].Fn != "closeReveal" || (results[i].Error != "") != failed {
+						t.Fatalf("result %d: %+v", i, results[i])
+					}
+				}
+			}
+			for i, judged := range tt.judged {
+				if got := f.mediaLogSubmit(chunks[i]).Judged; got != judged {
+					t.Fatalf("chunk %d: got judged %v, want %v", i, got, judged)
+				}
+			}
+			for _, name := range []string{"ac1", "ac2"} {
+				if credit := f.account(name).Credit; credit != tt.credit {
+					t.Fatalf("%s has credit %s, want %s", name, credit, tt.credit)
+				}
+			}
+			if events := f.events(); strings.Join(events, ",") != strings.Join(tt.events, ",") {
+				t.Fatalf("got events %v, want %v", events, tt.events)
+			}
+		})
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	stub := shim.NewMockStub(TEST_CHAINCODE, nil)
+	stub.MockTransactionStart("tx1")
+	stub.PutState("a", []byte("1"))
+	stub.PutState("b", []byte("2"))
+
+	overlay := newOverlayStub(stub)
+	item := newOverlayStub(overlay)
+	item.PutState("a", []byte("3"))
+	item.DelState("b")
+	item.PutState("c", []byte("4"))
+	if value, _ := item.GetState("a"); string(value) != "3" {
+		t.Fatalf("item reads a as %s", value)
+	}
+	if value, _ := item.GetState("b"); value != nil {
+		t.Fatalf("item reads deleted b as %s", value)
+	}
+	if value, _ := overlay.GetState("a"); string(value) != "1" {
+		t.Fatalf("overlay reads a as %s before the item flushed", value)
+	}
+	item.flush()
+	if value, _ := overlay.GetState("a"); string(value) != "3" {
+		t.Fatalf("overlay reads a as %s", value)
+	}
+	if value, _ := stub.GetState("a"); string(value) != "1" {
+		t.Fatalf("stub reads a as %s before the overlay flushed", value)
+	}
+	overlay.flush()
+	for key, want := range map[string]string{"a": "3", "b": "", "c": "4"} {
+		if value, _ := stub.GetState(key); string(value) != want {
+			t.Fatalf("stub reads %s as %q, want %q", key, value, want)
+		}
+	}
+}
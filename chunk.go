@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"chaincodedev/chaincode/liqi/hwxf/settlement"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// MAX_CHUNK_COUNT bounds the chunks of a media log, the progress of every
+// chunk is rewritten with each submission and settlement
+const MAX_CHUNK_COUNT = 1000
+
+// ChunkProgress follows the numbered chunks of a contract's media log.
+// Each chunk is judged and settled on its own, Tally adds up the settled
+// chunks and the contract is paid out once all of them are settled.
+type ChunkProgress struct {
+	ChunkCount int
+	Submitted  []bool
+	Settled    []bool
+	Tally      settlement.Tally
+	Finalized  bool
+}
+
+// getLogId returns the key of chunk i of the media log of a contract
+func getLogId(contractId string, chunk int) string {
+	return fmt.Sprintf("%s_log_%d", contractId, chunk)
+}
+
+// splitLogId returns the contract id and chunk index of a log id
+func splitLogId(logId string) (string, int, error) {
+	i := strings.LastIndex(logId, "_log_")
+	if i < 0 {
+		return "", 0, fmt.Errorf("log id format error: %s", logId)
+	}
+	chunk, err := strconv.Atoi(logId[i+len("_log_"):])
+	if err != nil || chunk < 0 {
+		return "", 0, fmt.Errorf("log id format error: %s", logId)
+	}
+	return logId[:i], chunk, nil
+}
+
+// getChunkProgress returns the chunk progress of a contract, nil before its first chunk is submitted
+func getChunkProgress(stub shim.ChaincodeStubInterface, contractId string) (*ChunkProgress, error) {
+	progressAsBytes, err := stub.GetState(contractId + "_chunks")
+	if err != nil {
+		return nil, err
+	}
+	if progressAsBytes == nil {
+		return nil, nil
+	}
+	var progress ChunkProgress
+	err = json.Unmarshal(progressAsBytes, &progress)
+	if err != nil {
+		return nil, err
+	}
+	return &progress, nil
+}
+
+func putChunkProgress(stub shim.ChaincodeStubInterface, contractId string, progress *ChunkProgress) error {
+	progressAsBytes, _ := json.Marshal(progress)
+	return stub.PutState(contractId+"_chunks", progressAsBytes)
+}
+
+// parseChunk reads the chunk index and count of a submission and checks them
+// against the chunks of the contract submitted so far
+func parseChunk(progress *ChunkProgress, chunkIndex string, chunkCount string) (int, int, error) {
+	index, err := strconv.Atoi(chunkIndex)
+	if err != nil {
+		return 0, 0, fmt.Errorf("chunk index format error: %s", chunkIndex)
+	}
+	count, err := strconv.Atoi(chunkCount)
+	if err != nil || count < 1 {
+		return 0, 0, fmt.Errorf("chunk count format error: %s", chunkCount)
+	}
+	if count > MAX_CHUNK_COUNT {
+		return 0, 0, fmt.Errorf("chunk count %d over the maximum of %d", count, MAX_CHUNK_COUNT)
+	}
+	if index < 0 || index >= count {
+		return 0, 0, fmt.Errorf("chunk index %d out of range, %d chunks", index, count)
+	}
+	if progress != nil && progress.ChunkCount != count {
+		return 0, 0, fmt.Errorf("chunk count %d differs from the %d chunks submitted before", count, progress.ChunkCount)
+	}
+	return index, count, nil
+}
+
+// getChunkProgressQuery returns how many chunks of a contract are submitted and settled
+// args[0]: contractId
+func getChunkProgressQuery(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("Incorrect arguments. Expecting 1 argument")
+	}
+	progress, err := stub.GetState(args[0] + "_chunks")
+	if err != nil {
+		return "", err
+	}
+	return string(progress), nil
+}
+
+// getReconcileReport returns the reconcile report of the settlement of a log chunk
+// args[0]: log id of the chunk
+func getReconcileReport(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("Incorrect arguments. Expecting 1 argument")
+	}
+	report, err := stub.GetState(args[0] + "_reconcile")
+	if err != nil {
+		return "", err
+	}
+	return string(report), nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseChunk(t *testing.T) {
+	tests := []struct {
+		name      string
+		progress  *ChunkProgress
+		index     string
+		count     string
+		wantIndex int
+		wantCount int
+		wantErr   string
+	}{
+		{name: "first", index: "0", count: "3", wantIndex: 0, wantCount: 3},
+		{name: "last", progress: &ChunkProgress{ChunkCount: 3}, index: "2", count: "3", wantIndex: 2, wantCount: 3},
+		{name: "maximum", index: "0", count: fmt.Sprint(MAX_CHUNK_COUNT), wantCount: MAX_CHUNK_COUNT},
+		{name: "over the maximum", index: "0", count: fmt.Sprint(MAX_CHUNK_COUNT + 1), wantErr: "over the maximum"},
+		{name: "huge", index: "0", count: "9223372036854775807", wantErr: "over the maximum"},
+		{name: "no chunks", index: "0", count: "0", wantErr: "chunk count format error"},
+		{name: "index out of range", index: "3", count: "3", wantErr: "out of range"},
+		{name: "negative index", index: "-1", count: "3", wantErr: "out of range"},
+		{name: "index not a number", index: "x", count: "3", wantErr: "chunk index format error"},
+		{name: "count changed", progress: &ChunkProgress{ChunkCount: 2}, index: "0", count: "3", wantErr: "differs from the 2 chunks"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index, count, err := parseChunk(tt.progress, tt.index, tt.count)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || index != tt.wantIndex || count != tt.wantCount {
+				t.Fatalf("got %d, %d, %v, want %d, %d", index, count, err, tt.wantIndex, tt.wantCount)
+			}
+		})
+	}
+}
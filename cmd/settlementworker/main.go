@@ -0,0 +1,254 @@
+// Command settlementworker settles a judged log chunk off-chain. It reads the
+// contract and the chunk from the ledger, downloads the media log and the
+// anticheat results from their storage (see package storage), checks them against their on-chain commitments,
+// reconciles and tallies them with package settlement and submits the
+// result as an oracle attestation. The attestation is signed here with the
+// oracle key, which never leaves the worker. The chaincode settles the chunk
+// once a quorum of oracles submitted the same attestation.
+//
+// It talks to the ledger through the peer CLI, so it runs wherever an
+// oracle identity is configured for peer:
+//
+//	settlementworker -channel mychannel -chaincode hwxf -key oracle.pem mycontract_log_0
+//
+// With -simulate it previews the settlement of a contract instead. The
+// chaincode pays out on the chunks settled or attested so far, the worker
+// fetches and tallies the other judged chunks itself, with the hypothetical
+// results given with -result in place of the submitted ones:
+//
+//	settlementworker -channel mychannel -chaincode hwxf -simulate -result 0:anticheat1:ipfs://... mycontract
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"chaincodedev/chaincode/liqi/hwxf/logformat"
+	"chaincodedev/chaincode/liqi/hwxf/payload"
+	"chaincodedev/chaincode/liqi/hwxf/settlement"
+	"chaincodedev/chaincode/liqi/hwxf/signing"
+	"chaincodedev/chaincode/liqi/hwxf/storage"
+)
+
+// the chaincode state the worker reads, other fields are ignored
+type signatureContract struct {
+	Contract payload.Contract
+}
+
+type mediaLogSubmit struct {
+	Log                       payload.Log
+	AntiCheatResultCommitment map[string]payload.FileCommitment
+	Judged                    bool
+	Defaulted                 []string
+	Credits                   map[string]float64
+}
+
+// Ledger queries and invokes the chaincode
+type Ledger interface {
+	Query(args ...string) ([]byte, error)
+	Invoke(args ...string) error
+}
+
+// peerLedger runs the peer CLI
+type peerLedger struct {
+	peer      string
+	channel   string
+	chaincode string
+	flags     []string
+}
+
+func (l peerLedger) run(command string, args []string, extra ...string) ([]byte, error) {
+	ctor, _ := json.Marshal(struct{ Args []string }{args})
+	cmdArgs := []string{"chaincode", command, "-C", l.channel, "-n", l.chaincode, "-c", string(ctor)}
+	cmdArgs = append(cmdArgs, l.flags...)
+	cmdArgs = append(cmdArgs, extra...)
+	cmd := exec.Command(l.peer, cmdArgs...)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("peer chaincode %s %s: %v", command, args[0], err)
+	}
+	return output, nil
+}
+
+func (l peerLedger) Query(args ...string) ([]byte, error) {
+	return l.run("query", args)
+}
+
+func (l peerLedger) Invoke(args ...string) error {
+	_, err := l.run("invoke", args, "--waitForEvent")
+	return err
+}
+
+// fetch downloads a committed file and decodes it
+func fetch(store *storage.Storage, commitment payload.FileCommitment) (*logformat.File, error) {
+	data, err := store.Fetch(context.Background(), commitment.Address, commitment.Size)
+	if err != nil {
+		return nil, err
+	}
+	file, err := commitment.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", commitment.Address, err)
+	}
+	return file, nil
+}
+
+// attest computes the attestation of chunk logId
+func attest(ledger Ledger, store *storage.Storage, logId string) (settlement.Attestation, error) {
+	var attestation settlement.Attestation
+	i := strings.LastIndex(logId, "_log_")
+	if i < 0 {
+		return attestation, fmt.Errorf("log id format error: %s", logId)
+	}
+	var sc signatureContract
+	output, err := ledger.Query("getContract", logId[:i])
+	if err != nil {
+		return attestation, err
+	}
+	if err := json.Unmarshal(output, &sc); err != nil {
+		return attestation, fmt.Errorf("contract %s: %v", logId[:i], err)
+	}
+	var mls mediaLogSubmit
+	output, err = ledger.Query("getContract", logId)
+	if err != nil {
+		return attestation, err
+	}
+	if err := json.Unmarshal(output, &mls); err != nil {
+		return attestation, fmt.Errorf("log %s: %v", logId, err)
+	}
+
+	if !mls.Judged {
+		return attestation, fmt.Errorf("log %s is not judged yet", logId)
+	}
+	mediaLog, err := fetch(store, mls.Log.FileCommitment)
+	if err != nil {
+		return attestation, err
+	}
+	antiCheatIds := sc.Contract.AntiCheatIds
+	results := make([]*logformat.File, len(antiCheatIds))
+	resultDigests := make(map[string]string, len(antiCheatIds))
+	for i, id := range antiCheatIds {
+		commitment, ok := mls.AntiCheatResultCommitment[id]
+		if !ok {
+			//defaulted, settled without its judgements
+			continue
+		}
+		results[i], err = fetch(store, commitment)
+		if err != nil {
+			return attestation, err
+		}
+		resultDigests[id] = commitment.Digest
+	}
+	tally, report, err := settlement.Settle(sc.Contract, mls.Log, mediaLog, results, mls.Credits)
+	if err != nil {
+		return attestation, err
+	}
+	return settlement.Attestation{
+		LogId:         logId,
+		Revision:      mls.Log.Revision,
+		LogDigest:     mls.Log.Digest,
+		ResultDigests: resultDigests,
+		Tally:         tally,
+		Report:        report,
+	}, nil
+}
+
+func main() {
+	peer := flag.String("peer", "peer", "path of the peer CLI")
+	channel := flag.String("channel", "", "channel of the chaincode")
+	chaincode := flag.String("chaincode", "", "chaincode name")
+	peerFlags := flag.String("peer-flags", "", "extra flags for peer chaincode, e.g. orderer and TLS settings")
+	keyFile := flag.String("key", "", "PEM private key of the oracle account, empty for X509 accounts")
+	algorithm := flag.String("algorithm", signing.ALGORITHM_ECDSA_P256, "signature algorithm of the oracle account")
+	timeout := flag.Duration("timeout", storage.DEFAULT_TIMEOUT, "timeout of each download")
+	maxBytes := flag.Int64("max-bytes", storage.DEFAULT_MAX_BYTES, "size limit of each download")
+	ipfsGateway := flag.String("ipfs-gateway", "http://127.0.0.1:8080", "trustless gateway for ipfs:// addresses")
+	s3Endpoint := flag.String("s3-endpoint", "", "endpoint for s3:// addresses, empty for AWS")
+	s3Region := flag.String("s3-region", os.Getenv("AWS_REGION"), "region for s3:// addresses")
+	fileRoot := flag.String("file-root", "", "directory file:// addresses are read from, empty to refuse them")
+	dryRun := flag.Bool("n", false, "print the attestation instead of submitting it")
+	simulateContract := flag.Bool("simulate", false, "print what settling the contract given as argument would do")
+	hypothetical := hypotheticals{}
+	flag.Var(hypothetical, "result", "chunk:antiCheatId:address of a result to simulate with, repeatable")
+	flag.Parse()
+	if flag.NArg() == 0 || *channel == "" || *chaincode == "" {
+		fmt.Fprintln(os.Stderr, "usage: settlementworker -channel C -chaincode N [-key oracle.pem] logId...")
+		fmt.Fprintln(os.Stderr, "       settlementworker -channel C -chaincode N -simulate [-result chunk:antiCheatId:address]... contractId")
+		os.Exit(2)
+	}
+	var privateKey []byte
+	if *keyFile != "" {
+		var err error
+		privateKey, err = ioutil.ReadFile(*keyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	ledger := peerLedger{peer: *peer, channel: *channel, chaincode: *chaincode, flags: strings.Fields(*peerFlags)}
+	limits := storage.Limits{Timeout: *timeout, MaxBytes: *maxBytes}
+	store := storage.New()
+	store.Register("http", storage.HTTPFetcher{}, limits)
+	store.Register("https", storage.HTTPFetcher{}, limits)
+	store.Register("ipfs", storage.IPFSFetcher{Gateway: *ipfsGateway}, limits)
+	store.Register("s3", storage.S3Fetcher{
+		Endpoint:     *s3Endpoint,
+		Region:       *s3Region,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}, limits)
+	store.Register("file", storage.FileFetcher{Root: *fileRoot}, limits)
+
+	if *simulateContract {
+		output, err := simulate(ledger, store, flag.Arg(0), hypothetical)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", flag.Arg(0), err)
+			os.Exit(1)
+		}
+		fmt.Println(string(output))
+		return
+	}
+
+	failed := false
+	for _, logId := range flag.Args() {
+		attestation, err := attest(ledger, store, logId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", logId, err)
+			failed = true
+			continue
+		}
+		attestationJson, _ := json.Marshal(attestation)
+		if *dryRun {
+			fmt.Println(string(attestationJson))
+			continue
+		}
+		var signature string
+		if privateKey != nil {
+			domain := payload.Domain{ChannelID: *channel, ChaincodeName: *chaincode}
+			sig, err := signing.Sign(*algorithm, attestation.Encode(domain), string(privateKey))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", logId, err)
+				failed = true
+				continue
+			}
+			signature = hex.EncodeToString(sig)
+		}
+		if err := ledger.Invoke("submitAttestation", string(attestationJson), signature); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", logId, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: attested revision %d\n", logId, attestation.Revision)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
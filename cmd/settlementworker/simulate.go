@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"chaincodedev/chaincode/liqi/hwxf/logformat"
+	"chaincodedev/chaincode/liqi/hwxf/settlement"
+	"chaincodedev/chaincode/liqi/hwxf/storage"
+)
+
+// where the worker takes the judgements of a pending chunk from
+const (
+	SOURCE_REVEALED     = "revealed"     // the revealed judgement files
+	SOURCE_HYPOTHETICAL = "hypothetical" // some judgement files given with -result
+)
+
+// hypotheticals are result files to simulate with in place of the submitted
+// ones, "chunk:antiCheatId:address" on the command line. Account ids are
+// base64, with '/' and '=' in them but never ':'.
+type hypotheticals map[int]map[string]string
+
+func (h hypotheticals) String() string {
+	return fmt.Sprint(map[int]map[string]string(h))
+}
+
+func (h hypotheticals) Set(value string) error {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+		return fmt.Errorf("expecting chunk:antiCheatId:address: %s", value)
+	}
+	chunk, err := strconv.Atoi(parts[0])
+	if err != nil || chunk < 0 {
+		return fmt.Errorf("chunk format error: %s", parts[0])
+	}
+	if h[chunk] == nil {
+		h[chunk] = make(map[string]string)
+	}
+	h[chunk][parts[1]] = parts[2]
+	return nil
+}
+
+type simulatedChunk struct {
+	Index     int
+	Source    string
+	Tally     settlement.Tally
+	Defaulted []string
+}
+
+// simulation is what settling a contract now would do. Ledger is the
+// simulateSettlement of the chaincode, the payout on the settled and
+// attested chunks. Chunks are the pending chunks the worker tallied, Pending
+// those without a judgement yet, and Tally that of every simulated chunk.
+type simulation struct {
+	ContractId string
+	Ledger     json.RawMessage
+	Chunks     []simulatedChunk
+	Pending    []int
+	Tally      settlement.Tally
+}
+
+// fetchHypothetical downloads a result file nothing was committed for
+func fetchHypothetical(store *storage.Storage, address string) (*logformat.File, error) {
+	data, err := store.Fetch(context.Background(), address, 0)
+	if err != nil {
+		return nil, err
+	}
+	file, err := logformat.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", address, err)
+	}
+	if err := file.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", address, err)
+	}
+	return file, nil
+}
+
+// judgingCredits returns the credits a chunk is judged with, those of the
+// anticheat accounts now if it is not judged yet
+func judgingCredits(ledger Ledger, contract signatureContract, mls mediaLogSubmit) (map[string]float64, error) {
+	if mls.Credits != nil || settlement.AggregatorName(contract.Contract.Options) != settlement.AGGREGATOR_CREDIT {
+		return mls.Credits, nil
+	}
+	credits := make(map[string]float64)
+	for _, id := range contract.Contract.AntiCheatIds {
+		output, err := ledger.Query("getAccount", id)
+		if err != nil {
+			return nil, err
+		}
+		var account struct{ Credit string }
+		if err := json.Unmarshal(output, &account); err != nil {
+			return nil, fmt.Errorf("account %s: %v", id, err)
+		}
+		credits[id], _ = strconv.ParseFloat(account.Credit, 64)
+	}
+	return credits, nil
+}
+
+// simulatedTally runs settlement.Settle on a pending chunk, with the revealed
+// judgements and the hypothetical ones in their place. It returns "" as
+// source if the chunk has no judgement to settle on yet.
+func simulatedTally(ledger Ledger, store *storage.Storage, logId string, contract signatureContract, hypothetical map[string]string) (simulatedChunk, error) {
+	var chunk simulatedChunk
+	output, err := ledger.Query("getContract", logId)
+	if err != nil {
+		return chunk, err
+	}
+	if len(strings.TrimSpace(string(output))) == 0 {
+		//not submitted yet
+		return chunk, nil
+	}
+	var mls mediaLogSubmit
+	if err := json.Unmarshal(output, &mls); err != nil {
+		return chunk, fmt.Errorf("log %s: %v", logId, err)
+	}
+	antiCheatIds := contract.Contract.AntiCheatIds
+	results := make([]*logformat.File, len(antiCheatIds))
+	for i, id := range antiCheatIds {
+		if address, ok := hypothetical[id]; ok {
+			results[i], err = fetchHypothetical(store, address)
+			chunk.Source = SOURCE_HYPOTHETICAL
+		} else if commitment, ok := mls.AntiCheatResultCommitment[id]; ok {
+			results[i], err = fetch(store, commitment)
+			if chunk.Source == "" {
+				chunk.Source = SOURCE_REVEALED
+			}
+		} else {
+			chunk.Defaulted = append(chunk.Defaulted, id)
+			continue
+		}
+		if err != nil {
+			return chunk, err
+		}
+	}
+	if chunk.Source == "" {
+		return chunk, nil
+	}
+	mediaLog, err := fetch(store, mls.Log.FileCommitment)
+	if err != nil {
+		return chunk, err
+	}
+	credits, err := judgingCredits(ledger, contract, mls)
+	if err != nil {
+		return chunk, err
+	}
+	chunk.Tally, _, err = settlement.Settle(contract.Contract, mls.Log, mediaLog, results, credits)
+	if err != nil {
+		return chunk, fmt.Errorf("%s: %v", logId, err)
+	}
+	return chunk, nil
+}
+
+// simulate previews the settlement of a contract. The chaincode pays out on
+// the settled and attested chunks, which it only reads from the state; the
+// worker fetches the files of the pending chunks and tallies them the same
+// way attest does, with the hypothetical results in place of the submitted.
+func simulate(ledger Ledger, store *storage.Storage, contractId string, hypothetical hypotheticals) ([]byte, error) {
+	simulated, err := ledger.Query("simulateSettlement", contractId)
+	if err != nil {
+		return nil, err
+	}
+	var onLedger struct {
+		Chunks  []simulatedChunk
+		Pending []int
+	}
+	if err := json.Unmarshal(simulated, &onLedger); err != nil {
+		return nil, fmt.Errorf("simulation of %s: %v", contractId, err)
+	}
+	var sc signatureContract
+	output, err := ledger.Query("getContract", contractId)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(output, &sc); err != nil {
+		return nil, fmt.Errorf("contract %s: %v", contractId, err)
+	}
+	pending := make(map[int]bool, len(onLedger.Pending))
+	for _, i := range onLedger.Pending {
+		pending[i] = true
+	}
+	for i, addresses := range hypothetical {
+		if !pending[i] {
+			return nil, fmt.Errorf("chunk %d is settled, attested or not in the contract", i)
+		}
+		for id := range addresses {
+			if !contains(sc.Contract.AntiCheatIds, id) {
+				return nil, fmt.Errorf("%s is not an anticheat of contract %s", id, contractId)
+			}
+		}
+	}
+
+	s := simulation{ContractId: contractId, Ledger: json.RawMessage(simulated)}
+	for _, chunk := range onLedger.Chunks {
+		s.Tally.Add(chunk.Tally)
+	}
+	for _, i := range onLedger.Pending {
+		chunk, err := simulatedTally(ledger, store, fmt.Sprintf("%s_log_%d", contractId, i), sc, hypothetical[i])
+		if err != nil {
+			return nil, err
+		}
+		if chunk.Source == "" {
+			s.Pending = append(s.Pending, i)
+			continue
+		}
+		chunk.Index = i
+		s.Tally.Add(chunk.Tally)
+		s.Chunks = append(s.Chunks, chunk)
+	}
+	return json.MarshalIndent(s, "", "  ")
+}
+
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
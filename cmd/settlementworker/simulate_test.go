@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHypotheticalsSet(t *testing.T) {
+	id := "eDUwOTo6Q049YWMxL089T3JnMTo6Q049YWMxL089T3JnMQ=="
+	tests := []struct {
+		value   string
+		chunk   int
+		id      string
+		address string
+		wantErr bool
+	}{
+		{value: "0:" + id + ":ipfs://bafy", chunk: 0, id: id, address: "ipfs://bafy"},
+		{value: "12:a/b+c=:https://host:8443/r?x=1", chunk: 12, id: "a/b+c=", address: "https://host:8443/r?x=1"},
+		{value: "0/" + id + "=ipfs://bafy", wantErr: true},
+		{value: "0:" + id, wantErr: true},
+		{value: "0::ipfs://bafy", wantErr: true},
+		{value: "0:" + id + ":", wantErr: true},
+		{value: "-1:" + id + ":ipfs://bafy", wantErr: true},
+		{value: "x:" + id + ":ipfs://bafy", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			h := hypotheticals{}
+			err := h.Set(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v", err)
+			}
+			if err == nil && h[tt.chunk][tt.id] != tt.address {
+				t.Fatalf("got %v", h)
+			}
+		})
+	}
+}
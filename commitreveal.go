@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"chaincodedev/chaincode/liqi/hwxf/payload"
+	"chaincodedev/chaincode/liqi/hwxf/settlement"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// The anticheats judge a chunk in two phases so none can copy another's result.
+// They first commit to payload.JudgementCommit of their result with anticheatCommit.
+// The reveal phase opens once every anticheat committed or the commit window
+// is over, then they reveal the result with anticheatConfirm.
+const (
+	DEFAULT_COMMIT_WINDOW = 86400
+	DEFAULT_REVEAL_WINDOW = 86400
+	NO_REVEAL_CREDIT      = 100 //credit an anticheat loses for a judgement it didn't reveal
+)
+
+type JudgementCommit struct {
+	Hash      string
+	TimeStamp int64
+}
+
+func commitWindow(o ContractOptions) int64 {
+	if o.CommitWindow == 0 {
+		return DEFAULT_COMMIT_WINDOW
+	}
+	return o.CommitWindow
+}
+
+func revealWindow(o ContractOptions) int64 {
+	if o.RevealWindow == 0 {
+		return DEFAULT_REVEAL_WINDOW
+	}
+	return o.RevealWindow
+}
+
+// revealFrom returns when the reveal phase of a chunk opens
+func revealFrom(mediaLogSubmit MediaLogSubmit, options ContractOptions) int64 {
+	if mediaLogSubmit.RevealFrom != 0 {
+		return mediaLogSubmit.RevealFrom
+	}
+	return mediaLogSubmit.Log.TimeStamp + commitWindow(options)
+}
+
+func isAntiCheat(contract Contract, id string) bool {
+	return contains(contract.AntiCheatIds, id)
+}
+
+// args[0]:log id
+// args[1]:revision of the log that was judged
+// args[2]:judgement commit, hex
+func anticheatCommit(stub shim.ChaincodeStubInterface, args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("Incorrect arguments. Expecting 3 value")
+	}
+	logId := args[0]
+	revision, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("revision format error: %s", args[1])
+	}
+	if h, err := hex.DecodeString(args[2]); err != nil || len(h) != 32 {
+		return fmt.Errorf("judgement commit format error: %s", args[2])
+	}
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return fmt.Errorf("could not get ID: %w", err)
+	}
+	contractId, _, err := splitLogId(logId)
+	if err != nil {
+		return err
+	}
+	sc, err := getSignatureContract(stub, contractId)
+	if err != nil {
+		return err
+	}
+	if !isAntiCheat(sc.Contract, id) {
+		return fmt.Errorf("%s is not an anticheat of contract %s", id, contractId)
+	}
+	mediaLogSubmit, err := getMediaLogSubmit(stub, logId)
+	if err != nil {
+		return err
+	}
+	if mediaLogSubmit.Log.Revision != revision {
+		return fmt.Errorf("log %s was revised, judge revision %d", logId, mediaLogSubmit.Log.Revision)
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	if mediaLogSubmit.Judged || now >= revealFrom(mediaLogSubmit, sc.Contract.Options) {
+		return fmt.Errorf("commit phase of log %s is over", logId)
+	}
+	if mediaLogSubmit.JudgementCommits == nil {
+		mediaLogSubmit.JudgementCommits = make(map[string]JudgementCommit)
+	}
+	if _, ok := mediaLogSubmit.JudgementCommits[id]; ok {
+		return fmt.Errorf("%s already committed to a judgement of log %s", id, logId)
+	}
+	mediaLogSubmit.JudgementCommits[id] = JudgementCommit{Hash: strings.ToLower(args[2]), TimeStamp: now}
+	if len(mediaLogSubmit.JudgementCommits) == mediaLogSubmit.Log.AntiCheatNum {
+		mediaLogSubmit.RevealFrom = now
+	}
+	mls, _ := json.Marshal(mediaLogSubmit)
+	return stub.PutState(logId, mls)
+}
+
+// checkReveal checks an anticheat reveals, in the reveal phase, the result it committed to
+func checkReveal(stub shim.ChaincodeStubInterface, id string, logId string, mediaLogSubmit MediaLogSubmit, options ContractOptions, result FileCommitment, salt string) error {
+	if mediaLogSubmit.Judged {
+		return fmt.Errorf("log %s is already judged", logId)
+	}
+	commit, ok := mediaLogSubmit.JudgementCommits[id]
+	if !ok {
+		return fmt.Errorf("%s did not commit to a judgement of log %s", id, logId)
+	}
+	if _, ok := mediaLogSubmit.AntiCheatResultCommitment[id]; ok {
+		return fmt.Errorf("%s already revealed its judgement of log %s", id, logId)
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	from := revealFrom(mediaLogSubmit, options)
+	if now < from {
+		return fmt.Errorf("reveal phase of log %s opens at %d", logId, from)
+	}
+	if now >= from+revealWindow(options) {
+		return fmt.Errorf("reveal phase of log %s is over", logId)
+	}
+	domain, err := getSigningDomain(stub)
+	if err != nil {
+		return err
+	}
+	if payload.JudgementCommit(domain, logId, mediaLogSubmit.Log.Revision, id, result, salt) != commit.Hash {
+		return fmt.Errorf("revealed judgement of %s does not match its commit", id)
+	}
+	return nil
+}
+
+// allRevealed tells whether every anticheat that could still judge a chunk revealed its judgement
+func allRevealed(mediaLogSubmit MediaLogSubmit, options ContractOptions, now int64) bool {
+	if len(mediaLogSubmit.AntiCheatResultCommitment) != len(mediaLogSubmit.JudgementCommits) {
+		return false
+	}
+	return len(mediaLogSubmit.JudgementCommits) == mediaLogSubmit.Log.AntiCheatNum || now >= revealFrom(mediaLogSubmit, options)
+}
+
+// markJudged closes the judgement of a chunk. The anticheats without a
+// revealed judgement default on it, they get no share of the chunk and
+// lose NO_REVEAL_CREDIT whether or not they committed to a judgement.
+func markJudged(stub shim.ChaincodeStubInterface, logId string, contract Contract, mediaLogSubmit *MediaLogSubmit) error {
+	mediaLogSubmit.Judged = true
+	mediaLogSubmit.Defaulted = nil
+	recordCredits := settlement.AggregatorName(contract.Options) == settlement.AGGREGATOR_CREDIT
+	if recordCredits {
+		mediaLogSubmit.Credits = make(map[string]float64, len(contract.AntiCheatIds))
+	}
+	for _, id := range contract.AntiCheatIds {
+		_, revealed := mediaLogSubmit.AntiCheatResultCommitment[id]
+		if !revealed {
+			mediaLogSubmit.Defaulted = append(mediaLogSubmit.Defaulted, id)
+		}
+		if revealed && !recordCredits {
+			continue
+		}
+		account, err := getAccountInfo(stub, id)
+		if err != nil {
+			return err
+		}
+		credit, err := strconv.ParseFloat(account.Credit, 64)
+		if err != nil {
+			return err
+		}
+		if !revealed {
+			credit -= NO_REVEAL_CREDIT
+			account.Credit = strconv.FormatFloat(credit, 'E', -1, 64)
+			accountAsBytes, _ := json.Marshal(account)
+			stub.PutState(id, accountAsBytes)
+		}
+		if recordCredits {
+			//after the penalty, so a withheld judgement also costs weight
+			mediaLogSubmit.Credits[id] = credit
+		}
+	}
+	mls, _ := json.Marshal(mediaLogSubmit)
+	stub.PutState(logId, mls)
+	//the settlement workers can attest the chunk
+	event, _ := json.Marshal(ChunkJudgedEvent{LogId: logId, Revision: mediaLogSubmit.Log.Revision, Defaulted: mediaLogSubmit.Defaulted})
+	return stub.SetEvent("chunkJudged", event)
+}
+
+// closeReveal ends the judgement of a chunk whose reveal phase is over
+// with judgements still unrevealed, any party of the contract may call it
+// args[0]:log id
+func closeReveal(stub shim.ChaincodeStubInterface, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Incorrect arguments. Expecting 1 value")
+	}
+	logId := args[0]
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return fmt.Errorf("could not get ID: %w", err)
+	}
+	contractId, _, err := splitLogId(logId)
+	if err != nil {
+		return err
+	}
+	sc, err := getSignatureContract(stub, contractId)
+	if err != nil {
+		return err
+	}
+	if !isContractParty(sc.Contract, id) {
+		return fmt.Errorf("%s is not a party of contract %s", id, contractId)
+	}
+	mediaLogSubmit, err := getMediaLogSubmit(stub, logId)
+	if err != nil {
+		return err
+	}
+	if mediaLogSubmit.Judged {
+		return fmt.Errorf("log %s is already judged", logId)
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	deadline := revealFrom(mediaLogSubmit, sc.Contract.Options) + revealWindow(sc.Contract.Options)
+	if now < deadline {
+		return fmt.Errorf("reveal phase of log %s is open until %d", logId, deadline)
+	}
+	return markJudged(stub, logId, sc.Contract, &mediaLogSubmit)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"chaincodedev/chaincode/liqi/hwxf/payload"
+)
+
+const (
+	testMediaLog = "#hwxf v2 tsv\nimp-1\nimp-2\nimp-3\nimp-4\n"
+	testAllReal  = "#hwxf v2 tsv\nimp-1\t1\nimp-2\t1\nimp-3\t1\nimp-4\t1\n"
+	testHalfFake = "#hwxf v2 tsv\nimp-1\t1\nimp-2\t1\nimp-3\t-1\tBOT\nimp-4\t-1\tBOT\n"
+)
+
+func TestCommitReveal(t *testing.T) {
+	tests := []struct {
+		name    string
+		run     func(f *fixture, logId string) error
+		wantErr string
+		judged  bool
+	}{
+		{
+			name: "both commit then reveal",
+			run: func(f *fixture, logId string) error {
+				f.judge(logId, testAllReal, testHalfFake)
+				return nil
+			},
+			judged: true,
+		},
+		{
+			name: "reveal while the other anticheat may still commit",
+			run: func(f *fixture, logId string) error {
+				if err := f.commit("ac1", logId, testAllReal, "salt1"); err != nil {
+					return err
+				}
+				return f.reveal("ac1", logId, testAllReal, "salt1")
+			},
+			wantErr: "reveal phase of log",
+		},
+		{
+			name: "reveal once the commit window is over",
+			run: func(f *fixture, logId string) error {
+				if err := f.commit("ac1", logId, testAllReal, "salt1"); err != nil {
+					return err
+				}
+				f.now += DEFAULT_COMMIT_WINDOW
+				return f.reveal("ac1", logId, testAllReal, "salt1")
+			},
+			judged: true,
+		},
+		{
+			name: "reveal of another result",
+			run: func(f *fixture, logId string) error {
+				f.commit("ac1", logId, testAllReal, "salt1")
+				f.commit("ac2", logId, testHalfFake, "salt2")
+				return f.reveal("ac1", logId, testHalfFake, "salt1")
+			},
+			wantErr: "does not match its commit",
+		},
+		{
+			name: "reveal with another salt",
+			run: func(f *fixture, logId string) error {
+				f.commit("ac1", logId, testAllReal, "salt1")
+				f.commit("ac2", logId, testHalfFake, "salt2")
+				return f.reveal("ac1", logId, testAllReal, "salt2")
+			},
+			wantErr: "does not match its commit",
+		},
+		{
+			name: "copied commit",
+			run: func(f *fixture, logId string) error {
+				f.commit("ac1", logId, testAllReal, "salt1")
+				hash := f.mediaLogSubmit(logId).JudgementCommits[f.id("ac1")].Hash
+				if _, err := f.invoke("ac2", "anticheatCommit", logId, "0", hash); err != nil {
+					return err
+				}
+				//ac2 reveals the result of ac1 once it is public
+				f.reveal("ac1", logId, testAllReal, "salt1")
+				return f.reveal("ac2", logId, testAllReal, "salt1")
+			},
+			wantErr: "does not match its commit",
+		},
+		{
+			name: "reveal without a commit",
+			run: func(f *fixture, logId string) error {
+				f.commit("ac1", logId, testAllReal, "salt1")
+				f.now += DEFAULT_COMMIT_WINDOW
+				return f.reveal("ac2", logId, testAllReal, "salt2")
+			},
+			wantErr: "did not commit to a judgement",
+		},
+		{
+			name: "commit twice",
+			run: func(f *fixture, logId string) error {
+				f.commit("ac1", logId, testAllReal, "salt1")
+				return f.commit("ac1", logId, testHalfFake, "salt1")
+			},
+			wantErr: "already committed",
+		},
+		{
+			name: "commit after the commit window",
+			run: func(f *fixture, logId string) error {
+				f.now += DEFAULT_COMMIT_WINDOW
+				return f.commit("ac1", logId, testAllReal, "salt1")
+			},
+			wantErr: "commit phase of log",
+		},
+		{
+			name: "commit by the media",
+			run: func(f *fixture, logId string) error {
+				_, err := f.invoke("media", "anticheatCommit", logId, "0", payload.Digest(nil))
+				return err
+			},
+			wantErr: "is not an anticheat",
+		},
+		{
+			name: "commit to an old revision",
+			run: func(f *fixture, logId string) error {
+				_, err := f.invoke("ac1", "anticheatCommit", logId, "1", payload.Digest(nil))
+				return err
+			},
+			wantErr: "was revised",
+		},
+		{
+			name: "reveal after the reveal window",
+			run: func(f *fixture, logId string) error {
+				f.commit("ac1", logId, testAllReal, "salt1")
+				f.commit("ac2", logId, testHalfFake, "salt2")
+				f.now += DEFAULT_REVEAL_WINDOW
+				return f.reveal("ac1", logId, testAllReal, "salt1")
+			},
+			wantErr: "reveal phase of log",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, nil)
+			contractId := f.contract(ContractOptions{})
+			logId := f.submit(contractId, 0, 1, testMediaLog)
+			err := tt.run(f, logId)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if judged := f.mediaLogSubmit(logId).Judged; judged != tt.judged {
+				t.Fatalf("got judged %v, want %v", judged, tt.judged)
+			}
+		})
+	}
+}
+
+// Every anticheat without a revealed judgement defaults and loses
+// NO_REVEAL_CREDIT, whether it committed or not
+func TestCloseReveal(t *testing.T) {
+	tests := []struct {
+		name      string
+		committed []string
+		revealed  []string
+		defaulted []string
+		closed    bool // the last reveal judged the chunk, every commit being revealed
+	}{
+		{name: "committed, one revealed", committed: []string{"ac1", "ac2"}, revealed: []string{"ac1"}, defaulted: []string{"ac2"}},
+		{name: "one committed and revealed", committed: []string{"ac1"}, revealed: []string{"ac1"}, defaulted: []string{"ac2"}, closed: true},
+		{name: "none revealed", committed: []string{"ac1"}, defaulted: []string{"ac1", "ac2"}},
+		{name: "none committed", defaulted: []string{"ac1", "ac2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, nil)
+			contractId := f.contract(ContractOptions{})
+			logId := f.submit(contractId, 0, 1, testMediaLog)
+			for _, name := range tt.committed {
+				if err := f.commit(name, logId, testAllReal, name); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(tt.committed) < 2 {
+				f.now += DEFAULT_COMMIT_WINDOW
+			}
+			for _, name := range tt.revealed {
+				if err := f.reveal(name, logId, testAllReal, name); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !tt.closed {
+				f.fails("reveal phase of log", "media", "closeReveal", logId)
+				f.now += DEFAULT_REVEAL_WINDOW
+				f.fails("is not a party", "oracle", "closeReveal", logId)
+				f.must("media", "closeReveal", logId)
+			}
+			f.fails("already judged", "media", "closeReveal", logId)
+
+			mls := f.mediaLogSubmit(logId)
+			if !mls.Judged || len(mls.Defaulted) != len(tt.defaulted) {
+				t.Fatalf("got judged %v, defaulted %v", mls.Judged, mls.Defaulted)
+			}
+			for i, name := range tt.defaulted {
+				if mls.Defaulted[i] != f.id(name) {
+					t.Fatalf("got defaulted %v, want %v", mls.Defaulted, tt.defaulted)
+				}
+			}
+			for _, name := range []string{"ac1", "ac2"} {
+				want := "0"
+				if contains(tt.defaulted, name) {
+					want = "-1E+02"
+				}
+				if credit := f.account(name).Credit; credit != want {
+					t.Fatalf("%s has credit %s, want %s", name, credit, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// A settled contract holds its payouts in escrow for the governance
+// DisputeWindow. Within it any party may open a dispute, which keeps the
+// payouts held until a governance arbitrator decides it. An upheld
+// settlement is released as it is, an overturned one has its media payout
+// reversed and paid again on the real rate the arbitrator found. A dispute
+// left undecided for the governance ArbitrationWindow is released as upheld.
+const (
+	DISPUTE_UPHELD     = "upheld"
+	DISPUTE_OVERTURNED = "overturned"
+)
+
+// Dispute of the settlement of a contract, stored at contractId+"_dispute"
+type Dispute struct {
+	ContractId        string
+	OpenedBy          string
+	Reason            string
+	Evidence          []string // storage addresses of the evidence
+	TxId              string
+	TimeStamp         int64
+	DecideBy          int64              // end of the arbitration window
+	Arbitrator        string             // empty when the arbitration timed out
+	Outcome           string             // DISPUTE_*, empty while open
+	RealRate          float64            // real rate found by the arbitrator when overturned
+	CreditAdjustments map[string]float64 // credit added to each party by the arbitrator
+	DecidedTxId       string
+	DecidedAt         int64
+}
+
+func getDisputeInfo(stub shim.ChaincodeStubInterface, contractId string) (*Dispute, error) {
+	disputeAsBytes, err := stub.GetState(contractId + "_dispute")
+	if err != nil || disputeAsBytes == nil {
+		return nil, err
+	}
+	var dispute Dispute
+	err = json.Unmarshal(disputeAsBytes, &dispute)
+	if err != nil {
+		return nil, err
+	}
+	return &dispute, nil
+}
+
+func putDispute(stub shim.ChaincodeStubInterface, dispute *Dispute) error {
+	disputeAsBytes, _ := json.Marshal(dispute)
+	return stub.PutState(dispute.ContractId+"_dispute", disputeAsBytes)
+}
+
+// heldPayees lists, in settlement order, the payees with a payout held for them
+func heldPayees(record *SettlementRecord) []string {
+	prefix := heldAccount(record.ContractId, "")
+	var payees []string
+	for _, entry := range record.Transfers {
+		for _, posting := range entry.Postings {
+			if posting.Amount > 0 && strings.HasPrefix(posting.Account, prefix) {
+				payee := posting.Account[len(prefix):]
+				if !contains(payees, payee) {
+					payees = append(payees, payee)
+				}
+			}
+		}
+	}
+	return payees
+}
+
+// releaseHeld pays out what is held for every payee of the settlement
+func releaseHeld(record *SettlementRecord, j *Journal) error {
+	for _, payee := range heldPayees(record) {
+		held := heldAccount(record.ContractId, payee)
+		balance, err := j.balance(held)
+		if err != nil {
+			return err
+		}
+		err = j.transfer(held, payee, balance, record.ContractId, REASON_RELEASE)
+		if err != nil {
+			return err
+		}
+	}
+	record.Released = true
+	return nil
+}
+
+// args[0]: contractId
+// args[1]: reason
+// args[2:]: storage addresses of the evidence
+func openDispute(stub shim.ChaincodeStubInterface, args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("Incorrect arguments. Expecting at least 3 value")
+	}
+	contractId := args[0]
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return fmt.Errorf("could not get ID: %w", err)
+	}
+	sc, err := getSignatureContract(stub, contractId)
+	if err != nil {
+		return err
+	}
+	if !isContractParty(sc.Contract, id) {
+		return fmt.Errorf("%s is not a party of contract %s", id, contractId)
+	}
+	err = checkContractState(contractId, sc, STATE_SETTLED)
+	if err != nil {
+		return err
+	}
+	for _, address := range args[2:] {
+		if address == "" {
+			return fmt.Errorf("empty evidence address")
+		}
+	}
+	dispute, err := getDisputeInfo(stub, contractId)
+	if err != nil {
+		return err
+	}
+	if dispute != nil {
+		return fmt.Errorf("settlement of contract %s was already disputed", contractId)
+	}
+	record, err := getSettlementRecord(stub, contractId)
+	if err != nil {
+		return err
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	if record.HeldUntil == 0 || record.Released || now >= record.HeldUntil {
+		return fmt.Errorf("settlement of contract %s is out of its dispute window", contractId)
+	}
+	governance, err := getGovernanceInfo(stub)
+	if err != nil {
+		return err
+	}
+	dispute = &Dispute{
+		ContractId: contractId,
+		OpenedBy:   id,
+		Reason:     args[1],
+		Evidence:   args[2:],
+		TxId:       stub.GetTxID(),
+		TimeStamp:  now,
+		DecideBy:   now + governance.arbitrationWindow(),
+	}
+	err = putDispute(stub, dispute)
+	if err != nil {
+		return err
+	}
+	err = putContractState(stub, contractId, sc, STATE_DISPUTED)
+	if err != nil {
+		return err
+	}
+	//the arbitrators learn of the dispute
+	event, _ := json.Marshal(dispute)
+	return stub.SetEvent("disputeOpened", event)
+}
+
+// overturnMediaPayment reverses the media payout of the settlement and pays
+// the media escrow again on realRate, moving the media credit to match
+func overturnMediaPayment(stub shim.ChaincodeStubInterface, sc Contract, record *SettlementRecord, realRate float64, j *Journal) error {
+	escrow := escrowAccount(record.ContractId, ESCROW_MEDIA)
+	for _, entry := range record.Transfers {
+		if entry.Reason != REASON_MEDIA_PAYMENT && entry.Reason != REASON_MEDIA_REFUND {
+			continue
+		}
+		for _, posting := range entry.Postings {
+			if posting.Amount > 0 {
+				err := j.transfer(posting.Account, escrow, posting.Amount, record.ContractId, REASON_REVERSAL)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	amount, err := strconv.ParseFloat(sc.PaymentAmountMedia, 64)
+	if err != nil {
+		return err
+	}
+	mediaAccount, err := getAccountInfo(stub, sc.MediaId)
+	if err != nil {
+		return err
+	}
+	credit, err := strconv.ParseFloat(mediaAccount.Credit, 64)
+	if err != nil {
+		return err
+	}
+	credit += (realRate - record.RealRate) * amount * MEDIA_CREDIT
+	before := mediaAccount.Credit
+	mediaAccount.Credit = strconv.FormatFloat(credit, 'f', 6, 64)
+	record.post(sc.MediaId, "Credit", before, mediaAccount.Credit, "arbitration")
+	accountAsBytes, _ := json.Marshal(mediaAccount)
+	stub.PutState(sc.MediaId, accountAsBytes)
+
+	escrowed, err := j.balance(escrow)
+	if err != nil {
+		return err
+	}
+	record.RealRate = realRate
+	record.MediaPaid = realRate >= record.Threshold
+	if record.MediaPaid {
+		return j.transfer(escrow, sc.MediaId, escrowed, record.ContractId, REASON_MEDIA_PAYMENT)
+	}
+	return j.transfer(escrow, sc.AdvertiserId, escrowed, record.ContractId, REASON_MEDIA_REFUND)
+}
+
+// adjustCredits adds the arbitrator's credit adjustments to the parties, in id order
+func adjustCredits(stub shim.ChaincodeStubInterface, sc Contract, record *SettlementRecord, adjustments map[string]float64) error {
+	ids := make([]string, 0, len(adjustments))
+	for id := range adjustments {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		account, err := getAccountInfo(stub, id)
+		if err != nil {
+			return err
+		}
+		credit, err := strconv.ParseFloat(account.Credit, 64)
+		if err != nil {
+			return err
+		}
+		credit += adjustments[id]
+		before := account.Credit
+		if id == sc.MediaId {
+			account.Credit = strconv.FormatFloat(credit, 'f', 6, 64)
+		} else {
+			account.Credit = strconv.FormatFloat(credit, 'E', -1, 64)
+		}
+		record.post(id, "Credit", before, account.Credit, "arbitration")
+		accountAsBytes, _ := json.Marshal(account)
+		stub.PutState(id, accountAsBytes)
+	}
+	return nil
+}
+
+// decideDispute settles a dispute, only a governance arbitrator who is not a
+// party of the contract may decide it, before the dispute's DecideBy. It
+// returns the settlement record.
+// args[0]: contractId
+// args[1]: upheld or overturned
+// args[2]: real rate found by the arbitrator, only when overturned
+// args[3]: credit adjustments JSON, party id to credit added, optional
+func decideDispute(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) < 2 || len(args) > 4 {
+		return "", fmt.Errorf("Incorrect arguments. Expecting 2 to 4 value")
+	}
+	contractId := args[0]
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return "", fmt.Errorf("could not get ID: %w", err)
+	}
+	governance, err := getGovernanceInfo(stub)
+	if err != nil {
+		return "", err
+	}
+	sc, err := getSignatureContract(stub, contractId)
+	if err != nil {
+		return "", err
+	}
+	if !governance.isArbitrator(id) || isContractParty(sc.Contract, id) {
+		return "", fmt.Errorf("%s may not arbitrate contract %s", id, contractId)
+	}
+	err = checkContractState(contractId, sc, STATE_DISPUTED)
+	if err != nil {
+		return "", err
+	}
+	dispute, err := getDisputeInfo(stub, contractId)
+	if err != nil {
+		return "", err
+	}
+	if dispute == nil || dispute.Outcome != "" {
+		return "", fmt.Errorf("contract %s has no open dispute", contractId)
+	}
+	var realRate float64
+	switch args[1] {
+	case DISPUTE_UPHELD:
+	case DISPUTE_OVERTURNED:
+		if len(args) < 3 {
+			return "", fmt.Errorf("Incorrect arguments. Expecting a real rate when overturned")
+		}
+		realRate, err = strconv.ParseFloat(args[2], 64)
+		if err != nil || realRate < 0 || realRate > 1 {
+			return "", fmt.Errorf("real rate format error: %s", args[2])
+		}
+	default:
+		return "", fmt.Errorf("unknown dispute outcome %s", args[1])
+	}
+	var adjustments map[string]float64
+	if len(args) == 4 && args[3] != "" {
+		err = json.Unmarshal([]byte(args[3]), &adjustments)
+		if err != nil {
+			return "", fmt.Errorf("credit adjustments format error: %s", err)
+		}
+		for party := range adjustments {
+			if !isContractParty(sc.Contract, party) {
+				return "", fmt.Errorf("%s is not a party of contract %s", party, contractId)
+			}
+		}
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return "", err
+	}
+	if now >= dispute.DecideBy {
+		return "", fmt.Errorf("arbitration of contract %s timed out at %d", contractId, dispute.DecideBy)
+	}
+	record, err := getSettlementRecord(stub, contractId)
+	if err != nil {
+		return "", err
+	}
+	j, err := newJournal(stub)
+	if err != nil {
+		return "", err
+	}
+	if args[1] == DISPUTE_OVERTURNED {
+		err = overturnMediaPayment(stub, sc.Contract, record, realRate, j)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = adjustCredits(stub, sc.Contract, record, adjustments)
+	if err != nil {
+		return "", err
+	}
+	err = releaseHeld(record, j)
+	if err != nil {
+		return "", err
+	}
+	err = j.commit()
+	if err != nil {
+		return "", err
+	}
+	record.Transfers = append(record.Transfers, j.entries...)
+
+	dispute.Arbitrator = id
+	dispute.Outcome = args[1]
+	dispute.RealRate = realRate
+	dispute.CreditAdjustments = adjustments
+	dispute.DecidedTxId = stub.GetTxID()
+	dispute.DecidedAt = now
+	err = putDispute(stub, dispute)
+	if err != nil {
+		return "", err
+	}
+	err = putContractState(stub, contractId, sc, STATE_SETTLED)
+	if err != nil {
+		return "", err
+	}
+	return putSettlementRecord(stub, record)
+}
+
+// releaseSettlement pays out the held payouts of a contract once its
+// dispute window closed without a dispute, or once the arbitration of its
+// dispute timed out, which upholds the settlement. Any party or admin may
+// call it.
+// args[0]: contractId
+func releaseSettlement(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("Incorrect arguments. Expecting 1 value")
+	}
+	contractId := args[0]
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return "", fmt.Errorf("could not get ID: %w", err)
+	}
+	governance, err := getGovernanceInfo(stub)
+	if err != nil {
+		return "", err
+	}
+	sc, err := getSignatureContract(stub, contractId)
+	if err != nil {
+		return "", err
+	}
+	if !isContractParty(sc.Contract, id) && !governance.isAdmin(id) {
+		return "", fmt.Errorf("%s may not release the settlement of contract %s", id, contractId)
+	}
+	err = checkContractState(contractId, sc, STATE_SETTLED, STATE_DISPUTED)
+	if err != nil {
+		return "", err
+	}
+	record, err := getSettlementRecord(stub, contractId)
+	if err != nil {
+		return "", err
+	}
+	if record.HeldUntil == 0 || record.Released {
+		return "", fmt.Errorf("settlement of contract %s holds nothing", contractId)
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return "", err
+	}
+	var dispute *Dispute
+	if contractState(sc) == STATE_DISPUTED {
+		dispute, err = getDisputeInfo(stub, contractId)
+		if err != nil {
+			return "", err
+		}
+		if dispute == nil || dispute.Outcome != "" {
+			return "", fmt.Errorf("contract %s has no open dispute", contractId)
+		}
+		if now < dispute.DecideBy {
+			return "", fmt.Errorf("dispute of contract %s is under arbitration until %d", contractId, dispute.DecideBy)
+		}
+	} else if now < record.HeldUntil {
+		return "", fmt.Errorf("settlement of contract %s is held until %d", contractId, record.HeldUntil)
+	}
+	j, err := newJournal(stub)
+	if err != nil {
+		return "", err
+	}
+	err = releaseHeld(record, j)
+	if err != nil {
+		return "", err
+	}
+	err = j.commit()
+	if err != nil {
+		return "", err
+	}
+	record.Transfers = append(record.Transfers, j.entries...)
+	if dispute != nil {
+		//the arbitration timed out, the settlement stands
+		dispute.Outcome = DISPUTE_UPHELD
+		dispute.DecidedTxId = stub.GetTxID()
+		dispute.DecidedAt = now
+		err = putDispute(stub, dispute)
+		if err != nil {
+			return "", err
+		}
+		err = putContractState(stub, contractId, sc, STATE_SETTLED)
+		if err != nil {
+			return "", err
+		}
+	}
+	return putSettlementRecord(stub, record)
+}
+
+// getDispute returns the dispute of a contract to its parties, the arbitrators and the admins
+// args[0]: contractId
+func getDispute(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("Incorrect arguments. Expecting 1 argument")
+	}
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return "", fmt.Errorf("could not get ID: %w", err)
+	}
+	governance, err := getGovernanceInfo(stub)
+	if err != nil {
+		return "", err
+	}
+	sc, err := getSignatureContract(stub, args[0])
+	if err != nil {
+		return "", err
+	}
+	if !isContractParty(sc.Contract, id) && !governance.isArbitrator(id) && !governance.isAdmin(id) {
+		return "", fmt.Errorf("%s may not read the dispute of contract %s", id, args[0])
+	}
+	dispute, err := stub.GetState(args[0] + "_dispute")
+	if err != nil {
+		return "", err
+	}
+	return string(dispute), nil
+}
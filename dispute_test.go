@@ -0,0 +1,248 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const TEST_DISPUTE_WINDOW = 86400
+
+func TestDispute(t *testing.T) {
+	tests := []struct {
+		name     string
+		run      func(f *fixture, contractId string) error
+		wantErr  string
+		outcome  string // outcome of the dispute, empty when none was decided
+		balances map[string]string
+	}{
+		{
+			name: "released after the dispute window",
+			run: func(f *fixture, contractId string) error {
+				f.fails("is held until", "media", "releaseSettlement", contractId)
+				f.now += TEST_DISPUTE_WINDOW
+				f.fails("may not release", "oracle", "releaseSettlement", contractId)
+				_, err := f.invoke("media", "releaseSettlement", contractId)
+				return err
+			},
+			balances: map[string]string{"advertiser": "890.01", "media": "100.00"},
+		},
+		{
+			name: "released twice",
+			run: func(f *fixture, contractId string) error {
+				f.now += TEST_DISPUTE_WINDOW
+				f.must("admin", "releaseSettlement", contractId)
+				_, err := f.invoke("media", "releaseSettlement", contractId)
+				return err
+			},
+			wantErr: "holds nothing",
+		},
+		{
+			name: "opened by a stranger",
+			run: func(f *fixture, contractId string) error {
+				_, err := f.invoke("oracle", "openDispute", contractId, "bots", "ipfs://evidence")
+				return err
+			},
+			wantErr: "is not a party",
+		},
+		{
+			name: "opened after the dispute window",
+			run: func(f *fixture, contractId string) error {
+				f.now += TEST_DISPUTE_WINDOW
+				_, err := f.invoke("advertiser", "openDispute", contractId, "bots", "ipfs://evidence")
+				return err
+			},
+			wantErr: "out of its dispute window",
+		},
+		{
+			name: "opened twice",
+			run: func(f *fixture, contractId string) error {
+				f.must("advertiser", "openDispute", contractId, "bots", "ipfs://evidence")
+				_, err := f.invoke("media", "openDispute", contractId, "no bots", "ipfs://evidence")
+				return err
+			},
+			wantErr: "is disputed",
+		},
+		{
+			name: "upheld without a rate",
+			run: func(f *fixture, contractId string) error {
+				f.must("advertiser", "openDispute", contractId, "bots", "ipfs://evidence")
+				_, err := f.invoke("arbitrator", "decideDispute", contractId, DISPUTE_UPHELD)
+				return err
+			},
+			outcome:  DISPUTE_UPHELD,
+			balances: map[string]string{"advertiser": "890.01", "media": "100.00"},
+		},
+		{
+			name: "overturned",
+			run: func(f *fixture, contractId string) error {
+				f.must("advertiser", "openDispute", contractId, "bots", "ipfs://evidence")
+				_, err := f.invoke("arbitrator", "decideDispute", contractId, DISPUTE_OVERTURNED, "0.25", `{"`+f.id("ac1")+`": -5}`)
+				return err
+			},
+			outcome:  DISPUTE_OVERTURNED,
+			balances: map[string]string{"advertiser": "990.01", "media": "0.00"},
+		},
+		{
+			name: "overturned without a rate",
+			run: func(f *fixture, contractId string) error {
+				f.must("advertiser", "openDispute", contractId, "bots", "ipfs://evidence")
+				_, err := f.invoke("arbitrator", "decideDispute", contractId, DISPUTE_OVERTURNED)
+				return err
+			},
+			wantErr: "Expecting a real rate",
+		},
+		{
+			name: "overturned on a rate out of range",
+			run: func(f *fixture, contractId string) error {
+				f.must("advertiser", "openDispute", contractId, "bots", "ipfs://evidence")
+				_, err := f.invoke("arbitrator", "decideDispute", contractId, DISPUTE_OVERTURNED, "1.5")
+				return err
+			},
+			wantErr: "real rate format error",
+		},
+		{
+			name: "adjusted credit of a stranger",
+			run: func(f *fixture, contractId string) error {
+				f.must("advertiser", "openDispute", contractId, "bots", "ipfs://evidence")
+				_, err := f.invoke("arbitrator", "decideDispute", contractId, DISPUTE_UPHELD, "", `{"`+f.id("oracle")+`": 1}`)
+				return err
+			},
+			wantErr: "is not a party",
+		},
+		{
+			name: "decided by a party",
+			run: func(f *fixture, contractId string) error {
+				f.must("advertiser", "openDispute", contractId, "bots", "ipfs://evidence")
+				_, err := f.invoke("advertiser", "decideDispute", contractId, DISPUTE_OVERTURNED, "0")
+				return err
+			},
+			wantErr: "may not arbitrate",
+		},
+		{
+			name: "decided twice",
+			run: func(f *fixture, contractId string) error {
+				f.must("advertiser", "openDispute", contractId, "bots", "ipfs://evidence")
+				f.must("arbitrator", "decideDispute", contractId, DISPUTE_UPHELD)
+				_, err := f.invoke("arbitrator", "decideDispute", contractId, DISPUTE_OVERTURNED, "0")
+				return err
+			},
+			wantErr: "is settled",
+		},
+		{
+			name: "released under arbitration",
+			run: func(f *fixture, contractId string) error {
+				f.must("advertiser", "openDispute", contractId, "bots", "ipfs://evidence")
+				f.now += TEST_DISPUTE_WINDOW
+				_, err := f.invoke("media", "releaseSettlement", contractId)
+				return err
+			},
+			wantErr: "under arbitration",
+		},
+		{
+			name: "arbitration timed out",
+			run: func(f *fixture, contractId string) error {
+				f.must("advertiser", "openDispute", contractId, "bots", "ipfs://evidence")
+				f.now += DEFAULT_ARBITRATION_WINDOW
+				f.fails("timed out", "arbitrator", "decideDispute", contractId, DISPUTE_OVERTURNED, "0")
+				_, err := f.invoke("media", "releaseSettlement", contractId)
+				return err
+			},
+			outcome:  DISPUTE_UPHELD,
+			balances: map[string]string{"advertiser": "890.01", "media": "100.00"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, func(f *fixture, g *Governance) {
+				g.DisputeWindow = TEST_DISPUTE_WINDOW
+			})
+			record := settle(f, testAllReal, testHalfFake)
+			if record.HeldUntil != f.now+TEST_DISPUTE_WINDOW || !record.MediaPaid {
+				t.Fatalf("got held until %d, media paid %v", record.HeldUntil, record.MediaPaid)
+			}
+			if got := f.balance("media"); got != "0.00" {
+				t.Fatalf("media was paid %s before the dispute window closed", got)
+			}
+			err := tt.run(f, record.ContractId)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var sc SignatureContract
+			f.state(record.ContractId, &sc)
+			if state := contractState(sc); state != STATE_SETTLED {
+				t.Fatalf("contract is %s", state)
+			}
+			f.state(record.ContractId+"_settlement", record)
+			if !record.Released {
+				t.Fatal("settlement was not released")
+			}
+			for _, payee := range heldPayees(record) {
+				if got := f.balance(heldAccount(record.ContractId, payee)); got != "0.00" {
+					t.Fatalf("%s still holds %s", payee, got)
+				}
+			}
+			for name, want := range tt.balances {
+				if got := f.balance(name); got != want {
+					t.Fatalf("%s has %s, want %s", name, got, want)
+				}
+			}
+			var dispute Dispute
+			if tt.outcome == "" {
+				if f.stub.State[record.ContractId+"_dispute"] != nil {
+					t.Fatal("settlement was disputed")
+				}
+				return
+			}
+			f.state(record.ContractId+"_dispute", &dispute)
+			if dispute.Outcome != tt.outcome || dispute.DecidedAt != f.now {
+				t.Fatalf("got outcome %s decided at %d", dispute.Outcome, dispute.DecidedAt)
+			}
+			if dispute.DecideBy != TEST_START+DEFAULT_ARBITRATION_WINDOW {
+				t.Fatalf("got arbitration window until %d", dispute.DecideBy)
+			}
+			if tt.outcome == DISPUTE_OVERTURNED {
+				if record.RealRate != 0.25 || record.MediaPaid {
+					t.Fatalf("got real rate %v, media paid %v", record.RealRate, record.MediaPaid)
+				}
+				//ac1 earned 10 in the settlement, the media credit is recomputed on the real rate
+				if credit := f.account("ac1").Credit; credit != "5E+00" {
+					t.Fatalf("ac1 has credit %s", credit)
+				}
+				if credit := f.account("media").Credit; credit != "-0.000250" {
+					t.Fatalf("media has credit %s", credit)
+				}
+			}
+		})
+	}
+}
+
+func TestArbitrationWindow(t *testing.T) {
+	tests := []struct {
+		window  int64
+		want    int64
+		wantErr bool
+	}{
+		{window: 0, want: DEFAULT_ARBITRATION_WINDOW},
+		{window: 3600, want: 3600},
+		{window: MAX_ARBITRATION_WINDOW, want: MAX_ARBITRATION_WINDOW},
+		{window: MAX_ARBITRATION_WINDOW + 1, wantErr: true},
+		{window: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		g := Governance{Admins: []string{"admin"}, Oracles: []string{"oracle"}, OracleQuorum: 1, ArbitrationWindow: tt.window}
+		err := g.check()
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("window %d: got error %v", tt.window, err)
+		}
+		if err == nil && g.arbitrationWindow() != tt.want {
+			t.Fatalf("window %d: got %d, want %d", tt.window, g.arbitrationWindow(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// The platform charges every contract the governance Fee. It is escrowed
+// from the advertiser with the payments when the contract is created and
+// paid to the governance FeeAccount when the contract is paid out.
+const (
+	FEE_PERCENT = "percent" // Amount percent of the media and anticheat payments
+	FEE_FLAT    = "flat"    // Amount per contract
+)
+
+type PlatformFee struct {
+	Type   string // FEE_PERCENT or FEE_FLAT, empty for no fee
+	Amount string
+}
+
+func (f PlatformFee) check(feeAccount string) error {
+	if f.Type == "" {
+		return nil
+	}
+	if feeAccount == "" {
+		return fmt.Errorf("a platform fee needs a fee account")
+	}
+	amount, err := strconv.ParseFloat(f.Amount, 64)
+	if err != nil || amount < 0 || math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return fmt.Errorf("platform fee amount format error: %s", f.Amount)
+	}
+	switch f.Type {
+	case FEE_PERCENT:
+		if amount > 100 {
+			return fmt.Errorf("platform fee of %s percent", f.Amount)
+		}
+	case FEE_FLAT:
+	default:
+		return fmt.Errorf("unknown platform fee type %s", f.Type)
+	}
+	return nil
+}
+
+// charge returns the fee of a contract with the given payments, in hundredths
+func (f PlatformFee) charge(payments int64) (int64, error) {
+	switch f.Type {
+	case "":
+		return 0, nil
+	case FEE_FLAT:
+		return parseAmount(f.Amount)
+	case FEE_PERCENT:
+		percent, err := strconv.ParseFloat(f.Amount, 64)
+		if err != nil {
+			return 0, fmt.Errorf("platform fee amount format error: %s", f.Amount)
+		}
+		return int64(math.Floor(float64(payments) * percent / 100)), nil
+	}
+	return 0, fmt.Errorf("unknown platform fee type %s", f.Type)
+}
+
+// payFee pays the fee escrowed for a contract to the fee account, or back
+// to the advertiser if the governance no longer has one
+func payFee(governance Governance, contractId string, sc Contract, record *SettlementRecord, j *Journal) error {
+	escrow := escrowAccount(contractId, ESCROW_FEE)
+	fee, err := j.balance(escrow)
+	if err != nil {
+		return err
+	}
+	if governance.FeeAccount == "" {
+		return j.transfer(escrow, sc.AdvertiserId, fee, contractId, REASON_FEE_REFUND)
+	}
+	record.PlatformFee = formatAmount(fee)
+	record.FeeAccount = governance.FeeAccount
+	return j.transfer(escrow, governance.FeeAccount, fee, contractId, REASON_PLATFORM_FEE)
+}
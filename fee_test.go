@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPlatformFee(t *testing.T) {
+	tests := []struct {
+		name       string
+		fee        PlatformFee
+		feeAccount string
+		want       int64 // charged on 110.00
+		wantErr    string
+	}{
+		{name: "none", want: 0},
+		{name: "percent", fee: PlatformFee{Type: FEE_PERCENT, Amount: "10"}, feeAccount: "fee", want: 1100},
+		{name: "percent rounds down", fee: PlatformFee{Type: FEE_PERCENT, Amount: "0.5"}, feeAccount: "fee", want: 55},
+		{name: "all", fee: PlatformFee{Type: FEE_PERCENT, Amount: "100"}, feeAccount: "fee", want: 11000},
+		{name: "flat", fee: PlatformFee{Type: FEE_FLAT, Amount: "2.5"}, feeAccount: "fee", want: 250},
+		{name: "over 100 percent", fee: PlatformFee{Type: FEE_PERCENT, Amount: "100.01"}, feeAccount: "fee", wantErr: "percent"},
+		{name: "negative", fee: PlatformFee{Type: FEE_FLAT, Amount: "-1"}, feeAccount: "fee", wantErr: "format error"},
+		{name: "NaN", fee: PlatformFee{Type: FEE_PERCENT, Amount: "NaN"}, feeAccount: "fee", wantErr: "format error"},
+		{name: "Inf", fee: PlatformFee{Type: FEE_FLAT, Amount: "Inf"}, feeAccount: "fee", wantErr: "format error"},
+		{name: "not a number", fee: PlatformFee{Type: FEE_FLAT, Amount: "x"}, feeAccount: "fee", wantErr: "format error"},
+		{name: "unknown type", fee: PlatformFee{Type: "tithe", Amount: "10"}, feeAccount: "fee", wantErr: "unknown platform fee type"},
+		{name: "no fee account", fee: PlatformFee{Type: FEE_FLAT, Amount: "1"}, wantErr: "needs a fee account"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.fee.check(tt.feeAccount)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tt.fee.charge(11000)
+			if err != nil || got != tt.want {
+				t.Fatalf("got %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// The fee is escrowed when the contract is created and paid to the fee
+// account on payout, or back to the advertiser if the governance dropped it
+func TestPayFee(t *testing.T) {
+	tests := []struct {
+		name       string
+		dropped    bool
+		advertiser string
+		fee        string
+		paid       string // PlatformFee of the settlement record
+	}{
+		{name: "paid", advertiser: "885.01", fee: "5.00", paid: "5.00"},
+		{name: "refunded", dropped: true, advertiser: "890.01", fee: "0.00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, func(f *fixture, g *Governance) {
+				g.FeeAccount = f.id("fee")
+				g.Fee = PlatformFee{Type: FEE_FLAT, Amount: "5"}
+			})
+			contractId := f.contract(ContractOptions{})
+			if got := f.balance(escrowAccount(contractId, ESCROW_FEE)); got != "5.00" {
+				t.Fatalf("fee escrow has %s", got)
+			}
+			if tt.dropped {
+				var governance Governance
+				f.state(GOVERNANCE_KEY, &governance)
+				governance.FeeAccount = ""
+				governance.Fee = PlatformFee{}
+				governanceAsBytes, _ := json.Marshal(governance)
+				f.must("admin", "setGovernance", string(governanceAsBytes))
+			}
+			logId := f.submit(contractId, 0, 1, testMediaLog)
+			f.judge(logId, testAllReal, testHalfFake)
+			f.attest(f.attestation(logId, testMediaLog, map[string]string{"ac1": testAllReal, "ac2": testHalfFake}))
+
+			var record SettlementRecord
+			f.state(contractId+"_settlement", &record)
+			if record.PlatformFee != tt.paid {
+				t.Fatalf("got platform fee %q, want %q", record.PlatformFee, tt.paid)
+			}
+			if got := f.balance("advertiser"); got != tt.advertiser {
+				t.Fatalf("advertiser has %s, want %s", got, tt.advertiser)
+			}
+			if got := f.balance("fee"); got != tt.fee {
+				t.Fatalf("fee account has %s, want %s", got, tt.fee)
+			}
+			if got := f.balance(escrowAccount(contractId, ESCROW_FEE)); got != "0.00" {
+				t.Fatalf("fee escrow has %s", got)
+			}
+		})
+	}
+}
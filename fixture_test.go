@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"chaincodedev/chaincode/liqi/hwxf/logformat"
+	"chaincodedev/chaincode/liqi/hwxf/merkle"
+	"chaincodedev/chaincode/liqi/hwxf/payload"
+	"chaincodedev/chaincode/liqi/hwxf/settlement"
+	"chaincodedev/chaincode/liqi/hwxf/signing"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	TEST_CHANNEL   = "mychannel"
+	TEST_CHAINCODE = "hwxf"
+	TEST_START     = 1500000000
+)
+
+var testDomain = payload.Domain{ChannelID: TEST_CHANNEL, ChaincodeName: TEST_CHAINCODE}
+
+// testStub is a MockStub invoked as creator, with the signed proposal of an
+// invocation of TEST_CHAINCODE so getSigningDomain can read the chaincode name
+type testStub struct {
+	*shim.MockStub
+	creator []byte
+	fn      string
+	args    []string
+}
+
+func (s *testStub) GetCreator() ([]byte, error) {
+	return s.creator, nil
+}
+
+func (s *testStub) GetFunctionAndParameters() (string, []string) {
+	return s.fn, s.args
+}
+
+func (s *testStub) GetSignedProposal() (*peer.SignedProposal, error) {
+	input, err := proto.Marshal(&peer.ChaincodeInvocationSpec{ChaincodeSpec: &peer.ChaincodeSpec{ChaincodeId: &peer.ChaincodeID{Name: TEST_CHAINCODE}}})
+	if err != nil {
+		return nil, err
+	}
+	cpp, err := proto.Marshal(&peer.ChaincodeProposalPayload{Input: input})
+	if err != nil {
+		return nil, err
+	}
+	proposal, err := proto.Marshal(&peer.Proposal{Payload: cpp})
+	if err != nil {
+		return nil, err
+	}
+	return &peer.SignedProposal{ProposalBytes: proposal}, nil
+}
+
+// party is an identity of the test network with its own key, which signs
+// both its X.509 certificate and the payloads of its account
+type party struct {
+	name    string
+	creator []byte // serialized identity
+	key     string // PEM private key
+	pub     string // PEM public key
+	id      string // cid.GetID of the identity
+}
+
+func newParty(t *testing.T, name string) *party {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"Org1"}},
+		NotBefore:    time.Unix(TEST_START-86400, 0),
+		NotAfter:     time.Unix(TEST_START+365*86400, 0),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: "Org1MSP", IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &party{
+		name:    name,
+		creator: creator,
+		key:     string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})),
+		pub:     string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})),
+	}
+	stub := &testStub{MockStub: shim.NewMockStub(name, nil), creator: creator}
+	p.id, err = cid.GetID(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// sign returns the hex signature of msg by p, as a client passes it
+func (p *party) sign(t *testing.T, msg []byte) string {
+	sig, err := signing.Sign(signing.ALGORITHM_ECDSA_P256, msg, p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(sig)
+}
+
+// fixture is a chaincode with a governance and an account for every party.
+// Transactions run one after the other at now, which tests move forward.
+type fixture struct {
+	t       *testing.T
+	cc      *SimpleAsset
+	stub    *testStub
+	now     int64
+	tx      int
+	parties map[string]*party
+}
+
+// TEST_PARTIES are the identities of every fixture, admin instantiates the chaincode
+var TEST_PARTIES = []string{"admin", "advertiser", "media", "ac1", "ac2", "oracle", "arbitrator", "fee"}
+
+// newFixture instantiates the chaincode, opens an account for every party,
+// the advertiser with 1000 in assets, and sets the governance after change
+func newFixture(t *testing.T, change func(f *fixture, g *Governance)) *fixture {
+	f := &fixture{
+		t:       t,
+		cc:      new(SimpleAsset),
+		now:     TEST_START,
+		parties: make(map[string]*party),
+	}
+	f.stub = &testStub{MockStub: shim.NewMockStub(TEST_CHAINCODE, f.cc)}
+	f.stub.ChannelID = TEST_CHANNEL
+	for _, name := range TEST_PARTIES {
+		f.parties[name] = newParty(t, name)
+	}
+	f.start("admin", "", nil)
+	res := f.cc.Init(f.stub)
+	f.stub.MockTransactionEnd(f.stub.TxID)
+	if res.Status != shim.OK {
+		t.Fatal(res.Message)
+	}
+	for _, name := range TEST_PARTIES {
+		assets := "0"
+		if name == "advertiser" {
+			assets = "1000"
+		}
+		f.must(name, "setAccount", name, "0", assets, f.parties[name].pub)
+	}
+	governance := Governance{
+		Admins:       []string{f.id("admin")},
+		Oracles:      []string{f.id("oracle")},
+		OracleQuorum: 1,
+		Arbitrators:  []string{f.id("arbitrator")},
+	}
+	if change != nil {
+		change(f, &governance)
+	}
+	governanceAsBytes, _ := json.Marshal(governance)
+	f.must("admin", "setGovernance", string(governanceAsBytes))
+	return f
+}
+
+func (f *fixture) id(name string) string {
+	return f.parties[name].id
+}
+
+func (f *fixture) start(as string, fn string, args []string) {
+	f.tx++
+	f.stub.MockTransactionStart(fmt.Sprintf("tx%d", f.tx))
+	f.stub.TxTimestamp = &timestamp.Timestamp{Seconds: f.now}
+	f.stub.creator = f.parties[as].creator
+	f.stub.fn = fn
+	f.stub.args = args
+}
+
+// invoke runs fn with args as the party named as
+func (f *fixture) invoke(as string, fn string, args ...string) (string, error) {
+	f.start(as, fn, args)
+	res := f.cc.Invoke(f.stub)
+	f.stub.MockTransactionEnd(f.stub.TxID)
+	if res.Status != shim.OK {
+		return "", errors.New(res.Message)
+	}
+	return string(res.Payload), nil
+}
+
+func (f *fixture) must(as string, fn string, args ...string) string {
+	f.t.Helper()
+	result, err := f.invoke(as, fn, args...)
+	if err != nil {
+		f.t.Fatalf("%s %s: %v", as, fn, err)
+	}
+	return result
+}
+
+// fails checks fn fails with an error containing want
+func (f *fixture) fails(want string, as string, fn string, args ...string) {
+	f.t.Helper()
+	_, err := f.invoke(as, fn, args...)
+	if err == nil || !strings.Contains(err.Error(), want) {
+		f.t.Fatalf("%s %s: got error %v, want %q", as, fn, err, want)
+	}
+}
+
+// state reads key as it is committed
+func (f *fixture) state(key string, v interface{}) {
+	f.t.Helper()
+	if err := json.Unmarshal(f.stub.State[key], v); err != nil {
+		f.t.Fatalf("%s: %v", key, err)
+	}
+}
+
+func (f *fixture) account(name string) Account {
+	var account Account
+	f.state(f.id(name), &account)
+	return account
+}
+
+// balance returns the ledger balance of a party, or of an account of the ledger
+func (f *fixture) balance(account string) string {
+	f.t.Helper()
+	if p, ok := f.parties[account]; ok {
+		account = p.id
+	}
+	return f.must("admin", "getBalance", account)
+}
+
+// contract creates an active contract of the advertiser with the media and
+// both anticheats, paying 100 to the media and 10 to the anticheats
+func (f *fixture) contract(options ContractOptions) string {
+	return f.contractPaying(options, "100", "10")
+}
+
+// contractPaying creates an active contract paying media to the media and antiCheat to the anticheats
+func (f *fixture) contractPaying(options ContractOptions, media string, antiCheat string) string {
+	contractId, msg := f.propose(options, media, antiCheat)
+	for _, name := range []string{"media", "ac1", "ac2"} {
+		f.must(name, "mediaAntiConfirm", f.parties[name].sign(f.t, msg), contractId)
+	}
+	return contractId
+}
+
+// propose creates a contract signed by the advertiser only, it returns its id and signed payload
+func (f *fixture) propose(options ContractOptions, media string, antiCheat string) (string, []byte) {
+	contract := Contract{
+		AdvertiserId:           f.id("advertiser"),
+		MediaId:                f.id("media"),
+		AntiCheatIds:           []string{f.id("ac1"), f.id("ac2")},
+		PaymentThreshold:       "0.5",
+		PaymentAmountMedia:     media,
+		PaymentAmountAntiCheat: antiCheat,
+		AntiCheatShareType:     "average",
+		AntiCheatPriority:      []string{"1", "1"},
+		TimeStamp:              f.now,
+		Options:                options,
+	}
+	msg := contract.Encode(testDomain)
+	optionsAsBytes, _ := json.Marshal(options)
+	contractId := f.must("advertiser", "generatorContract", contract.MediaId, strings.Join(contract.AntiCheatIds, ","),
+		contract.PaymentThreshold, contract.PaymentAmountMedia, contract.PaymentAmountAntiCheat, contract.AntiCheatShareType,
+		strings.Join(contract.AntiCheatPriority, ","), fmt.Sprint(contract.TimeStamp), f.parties["advertiser"].sign(f.t, msg), string(optionsAsBytes))
+	return contractId, msg
+}
+
+// file returns the commitment a party submits for data stored at address
+func (f *fixture) file(address string, data string) FileCommitment {
+	f.t.Helper()
+	file, err := logformat.Parse([]byte(data))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return FileCommitment{
+		Address:     address,
+		Digest:      payload.Digest([]byte(data)),
+		Size:        int64(len(data)),
+		RecordCount: len(file.Records),
+		MerkleRoot:  hex.EncodeToString(merkle.Root(file.Canonical())),
+	}
+}
+
+func commitmentArgs(c FileCommitment) []string {
+	return []string{c.Address, c.Digest, fmt.Sprint(c.Size), fmt.Sprint(c.RecordCount), c.MerkleRoot}
+}
+
+// submit submits data as chunk index of count of the media log, for the hour before now
+func (f *fixture) submit(contractId string, index int, count int, data string) string {
+	log := Log{
+		FileCommitment:  f.file(fmt.Sprintf("https://media.example/%d.log", index), data),
+		TimeStamp:       f.now,
+		AntiCheatNum:    2,
+		ChunkIndex:      index,
+		ChunkCount:      count,
+		PeriodStart:     f.now - 3600 - int64(count-index)*3600,
+		PeriodEnd:       f.now - int64(count-index)*3600,
+		ImpressionCount: len(strings.Split(strings.TrimSpace(data), "\n")) - 1,
+		PlacementIds:    []string{"slot-1"},
+	}
+	args := append([]string{contractId, fmt.Sprint(index), fmt.Sprint(count)}, commitmentArgs(log.FileCommitment)...)
+	args = append(args, fmt.Sprint(log.PeriodStart), fmt.Sprint(log.PeriodEnd), fmt.Sprint(log.ImpressionCount), "slot-1",
+		fmt.Sprint(log.TimeStamp), f.parties["media"].sign(f.t, log.Encode(testDomain)))
+	f.must("media", "mediaSubmit", args...)
+	return getLogId(contractId, index)
+}
+
+func (f *fixture) mediaLogSubmit(logId string) MediaLogSubmit {
+	var mediaLogSubmit MediaLogSubmit
+	f.state(logId, &mediaLogSubmit)
+	return mediaLogSubmit
+}
+
+// commit commits anticheat as to result, a file at an address of its own
+func (f *fixture) commit(as string, logId string, result string, salt string) error {
+	mls := f.mediaLogSubmit(logId)
+	commitment := f.file("https://"+as+".example/"+logId, result)
+	hash := payload.JudgementCommit(testDomain, logId, mls.Log.Revision, f.id(as), commitment, salt)
+	_, err := f.invoke(as, "anticheatCommit", logId, fmt.Sprint(mls.Log.Revision), hash)
+	return err
+}
+
+// reveal reveals the result anticheat as committed to
+func (f *fixture) reveal(as string, logId string, result string, salt string) error {
+	mls := f.mediaLogSubmit(logId)
+	args := append([]string{logId, fmt.Sprint(mls.Log.Revision)}, commitmentArgs(f.file("https://"+as+".example/"+logId, result))...)
+	args = append(args, salt, f.parties[as].sign(f.t, mls.Log.Encode(testDomain)))
+	_, err := f.invoke(as, "anticheatConfirm", args...)
+	return err
+}
+
+// judge has both anticheats commit to and reveal their results
+func (f *fixture) judge(logId string, ac1 string, ac2 string) {
+	f.t.Helper()
+	for _, err := range []error{
+		f.commit("ac1", logId, ac1, "salt1"),
+		f.commit("ac2", logId, ac2, "salt2"),
+		f.reveal("ac1", logId, ac1, "salt1"),
+		f.reveal("ac2", logId, ac2, "salt2"),
+	} {
+		if err != nil {
+			f.t.Fatal(err)
+		}
+	}
+}
+
+// attestation is what the settlement workers compute for a judged chunk
+func (f *fixture) attestation(logId string, mediaLog string, results map[string]string) Attestation {
+	f.t.Helper()
+	contractId, _, _ := splitLogId(logId)
+	var sc SignatureContract
+	f.state(contractId, &sc)
+	mls := f.mediaLogSubmit(logId)
+	parse := func(data string) *logformat.File {
+		file, err := logformat.Parse([]byte(data))
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		return file
+	}
+	files := make([]*logformat.File, len(sc.Contract.AntiCheatIds))
+	digests := make(map[string]string)
+	for i, id := range sc.Contract.AntiCheatIds {
+		if _, ok := mls.AntiCheatResultCommitment[id]; !ok {
+			continue
+		}
+		for name, result := range results {
+			if f.id(name) == id {
+				files[i] = parse(result)
+				digests[id] = payload.Digest([]byte(result))
+			}
+		}
+	}
+	tally, report, err := settlement.Settle(sc.Contract, mls.Log, parse(mediaLog), files, mls.Credits)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return Attestation{LogId: logId, Revision: mls.Log.Revision, LogDigest: mls.Log.Digest, ResultDigests: digests, Tally: tally, Report: report}
+}
+
+// attest submits the attestation of the oracle, which settles the chunk with a quorum of 1
+func (f *fixture) attest(attestation Attestation) string {
+	attestationAsBytes, _ := json.Marshal(attestation)
+	return f.must("oracle", "submitAttestation", string(attestationAsBytes), f.parties["oracle"].sign(f.t, attestation.Encode(testDomain)))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	GOVERNANCE_KEY             = "governance"
+	DEFAULT_DISPUTE_WINDOW     = 86400 * 3
+	DEFAULT_HOLD_PERIOD        = 86400 * 7
+	DEFAULT_ARBITRATION_WINDOW = 86400 * 14
+	MAX_ARBITRATION_WINDOW     = 86400 * 90
+)
+
+// Governance lists who runs the chaincode. Admins change the governance,
+// Oracles attest the settlement of judged chunks and OracleQuorum identical
+// attestations settle a chunk. Payouts are held for DisputeWindow seconds
+// after settlement, 0 paying out at once, and Arbitrators decide disputes
+// within ArbitrationWindow seconds, 0 taking DEFAULT_ARBITRATION_WINDOW,
+// after which the settlement is released as upheld.
+// The hold period of a contract escrow must be within MinHoldPeriod and
+// MaxHoldPeriod, both 0 allowing only DEFAULT_HOLD_PERIOD. Every contract
+// pays Fee to FeeAccount.
+type Governance struct {
+	Admins            []string
+	Oracles           []string
+	OracleQuorum      int
+	Arbitrators       []string
+	DisputeWindow     int64
+	ArbitrationWindow int64
+	MinHoldPeriod     int64
+	MaxHoldPeriod     int64
+	FeeAccount        string
+	Fee               PlatformFee
+}
+
+func (g Governance) isAdmin(id string) bool {
+	return contains(g.Admins, id)
+}
+
+func (g Governance) isOracle(id string) bool {
+	return contains(g.Oracles, id)
+}
+
+func (g Governance) isArbitrator(id string) bool {
+	return contains(g.Arbitrators, id)
+}
+
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (g Governance) check() error {
+	if len(g.Admins) == 0 {
+		return fmt.Errorf("governance needs at least one admin")
+	}
+	if g.OracleQuorum < 1 || g.OracleQuorum > len(g.Oracles) {
+		return fmt.Errorf("oracle quorum %d out of range, %d oracles", g.OracleQuorum, len(g.Oracles))
+	}
+	if g.DisputeWindow < 0 {
+		return fmt.Errorf("negative dispute window %d", g.DisputeWindow)
+	}
+	if g.DisputeWindow > 0 && len(g.Arbitrators) == 0 {
+		return fmt.Errorf("a dispute window needs at least one arbitrator")
+	}
+	if g.ArbitrationWindow < 0 || g.ArbitrationWindow > MAX_ARBITRATION_WINDOW {
+		return fmt.Errorf("arbitration window %d out of range [0, %d]", g.ArbitrationWindow, MAX_ARBITRATION_WINDOW)
+	}
+	if g.MinHoldPeriod < 0 || g.MaxHoldPeriod < g.MinHoldPeriod {
+		return fmt.Errorf("hold period bounds [%d, %d] out of range", g.MinHoldPeriod, g.MaxHoldPeriod)
+	}
+	return g.Fee.check(g.FeeAccount)
+}
+
+// arbitrationWindow returns the seconds the arbitrators have to decide a dispute
+func (g Governance) arbitrationWindow() int64 {
+	if g.ArbitrationWindow == 0 {
+		return DEFAULT_ARBITRATION_WINDOW
+	}
+	return g.ArbitrationWindow
+}
+
+// holdPeriod returns the seconds the escrow of a contract is held. A contract
+// without a hold period takes DEFAULT_HOLD_PERIOD, brought within the bounds.
+func (g Governance) holdPeriod(o ContractOptions) (int64, error) {
+	min, max := g.MinHoldPeriod, g.MaxHoldPeriod
+	if max == 0 {
+		min, max = DEFAULT_HOLD_PERIOD, DEFAULT_HOLD_PERIOD
+	}
+	if o.HoldPeriod == 0 {
+		if DEFAULT_HOLD_PERIOD < min {
+			return min, nil
+		}
+		if DEFAULT_HOLD_PERIOD > max {
+			return max, nil
+		}
+		return DEFAULT_HOLD_PERIOD, nil
+	}
+	if o.HoldPeriod < min || o.HoldPeriod > max {
+		return 0, fmt.Errorf("hold period %d out of the governance bounds [%d, %d]", o.HoldPeriod, min, max)
+	}
+	return o.HoldPeriod, nil
+}
+
+func getGovernanceInfo(stub shim.ChaincodeStubInterface) (Governance, error) {
+	var governance Governance
+	governanceAsBytes, err := stub.GetState(GOVERNANCE_KEY)
+	if err != nil {
+		return governance, err
+	}
+	if governanceAsBytes == nil {
+		return governance, fmt.Errorf("governance is not set")
+	}
+	err = json.Unmarshal(governanceAsBytes, &governance)
+	return governance, err
+}
+
+// initGovernance makes the identity instantiating the chaincode its first admin.
+// An upgrade keeps the governance in place.
+func initGovernance(stub shim.ChaincodeStubInterface) error {
+	governanceAsBytes, err := stub.GetState(GOVERNANCE_KEY)
+	if err != nil {
+		return err
+	}
+	if governanceAsBytes != nil {
+		return nil
+	}
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return fmt.Errorf("could not get ID: %w", err)
+	}
+	governanceAsBytes, _ = json.Marshal(Governance{Admins: []string{id}})
+	return stub.PutState(GOVERNANCE_KEY, governanceAsBytes)
+}
+
+// setGovernance replaces the governance, only an admin may call it
+// args[0]: governance JSON
+func setGovernance(stub shim.ChaincodeStubInterface, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Incorrect arguments. Expecting 1 value")
+	}
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return fmt.Errorf("could not get ID: %w", err)
+	}
+	current, err := getGovernanceInfo(stub)
+	if err != nil {
+		return err
+	}
+	if !current.isAdmin(id) {
+		return fmt.Errorf("%s is not a governance admin", id)
+	}
+	var governance Governance
+	err = json.Unmarshal([]byte(args[0]), &governance)
+	if err != nil {
+		return fmt.Errorf("governance format error: %s", err)
+	}
+	err = governance.check()
+	if err != nil {
+		return err
+	}
+	governanceAsBytes, _ := json.Marshal(governance)
+	return stub.PutState(GOVERNANCE_KEY, governanceAsBytes)
+}
+
+func getGovernance(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	governance, err := stub.GetState(GOVERNANCE_KEY)
+	if err != nil {
+		return "", err
+	}
+	return string(governance), nil
+}
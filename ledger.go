@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Money only moves as balanced journal entries between ledger accounts.
+// A party's ledger account is its id, a contract holds the money of its
+// payments in escrow sub-accounts until settlement, and LEDGER_ISSUANCE is
+// the counterpart of money put into or taken out of the chaincode. Every
+// entry sums to zero and Journal.commit checks the whole transaction does.
+const (
+	AMOUNT_SCALE    = 100 // amounts are kept in hundredths
+	LEDGER_ISSUANCE = "ledger/issuance"
+
+	ESCROW_MEDIA     = "media"
+	ESCROW_ANTICHEAT = "anticheat"
+	ESCROW_HELD      = "held" // payouts held during the dispute window, one account per payee
+	ESCROW_FEE       = "fee"
+
+	JOURNAL_INDEX = "journal"
+	POSTING_INDEX = "posting" // account, time, txId, entry seq, posting index
+	BALANCE_INDEX = "balance"
+)
+
+// reason codes of journal entries
+const (
+	REASON_OPENING          = "opening"          // money an account held before the ledger
+	REASON_DEPOSIT          = "deposit"          // setAccount raised the assets
+	REASON_WITHDRAWAL       = "withdrawal"       // setAccount lowered the assets
+	REASON_ESCROW           = "escrow"           // contract payment frozen at generatorContract
+	REASON_ESCROW_REFUND    = "escrow_refund"    // advertiserChargeGet
+	REASON_MEDIA_PAYMENT    = "media_payment"    // media met the threshold
+	REASON_MEDIA_REFUND     = "media_refund"     // media missed the threshold
+	REASON_ANTICHEAT_SHARE  = "anticheat_share"  // share of the anticheat payment
+	REASON_ANTICHEAT_REFUND = "anticheat_refund" // anticheat payment nobody earned
+	REASON_RELEASE          = "release"          // held payout released after the dispute window
+	REASON_PLATFORM_FEE     = "platform_fee"     // fee paid to the governance fee account
+	REASON_FEE_REFUND       = "fee_refund"       // fee escrow of a contract that paid no fee
+	REASON_REVERSAL         = "dispute_reversal" // payout reversed by an arbitrator
+)
+
+// LedgerPosting adds Amount to the balance of Account
+type LedgerPosting struct {
+	Account string
+	Amount  int64
+}
+
+// JournalEntry is a balanced set of postings
+type JournalEntry struct {
+	TxId       string
+	Seq        int
+	TimeStamp  int64
+	ContractId string
+	Reason     string
+	Postings   []LedgerPosting
+}
+
+func escrowAccount(contractId string, purpose string) string {
+	return contractId + "/escrow/" + purpose
+}
+
+func heldAccount(contractId string, payee string) string {
+	return escrowAccount(contractId, ESCROW_HELD+"/"+payee)
+}
+
+func isEscrowAccount(account string) bool {
+	return strings.Contains(account, "/escrow/")
+}
+
+// parseAmount reads a decimal amount into hundredths
+func parseAmount(s string) (int64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || math.Abs(f) > math.MaxInt64/AMOUNT_SCALE {
+		return 0, fmt.Errorf("amount format error: %s", s)
+	}
+	return int64(math.Round(f * AMOUNT_SCALE)), nil
+}
+
+func formatAmount(amount int64) string {
+	return strconv.FormatFloat(float64(amount)/AMOUNT_SCALE, 'f', 2, 64)
+}
+
+// Journal buffers the entries of a transaction. Fabric does not let a
+// transaction read its own writes, so it keeps the balances it moved.
+type Journal struct {
+	stub      shim.ChaincodeStubInterface
+	timeStamp int64
+	initial   map[string]int64 // balances before this transaction
+	balances  map[string]int64
+	entries   []JournalEntry
+	seq       int // seq of the first entry, after those a batch already journaled in this transaction
+}
+
+func newJournal(stub shim.ChaincodeStubInterface) (*Journal, error) {
+	timeStamp, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{stub: stub, timeStamp: timeStamp, initial: make(map[string]int64), balances: make(map[string]int64)}
+	for {
+		key, err := j.stub.CreateCompositeKey(JOURNAL_INDEX, []string{stub.GetTxID(), fmt.Sprintf("%06d", j.seq)})
+		if err != nil {
+			return nil, err
+		}
+		entryAsBytes, err := j.stub.GetState(key)
+		if err != nil {
+			return nil, err
+		}
+		if entryAsBytes == nil {
+			return j, nil
+		}
+		j.seq++
+	}
+}
+
+func balanceKey(stub shim.ChaincodeStubInterface, account string) (string, error) {
+	return stub.CreateCompositeKey(BALANCE_INDEX, []string{account})
+}
+
+// balance returns the balance of account as of the postings of this journal.
+// Accounts that held money before the ledger existed open with it: a party
+// with the Assets of its account, an escrow with what was frozen for it.
+// LEDGER_ISSUANCE is the counterpart of every deposit and withdrawal, so it
+// keeps no balance key all transactions would conflict on: its balance here
+// is only the change of this transaction.
+func (j *Journal) balance(account string) (int64, error) {
+	if b, ok := j.balances[account]; ok {
+		return b, nil
+	}
+	if account == LEDGER_ISSUANCE {
+		j.initial[account] = 0
+		j.balances[account] = 0
+		return 0, nil
+	}
+	key, err := balanceKey(j.stub, account)
+	if err != nil {
+		return 0, err
+	}
+	balanceAsBytes, err := j.stub.GetState(key)
+	if err != nil {
+		return 0, err
+	}
+	if balanceAsBytes != nil {
+		b, err := strconv.ParseInt(string(balanceAsBytes), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		j.initial[account] = b
+		j.balances[account] = b
+		return b, nil
+	}
+	j.initial[account] = 0
+	j.balances[account] = 0
+	opening, err := j.openingBalance(account)
+	if err != nil {
+		return 0, err
+	}
+	if opening > 0 {
+		err = j.transfer(LEDGER_ISSUANCE, account, opening, "", REASON_OPENING)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return j.balances[account], nil
+}
+
+// openingBalance returns what an account held before the ledger. Only the
+// media escrow of a contract frozen before the ledger opens with its
+// _freeze, a contract created under the ledger wrote the balance keys of
+// all its escrows.
+func (j *Journal) openingBalance(account string) (int64, error) {
+	if isEscrowAccount(account) {
+		i := strings.Index(account, "/escrow/")
+		if account[i+len("/escrow/"):] != ESCROW_MEDIA {
+			return 0, nil
+		}
+		for _, purpose := range []string{ESCROW_ANTICHEAT, ESCROW_FEE} {
+			key, err := balanceKey(j.stub, escrowAccount(account[:i], purpose))
+			if err != nil {
+				return 0, err
+			}
+			balanceAsBytes, err := j.stub.GetState(key)
+			if err != nil || balanceAsBytes != nil {
+				return 0, err
+			}
+		}
+		freeze, err := j.stub.GetState(account[:i] + "_freeze")
+		if err != nil || freeze == nil {
+			return 0, err
+		}
+		timePayment := strings.Split(string(freeze), "_")
+		if len(timePayment) != 2 {
+			return 0, nil
+		}
+		return parseAmount(timePayment[1])
+	}
+	accountAsBytes, err := j.stub.GetState(account)
+	if err != nil || accountAsBytes == nil {
+		return 0, err
+	}
+	var a Account
+	if json.Unmarshal(accountAsBytes, &a) != nil || a.Assets == "" {
+		return 0, nil
+	}
+	return parseAmount(a.Assets)
+}
+
+// transfer moves amount from one ledger account to another
+func (j *Journal) transfer(from string, to string, amount int64, contractId string, reason string) error {
+	if amount < 0 {
+		return fmt.Errorf("negative transfer %s from %s to %s", formatAmount(amount), from, to)
+	}
+	fromBalance, err := j.balance(from)
+	if err != nil {
+		return err
+	}
+	toBalance, err := j.balance(to)
+	if err != nil {
+		return err
+	}
+	if amount == 0 {
+		//both accounts still get a balance key, so an escrow of nothing
+		//is on the ledger and never opens from _freeze
+		return nil
+	}
+	if from != LEDGER_ISSUANCE && fromBalance < amount {
+		return fmt.Errorf("%s has %s, can not transfer %s", from, formatAmount(fromBalance), formatAmount(amount))
+	}
+	j.balances[from] = fromBalance - amount
+	j.balances[to] = toBalance + amount
+	j.entries = append(j.entries, JournalEntry{
+		TxId:       j.stub.GetTxID(),
+		Seq:        j.seq + len(j.entries),
+		TimeStamp:  j.timeStamp,
+		ContractId: contractId,
+		Reason:     reason,
+		Postings:   []LedgerPosting{{Account: from, Amount: -amount}, {Account: to, Amount: amount}},
+	})
+	return nil
+}
+
+// commit checks the journal conserves money and stores its entries, the
+// postings indexed by account, and the new balances but that of LEDGER_ISSUANCE
+func (j *Journal) commit() error {
+	var sum int64
+	for _, entry := range j.entries {
+		var entrySum int64
+		for _, posting := range entry.Postings {
+			entrySum += posting.Amount
+		}
+		if entrySum != 0 {
+			return fmt.Errorf("journal entry %d is not balanced: %s", entry.Seq, formatAmount(entrySum))
+		}
+		sum += entrySum
+	}
+	for account, balance := range j.balances {
+		sum += balance - j.initial[account]
+	}
+	if sum != 0 {
+		return fmt.Errorf("transaction does not conserve money: %s", formatAmount(sum))
+	}
+	txId := j.stub.GetTxID()
+	for _, entry := range j.entries {
+		seq := fmt.Sprintf("%06d", entry.Seq)
+		timeStamp := fmt.Sprintf("%012d", entry.TimeStamp)
+		key, err := j.stub.CreateCompositeKey(JOURNAL_INDEX, []string{txId, seq})
+		if err != nil {
+			return err
+		}
+		entryAsBytes, _ := json.Marshal(entry)
+		err = j.stub.PutState(key, entryAsBytes)
+		if err != nil {
+			return err
+		}
+		for i, posting := range entry.Postings {
+			key, err := j.stub.CreateCompositeKey(POSTING_INDEX, []string{posting.Account, timeStamp, txId, seq, strconv.Itoa(i)})
+			if err != nil {
+				return err
+			}
+			err = j.stub.PutState(key, []byte(strconv.FormatInt(posting.Amount, 10)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	accounts := make([]string, 0, len(j.balances))
+	for account := range j.balances {
+		accounts = append(accounts, account)
+	}
+	sort.Strings(accounts)
+	for _, account := range accounts {
+		if account == LEDGER_ISSUANCE {
+			continue
+		}
+		if j.balances[account] < 0 {
+			return fmt.Errorf("%s would be overdrawn", account)
+		}
+		key, err := balanceKey(j.stub, account)
+		if err != nil {
+			return err
+		}
+		err = j.stub.PutState(key, []byte(strconv.FormatInt(j.balances[account], 10)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ledgerBalance derives the balance of account from its postings
+func ledgerBalance(stub shim.ChaincodeStubInterface, account string) (int64, error) {
+	it, err := stub.GetStateByPartialCompositeKey(POSTING_INDEX, []string{account})
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+	var balance int64
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return 0, err
+		}
+		amount, err := strconv.ParseInt(string(kv.Value), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		balance += amount
+	}
+	return balance, nil
+}
+
+// getBalance returns the balance of a ledger account derived from its
+// postings, a party's id or an escrow such as contractId/escrow/media.
+// The balance of LEDGER_ISSUANCE is minus the money in the chaincode.
+// args[0]: ledger account
+func getBalance(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("Incorrect arguments. Expecting 1 argument")
+	}
+	if args[0] == LEDGER_ISSUANCE {
+		balance, err := ledgerBalance(stub, LEDGER_ISSUANCE)
+		if err != nil {
+			return "", err
+		}
+		return formatAmount(balance), nil
+	}
+	key, err := balanceKey(stub, args[0])
+	if err != nil {
+		return "", err
+	}
+	cached, err := stub.GetState(key)
+	if err != nil {
+		return "", err
+	}
+	if cached == nil {
+		//not on the ledger yet, what it would open with
+		j, err := newJournal(stub)
+		if err != nil {
+			return "", err
+		}
+		balance, err := j.balance(args[0])
+		if err != nil {
+			return "", err
+		}
+		return formatAmount(balance), nil
+	}
+	balance, err := ledgerBalance(stub, args[0])
+	if err != nil {
+		return "", err
+	}
+	return formatAmount(balance), nil
+}
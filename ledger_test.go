@@ -0,0 +1,272 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	testAllFake    = "#hwxf v2 tsv\nimp-1\t-1\nimp-2\t-1\nimp-3\t-1\nimp-4\t-1\n"
+	testAllAbstain = "#hwxf v2 tsv\nimp-1\tabstain\nimp-2\tabstain\nimp-3\tabstain\nimp-4\tabstain\n"
+)
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		amount  string
+		want    int64
+		wantErr bool
+	}{
+		{amount: "100", want: 10000},
+		{amount: "0.01", want: 1},
+		{amount: "1.006", want: 101},
+		{amount: "-2.5", want: -250},
+		{amount: "x", wantErr: true},
+		{amount: "NaN", wantErr: true},
+		{amount: "Inf", wantErr: true},
+		{amount: "1e17", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.amount, func(t *testing.T) {
+			got, err := parseAmount(tt.amount)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Fatalf("got %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestJournal(t *testing.T) {
+	tests := []struct {
+		name    string
+		run     func(f *fixture, j *Journal) error
+		wantErr string
+	}{
+		{
+			name: "transfer",
+			run: func(f *fixture, j *Journal) error {
+				return j.transfer(f.id("advertiser"), f.id("media"), 25000, "", REASON_MEDIA_PAYMENT)
+			},
+		},
+		{
+			name: "overdraft",
+			run: func(f *fixture, j *Journal) error {
+				return j.transfer(f.id("advertiser"), f.id("media"), 100001, "", REASON_MEDIA_PAYMENT)
+			},
+			wantErr: "can not transfer 1000.01",
+		},
+		{
+			name: "negative transfer",
+			run: func(f *fixture, j *Journal) error {
+				return j.transfer(f.id("media"), f.id("advertiser"), -1, "", REASON_MEDIA_PAYMENT)
+			},
+			wantErr: "negative transfer",
+		},
+		{
+			name: "unbalanced entry",
+			run: func(f *fixture, j *Journal) error {
+				j.transfer(f.id("advertiser"), f.id("media"), 100, "", REASON_MEDIA_PAYMENT)
+				j.entries[0].Postings[1].Amount = 50
+				return j.commit()
+			},
+			wantErr: "is not balanced",
+		},
+		{
+			name: "money out of nowhere",
+			run: func(f *fixture, j *Journal) error {
+				j.balance(f.id("media"))
+				j.balances[f.id("media")] += 100
+				return j.commit()
+			},
+			wantErr: "does not conserve money",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, nil)
+			f.start("admin", "", nil)
+			j, err := newJournal(f.stub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tt.run(f, j)
+			if err == nil {
+				err = j.commit()
+			}
+			f.stub.MockTransactionEnd(f.stub.TxID)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.balance("advertiser"); got != "750.00" {
+				t.Fatalf("advertiser has %s", got)
+			}
+			if got := f.balance("media"); got != "250.00" {
+				t.Fatalf("media has %s", got)
+			}
+		})
+	}
+}
+
+// Deposits and withdrawals post against LEDGER_ISSUANCE, whose balance is
+// derived from its postings and never stored
+func TestIssuance(t *testing.T) {
+	f := newFixture(t, nil)
+	issuanceKey, _ := balanceKey(f.stub, LEDGER_ISSUANCE)
+	tests := []struct {
+		name     string
+		as       string
+		assets   string
+		balance  string
+		issuance string
+	}{
+		{name: "deposit", as: "media", assets: "50", balance: "50.00", issuance: "-1050.00"},
+		{name: "withdrawal", as: "advertiser", assets: "400", balance: "400.00", issuance: "-450.00"},
+		{name: "no change", as: "advertiser", assets: "400", balance: "400.00", issuance: "-450.00"},
+		{name: "withdraw all", as: "media", assets: "0", balance: "0.00", issuance: "-400.00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f.must(tt.as, "setAccount", "media", "0", tt.assets, f.parties[tt.as].pub)
+			if got := f.balance(tt.as); got != tt.balance {
+				t.Fatalf("got balance %s, want %s", got, tt.balance)
+			}
+			if got := f.balance(LEDGER_ISSUANCE); got != tt.issuance {
+				t.Fatalf("got issuance %s, want %s", got, tt.issuance)
+			}
+			if f.stub.State[issuanceKey] != nil {
+				t.Fatal("issuance has a balance key")
+			}
+		})
+	}
+}
+
+// settle runs a contract of one chunk judged by ac1 and ac2 to its payout
+func settle(f *fixture, ac1 string, ac2 string) *SettlementRecord {
+	contractId := f.contract(ContractOptions{})
+	logId := f.submit(contractId, 0, 1, testMediaLog)
+	f.judge(logId, ac1, ac2)
+	f.attest(f.attestation(logId, testMediaLog, map[string]string{"ac1": ac1, "ac2": ac2}))
+	var record SettlementRecord
+	f.state(contractId+"_settlement", &record)
+	return &record
+}
+
+func TestPayOut(t *testing.T) {
+	tests := []struct {
+		name     string
+		ac1, ac2 string
+		balances map[string]string
+		paid     bool
+		refunded bool
+	}{
+		{
+			name:     "media paid",
+			ac1:      testAllReal,
+			ac2:      testHalfFake,
+			balances: map[string]string{"advertiser": "879.01", "media": "100.00", "ac1": "6.66", "ac2": "3.33", "fee": "11.00"},
+			paid:     true,
+		},
+		{
+			name:     "media refunded",
+			ac1:      testAllFake,
+			ac2:      testAllFake,
+			balances: map[string]string{"advertiser": "979.00", "media": "0.00", "ac1": "5.00", "ac2": "5.00", "fee": "11.00"},
+		},
+		{
+			name:     "nothing judged refunds every escrow",
+			ac1:      testAllAbstain,
+			ac2:      testAllAbstain,
+			balances: map[string]string{"advertiser": "1000.00", "media": "0.00", "ac1": "0.00", "ac2": "0.00", "fee": "0.00"},
+			refunded: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, func(f *fixture, g *Governance) {
+				g.FeeAccount = f.id("fee")
+				g.Fee = PlatformFee{Type: FEE_PERCENT, Amount: "10"}
+			})
+			record := settle(f, tt.ac1, tt.ac2)
+			if !record.Finalized || record.MediaPaid != tt.paid || record.Refunded != tt.refunded {
+				t.Fatalf("got record finalized %v, media paid %v, refunded %v", record.Finalized, record.MediaPaid, record.Refunded)
+			}
+			for name, want := range tt.balances {
+				if got := f.balance(name); got != want {
+					t.Fatalf("%s has %s, want %s", name, got, want)
+				}
+			}
+			for _, purpose := range []string{ESCROW_MEDIA, ESCROW_ANTICHEAT, ESCROW_FEE} {
+				if got := f.balance(escrowAccount(record.ContractId, purpose)); got != "0.00" {
+					t.Fatalf("%s escrow has %s", purpose, got)
+				}
+			}
+			if got := f.balance(LEDGER_ISSUANCE); got != "-1000.00" {
+				t.Fatalf("issuance is %s", got)
+			}
+			if tt.refunded && f.account("media").Credit != "0" {
+				t.Fatalf("media credit changed to %s", f.account("media").Credit)
+			}
+		})
+	}
+}
+
+// A contract paying nothing to the media still has its media escrow on the
+// ledger, settlement must not open it from _freeze
+func TestZeroEscrow(t *testing.T) {
+	f := newFixture(t, nil)
+	contractId := f.contractPaying(ContractOptions{}, "0", "10")
+	for _, purpose := range []string{ESCROW_MEDIA, ESCROW_ANTICHEAT, ESCROW_FEE} {
+		key, _ := balanceKey(f.stub, escrowAccount(contractId, purpose))
+		if f.stub.State[key] == nil {
+			t.Fatalf("%s escrow has no balance key", purpose)
+		}
+	}
+	logId := f.submit(contractId, 0, 1, testMediaLog)
+	f.judge(logId, testAllReal, testAllReal)
+	f.attest(f.attestation(logId, testMediaLog, map[string]string{"ac1": testAllReal, "ac2": testAllReal}))
+
+	balances := map[string]string{"advertiser": "990.00", "media": "0.00", "ac1": "5.00", "ac2": "5.00", LEDGER_ISSUANCE: "-1000.00"}
+	for name, want := range balances {
+		if got := f.balance(name); got != want {
+			t.Fatalf("%s has %s, want %s", name, got, want)
+		}
+	}
+}
+
+// Only the media escrow of a contract frozen before the ledger opens with its _freeze
+func TestEscrowOpening(t *testing.T) {
+	tests := []struct {
+		name     string
+		onLedger string // escrow of the contract with a balance key
+		want     int64
+	}{
+		{name: "frozen before the ledger", want: 4200},
+		{name: "anticheat escrow on the ledger", onLedger: ESCROW_ANTICHEAT},
+		{name: "fee escrow on the ledger", onLedger: ESCROW_FEE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, nil)
+			f.start("admin", "", nil)
+			f.stub.PutState("legacy_freeze", []byte("1500000000_42.00"))
+			if tt.onLedger != "" {
+				key, _ := balanceKey(f.stub, escrowAccount("legacy", tt.onLedger))
+				f.stub.PutState(key, []byte("0"))
+			}
+			j, err := newJournal(f.stub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := j.balance(escrowAccount("legacy", ESCROW_MEDIA))
+			f.stub.MockTransactionEnd(f.stub.TxID)
+			if err != nil || got != tt.want {
+				t.Fatalf("got %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+}
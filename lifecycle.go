@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// lifecycle states of a contract
+const (
+	STATE_PROPOSED = "proposed" // waiting for the signatures of the media and the anticheats
+	STATE_ACTIVE   = "active"   // signed by every party, chunks are submitted and judged
+	STATE_SETTLING = "settling" // some chunks are settled
+	STATE_SETTLED  = "settled"  // every chunk is settled and the contract is paid out
+	STATE_REFUNDED = "refunded" // the advertiser took the escrow back before settlement
+	STATE_DISPUTED = "disputed" // a party disputes the settlement, its payouts stay held
+)
+
+// contractState returns the lifecycle state of a contract. Contracts stored
+// before the state was recorded are proposed or active by their signatures.
+func contractState(sc SignatureContract) string {
+	if sc.State != "" {
+		return sc.State
+	}
+	if sc.ContractSignature.count() == len(sc.Contract.AntiCheatIds)+2 {
+		return STATE_ACTIVE
+	}
+	return STATE_PROPOSED
+}
+
+// checkContractState fails unless the contract is in one of states
+func checkContractState(contractId string, sc SignatureContract, states ...string) error {
+	state := contractState(sc)
+	for _, s := range states {
+		if state == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("contract %s is %s, expecting %v", contractId, state, states)
+}
+
+func putContractState(stub shim.ChaincodeStubInterface, contractId string, sc SignatureContract, state string) error {
+	sc.State = state
+	scAsBytes, _ := json.Marshal(sc)
+	return stub.PutState(contractId, scAsBytes)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Only the media and the anticheats of a contract sign it after the
+// advertiser, and it is active once every one of them did
+func TestMediaAntiConfirm(t *testing.T) {
+	tests := []struct {
+		name    string
+		signers []string
+		state   string
+		wantErr string
+	}{
+		{name: "every party", signers: []string{"media", "ac1", "ac2"}, state: STATE_ACTIVE},
+		{name: "some parties", signers: []string{"media", "ac1"}, state: STATE_PROPOSED},
+		{name: "twice", signers: []string{"media", "ac1", "ac1"}, state: STATE_PROPOSED},
+		{name: "stranger", signers: []string{"media", "ac1", "oracle"}, wantErr: "is not the media or an anticheat"},
+		{name: "advertiser", signers: []string{"media", "ac1", "advertiser"}, wantErr: "is not the media or an anticheat"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, nil)
+			contractId, msg := f.propose(ContractOptions{}, "100", "10")
+			var err error
+			for _, name := range tt.signers {
+				_, err = f.invoke(name, "mediaAntiConfirm", f.parties[name].sign(t, msg), contractId)
+				if err != nil {
+					break
+				}
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sc SignatureContract
+			f.state(contractId, &sc)
+			if state := contractState(sc); state != tt.state {
+				t.Fatalf("contract is %s, want %s", state, tt.state)
+			}
+		})
+	}
+}
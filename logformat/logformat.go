@@ -0,0 +1,366 @@
+// Package logformat reads media log and anticheat result files.
+//
+// A file starts with a header naming the format version and encoding:
+//
+//	#hwxf v1 tsv
+//
+// followed by one record per line. The encodings are
+//
+//	tsv    id<TAB>score<TAB>reasons
+//	csv    id,score,reasons
+//	jsonl  {"id":"...","score":0.5,"reasons":["BOT"]}
+//
+// The score is left out in media logs. Since version 2 a judgement may name
+// why the impression is invalid traffic with reason codes, separated by "|"
+// in tsv and csv; the reasons column is optional. An anticheat that can not judge a
+// record writes the score "abstain", or {"id":"...","abstain":true} in
+// jsonl. Any file may be gzip compressed as a
+// whole, the header then is the first line of the decompressed content.
+// Files without a header are read as version 0, the original format of
+// id, four spaces and score.
+//
+// Parse never drops a line silently: every line it can not read is returned
+// in File.Errors with its line number.
+package logformat
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	VERSION = 2
+
+	ENCODING_LEGACY = "legacy"
+	ENCODING_TSV    = "tsv"
+	ENCODING_CSV    = "csv"
+	ENCODING_JSONL  = "jsonl"
+
+	HEADER_PREFIX = "#hwxf "
+
+	ABSTAIN = "abstain"
+
+	REASON_SEPARATOR = "|"
+)
+
+// invalid traffic reason codes, after the IAB/MRC invalid traffic guidelines
+const (
+	REASON_GIVT         = "GIVT"         // general invalid traffic
+	REASON_SIVT         = "SIVT"         // sophisticated invalid traffic
+	REASON_BOT          = "BOT"          // bots and spiders
+	REASON_CLICK_FARM   = "CLICK_FARM"   // human click farms and incentivized traffic
+	REASON_GEO_MISMATCH = "GEO_MISMATCH" // location does not match the targeted region
+	REASON_DATA_CENTER  = "DATA_CENTER"  // traffic from data center IP addresses
+	REASON_HIJACKED     = "HIJACKED"     // hijacked devices, sessions or ad tags
+	REASON_OTHER        = "OTHER"
+)
+
+var reasonCodes = map[string]bool{
+	REASON_GIVT:         true,
+	REASON_SIVT:         true,
+	REASON_BOT:          true,
+	REASON_CLICK_FARM:   true,
+	REASON_GEO_MISMATCH: true,
+	REASON_DATA_CENTER:  true,
+	REASON_HIJACKED:     true,
+	REASON_OTHER:        true,
+}
+
+// IsReasonCode reports whether code is a known invalid traffic reason
+func IsReasonCode(code string) bool {
+	return reasonCodes[code]
+}
+
+// MaxDecompressedSize caps the content of gzip compressed files
+var MaxDecompressedSize int64 = 1 << 30
+
+type Record struct {
+	Line     int
+	ID       string
+	HasScore bool
+	Score    float64
+	Abstain  bool
+	Reasons  []string
+}
+
+// Canonical returns the encoding independent form of r, the leaf of the
+// file's merkle tree: the id, followed by a tab and the shortest decimal
+// form of the score, or "abstain", when there is one, and by a tab and the
+// reasons joined by "|" when there are any.
+func (r Record) Canonical() []byte {
+	var canonical string
+	if r.Abstain {
+		canonical = r.ID + "\t" + ABSTAIN
+	} else if r.HasScore {
+		canonical = r.ID + "\t" + strconv.FormatFloat(r.Score, 'g', -1, 64)
+	} else {
+		return []byte(r.ID)
+	}
+	if len(r.Reasons) > 0 {
+		canonical += "\t" + strings.Join(r.Reasons, REASON_SEPARATOR)
+	}
+	return []byte(canonical)
+}
+
+type LineError struct {
+	Line int
+	Text string
+	Err  error
+}
+
+func (e LineError) Error() string {
+	return fmt.Sprintf("line %d: %v: %q", e.Line, e.Err, e.Text)
+}
+
+// ParseErrors lists every line of a file that could not be read
+type ParseErrors []LineError
+
+func (e ParseErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, le := range e {
+		msgs[i] = le.Error()
+	}
+	return fmt.Sprintf("%d lines could not be parsed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+type File struct {
+	Version    int
+	Encoding   string
+	Compressed bool
+	Records    []Record
+	Errors     ParseErrors
+}
+
+// Canonical returns the canonical form of every record, in file order
+func (f *File) Canonical() [][]byte {
+	records := make([][]byte, len(f.Records))
+	for i, r := range f.Records {
+		records[i] = r.Canonical()
+	}
+	return records
+}
+
+// Err returns the parse errors of f, or nil when every line was read
+func (f *File) Err() error {
+	if len(f.Errors) == 0 {
+		return nil
+	}
+	return f.Errors
+}
+
+// Parse reads a file. It only fails when the file as a whole can not be read,
+// errors of single lines are collected in File.Errors.
+func Parse(data []byte) (*File, error) {
+	f := &File{}
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data, err = ioutil.ReadAll(io.LimitReader(zr, MaxDecompressedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) > MaxDecompressedSize {
+			return nil, fmt.Errorf("decompressed file is larger than %d bytes", MaxDecompressedSize)
+		}
+		f.Compressed = true
+	}
+
+	lines := strings.Split(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	first := 0
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "#") {
+		if err := f.parseHeader(strings.TrimSuffix(lines[0], "\r")); err != nil {
+			return nil, err
+		}
+		first = 1
+	} else {
+		f.Version = 0
+		f.Encoding = ENCODING_LEGACY
+	}
+
+	f.Records = make([]Record, 0, len(lines)-first)
+	for i := first; i < len(lines); i++ {
+		text := strings.TrimSuffix(lines[i], "\r")
+		r, err := parseRecord(f.Version, f.Encoding, text)
+		if err != nil {
+			f.Errors = append(f.Errors, LineError{Line: i + 1, Text: text, Err: err})
+			continue
+		}
+		r.Line = i + 1
+		f.Records = append(f.Records, r)
+	}
+	return f, nil
+}
+
+func (f *File) parseHeader(line string) error {
+	if !strings.HasPrefix(line, HEADER_PREFIX) {
+		return fmt.Errorf("line 1: unknown header %q", line)
+	}
+	fields := strings.Fields(line[len(HEADER_PREFIX):])
+	if len(fields) != 2 || !strings.HasPrefix(fields[0], "v") {
+		return fmt.Errorf("line 1: header must be %q followed by version and encoding: %q", HEADER_PREFIX, line)
+	}
+	version, err := strconv.Atoi(fields[0][1:])
+	if err != nil {
+		return fmt.Errorf("line 1: version format error: %q", fields[0])
+	}
+	if version < 1 || version > VERSION {
+		return fmt.Errorf("line 1: unsupported format version %d", version)
+	}
+	switch fields[1] {
+	case ENCODING_TSV, ENCODING_CSV, ENCODING_JSONL:
+	default:
+		return fmt.Errorf("line 1: unsupported encoding %q", fields[1])
+	}
+	f.Version = version
+	f.Encoding = fields[1]
+	return nil
+}
+
+func parseRecord(version int, encoding string, text string) (Record, error) {
+	var r Record
+	if strings.TrimSpace(text) == "" {
+		return r, fmt.Errorf("empty line")
+	}
+	switch encoding {
+	case ENCODING_LEGACY:
+		return parseFields(version, strings.Split(strings.Replace(text, "\t", "    ", -1), "    "))
+	case ENCODING_TSV:
+		return parseFields(version, strings.Split(text, "\t"))
+	case ENCODING_CSV:
+		cr := csv.NewReader(strings.NewReader(text))
+		cr.FieldsPerRecord = -1
+		fields, err := cr.Read()
+		if err != nil {
+			return r, err
+		}
+		return parseFields(version, fields)
+	case ENCODING_JSONL:
+		return parseJSON(version, text)
+	}
+	return r, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+func parseFields(version int, fields []string) (Record, error) {
+	var r Record
+	maxFields := 2
+	if version >= 2 {
+		maxFields = 3
+	}
+	if len(fields) > maxFields {
+		return r, fmt.Errorf("expecting at most %d fields, got %d", maxFields, len(fields))
+	}
+	if len(fields) == 3 {
+		reasons, err := parseReasons(strings.Split(strings.TrimSpace(fields[2]), REASON_SEPARATOR))
+		if err != nil {
+			return r, err
+		}
+		r.Reasons = reasons
+		fields = fields[:2]
+	}
+	r.ID = strings.TrimSpace(fields[0])
+	if r.ID == "" {
+		return r, fmt.Errorf("empty id")
+	}
+	if len(fields) == 2 && strings.TrimSpace(fields[1]) == ABSTAIN {
+		if len(r.Reasons) > 0 {
+			return r, fmt.Errorf("reasons given for an abstained judgement")
+		}
+		r.Abstain = true
+		return r, nil
+	}
+	if len(fields) == 2 {
+		score, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+		if err != nil || math.IsNaN(score) || math.IsInf(score, 0) {
+			return r, fmt.Errorf("score format error")
+		}
+		r.Score = score
+		r.HasScore = true
+	}
+	if len(r.Reasons) > 0 && !r.HasScore {
+		return r, fmt.Errorf("reasons given without a score")
+	}
+	return r, nil
+}
+
+// parseReasons checks reason codes, an empty list means no reasons
+func parseReasons(codes []string) ([]string, error) {
+	if len(codes) == 1 && codes[0] == "" {
+		return nil, nil
+	}
+	seen := make(map[string]bool, len(codes))
+	reasons := make([]string, 0, len(codes))
+	for _, code := range codes {
+		code = strings.TrimSpace(code)
+		if !IsReasonCode(code) {
+			return nil, fmt.Errorf("unknown reason code %q", code)
+		}
+		if seen[code] {
+			return nil, fmt.Errorf("reason code %q given twice", code)
+		}
+		seen[code] = true
+		reasons = append(reasons, code)
+	}
+	return reasons, nil
+}
+
+type jsonRecord struct {
+	ID      string   `json:"id"`
+	Score   *float64 `json:"score"`
+	Abstain bool     `json:"abstain"`
+	Reasons []string `json:"reasons"`
+}
+
+func parseJSON(version int, text string) (Record, error) {
+	var r Record
+	var jr jsonRecord
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&jr); err != nil {
+		return r, err
+	}
+	if dec.More() {
+		return r, fmt.Errorf("more than one value on the line")
+	}
+	if jr.ID == "" {
+		return r, fmt.Errorf("empty id")
+	}
+	r.ID = jr.ID
+	if jr.Reasons != nil {
+		if version < 2 {
+			return r, fmt.Errorf("reasons need format version 2")
+		}
+		if jr.Score == nil {
+			return r, fmt.Errorf("reasons given without a score")
+		}
+		reasons, err := parseReasons(jr.Reasons)
+		if err != nil {
+			return r, err
+		}
+		r.Reasons = reasons
+	}
+	if jr.Abstain {
+		if jr.Score != nil {
+			return r, fmt.Errorf("both score and abstain")
+		}
+		r.Abstain = true
+		return r, nil
+	}
+	if jr.Score != nil {
+		r.Score = *jr.Score
+		r.HasScore = true
+	}
+	return r, nil
+}
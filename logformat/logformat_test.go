@@ -0,0 +1,186 @@
+package logformat
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, data string) string {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		version    int
+		encoding   string
+		compressed bool
+		canonical  []string
+		errLines   []int
+	}{
+		{
+			name:      "media log",
+			data:      "#hwxf v2 tsv\nimp-1\nimp-2\n",
+			version:   2,
+			encoding:  ENCODING_TSV,
+			canonical: []string{"imp-1", "imp-2"},
+		},
+		{
+			name:      "tsv",
+			data:      "#hwxf v2 tsv\nimp-1\t0.5\nimp-2\t-1\tBOT|GIVT\nimp-3\tabstain\n",
+			version:   2,
+			encoding:  ENCODING_TSV,
+			canonical: []string{"imp-1\t0.5", "imp-2\t-1\tBOT|GIVT", "imp-3\tabstain"},
+		},
+		{
+			name:      "csv",
+			data:      "#hwxf v2 csv\r\nimp-1,0.50\r\n\"imp,2\",-1,BOT\r\nimp-3,abstain\r\n",
+			version:   2,
+			encoding:  ENCODING_CSV,
+			canonical: []string{"imp-1\t0.5", "imp,2\t-1\tBOT", "imp-3\tabstain"},
+		},
+		{
+			name:      "jsonl",
+			data:      "#hwxf v2 jsonl\n{\"id\":\"imp-1\",\"score\":0.5}\n{\"id\":\"imp-2\",\"score\":-1,\"reasons\":[\"BOT\"]}\n{\"id\":\"imp-3\",\"abstain\":true}\n",
+			version:   2,
+			encoding:  ENCODING_JSONL,
+			canonical: []string{"imp-1\t0.5", "imp-2\t-1\tBOT", "imp-3\tabstain"},
+		},
+		{
+			name:      "legacy",
+			data:      "imp-1    0.5\nimp-2\t-1\n",
+			encoding:  ENCODING_LEGACY,
+			canonical: []string{"imp-1\t0.5", "imp-2\t-1"},
+		},
+		{
+			name:       "gzip",
+			data:       gzipped(t, "#hwxf v1 tsv\nimp-1\t0.5\n"),
+			version:    1,
+			encoding:   ENCODING_TSV,
+			compressed: true,
+			canonical:  []string{"imp-1\t0.5"},
+		},
+		{
+			name:      "bad lines are reported, not dropped",
+			data:      "#hwxf v2 tsv\nimp-1\t0.5\n\t0.5\nimp-3\tNaN\nimp-4\t0.5\tSPAM\nimp-5\tabstain\tBOT\nimp-6\t0.5\tBOT|BOT\n\nimp-8\t1\n",
+			version:   2,
+			encoding:  ENCODING_TSV,
+			canonical: []string{"imp-1\t0.5", "imp-8\t1"},
+			errLines:  []int{3, 4, 5, 6, 7, 8},
+		},
+		{
+			name:      "reasons need version 2",
+			data:      "#hwxf v1 tsv\nimp-1\t0.5\tBOT\nimp-2\t0.5\n",
+			version:   1,
+			encoding:  ENCODING_TSV,
+			canonical: []string{"imp-2\t0.5"},
+			errLines:  []int{2},
+		},
+		{
+			name:      "bad json lines",
+			data:      "#hwxf v2 jsonl\n{\"id\":\"imp-1\",\"score\":1,\"abstain\":true}\n{\"id\":\"imp-2\",\"reasons\":[\"BOT\"]}\n{\"id\":\"imp-3\",\"extra\":1}\n{\"id\":\"imp-4\"}{}\n",
+			version:   2,
+			encoding:  ENCODING_JSONL,
+			canonical: []string{},
+			errLines:  []int{2, 3, 4, 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := Parse([]byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Version != tt.version || f.Encoding != tt.encoding || f.Compressed != tt.compressed {
+				t.Fatalf("got v%d %s compressed %v", f.Version, f.Encoding, f.Compressed)
+			}
+			var canonical []string
+			for _, c := range f.Canonical() {
+				canonical = append(canonical, string(c))
+			}
+			if strings.Join(canonical, "\n") != strings.Join(tt.canonical, "\n") {
+				t.Fatalf("got records %q, want %q", canonical, tt.canonical)
+			}
+			var errLines []int
+			for _, le := range f.Errors {
+				errLines = append(errLines, le.Line)
+			}
+			if len(errLines) != len(tt.errLines) {
+				t.Fatalf("got errors on lines %v, want %v: %v", errLines, tt.errLines, f.Err())
+			}
+			for i := range errLines {
+				if errLines[i] != tt.errLines[i] {
+					t.Fatalf("got errors on lines %v, want %v", errLines, tt.errLines)
+				}
+			}
+			if (f.Err() == nil) != (len(tt.errLines) == 0) {
+				t.Fatalf("Err() is %v", f.Err())
+			}
+		})
+	}
+}
+
+func TestParseFails(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{name: "unknown header", data: "#other v1 tsv\n", wantErr: "unknown header"},
+		{name: "no encoding", data: "#hwxf v1\n", wantErr: "followed by version and encoding"},
+		{name: "version format", data: "#hwxf vx tsv\n", wantErr: "version format error"},
+		{name: "future version", data: "#hwxf v3 tsv\n", wantErr: "unsupported format version 3"},
+		{name: "unknown encoding", data: "#hwxf v2 xml\n", wantErr: "unsupported encoding"},
+		{name: "broken gzip", data: "\x1f\x8b\x08", wantErr: "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMaxDecompressedSize(t *testing.T) {
+	defer func(max int64) { MaxDecompressedSize = max }(MaxDecompressedSize)
+	MaxDecompressedSize = 16
+	_, err := Parse([]byte(gzipped(t, "#hwxf v2 tsv\nimp-1\nimp-2\n")))
+	if err == nil || !strings.Contains(err.Error(), "larger than 16 bytes") {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+// The canonical form, and so the merkle root, does not depend on the encoding
+func TestCanonicalIsEncodingIndependent(t *testing.T) {
+	files := []string{
+		"#hwxf v2 tsv\nimp-1\t0.50\tBOT\n",
+		"#hwxf v2 csv\nimp-1, 5e-1 ,BOT\n",
+		"#hwxf v2 jsonl\n{\"id\":\"imp-1\",\"score\":0.5,\"reasons\":[\"BOT\"]}\n",
+		gzipped(t, "#hwxf v2 tsv\nimp-1\t.5\tBOT\n"),
+	}
+	for _, data := range files {
+		f, err := Parse([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(f.Canonical()[0]); got != "imp-1\t0.5\tBOT" {
+			t.Fatalf("%q: got %q", data, got)
+		}
+	}
+}
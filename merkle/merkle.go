@@ -0,0 +1,110 @@
+// Package merkle commits to the ordered records of a log or anticheat
+// result file, so a single record can later be proven to be part of a
+// submission without revealing the whole file. The records are the
+// canonical forms returned by logformat.File.Canonical, so the root does
+// not depend on the file encoding or compression.
+//
+// The tree is the one of RFC 6962: leaves are SHA-256(0x00 || record),
+// inner nodes SHA-256(0x01 || left || right), and a tree of n leaves is
+// split at the largest power of two smaller than n.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
+
+func LeafHash(record []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(record)
+	return h.Sum(nil)
+}
+
+func nodeHash(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// split returns the largest power of two smaller than n, n > 1
+func split(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+func rootOfLeaves(leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	k := split(len(leaves))
+	return nodeHash(rootOfLeaves(leaves[:k]), rootOfLeaves(leaves[k:]))
+}
+
+func leafHashes(records [][]byte) [][]byte {
+	leaves := make([][]byte, len(records))
+	for i, record := range records {
+		leaves[i] = LeafHash(record)
+	}
+	return leaves
+}
+
+// Root returns the Merkle tree hash of records
+func Root(records [][]byte) []byte {
+	if len(records) == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+	return rootOfLeaves(leafHashes(records))
+}
+
+func pathOfLeaves(leaves [][]byte, index int) [][]byte {
+	if len(leaves) == 1 {
+		return [][]byte{}
+	}
+	k := split(len(leaves))
+	if index < k {
+		return append(pathOfLeaves(leaves[:k], index), rootOfLeaves(leaves[k:]))
+	}
+	return append(pathOfLeaves(leaves[k:], index-k), rootOfLeaves(leaves[:k]))
+}
+
+// Proof returns the inclusion proof of records[index], ordered from the leaf up
+func Proof(records [][]byte, index int) ([][]byte, error) {
+	if index < 0 || index >= len(records) {
+		return nil, fmt.Errorf("index %d out of range, %d records", index, len(records))
+	}
+	return pathOfLeaves(leafHashes(records), index), nil
+}
+
+// Verify reports whether record is the index-th of size records committed by root
+func Verify(root []byte, record []byte, index int, size int, proof [][]byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	fn, sn := index, size-1
+	r := LeafHash(record)
+	for _, p := range proof {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
@@ -0,0 +1,104 @@
+package merkle
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func records(n int) [][]byte {
+	rs := make([][]byte, n)
+	for i := range rs {
+		rs[i] = []byte(fmt.Sprintf("imp-%d", i))
+	}
+	return rs
+}
+
+// Vectors of the RFC 6962 reference implementation
+func TestRoot(t *testing.T) {
+	tests := []struct {
+		name    string
+		records [][]byte
+		want    string
+	}{
+		{name: "empty", want: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{name: "empty record", records: [][]byte{{}}, want: "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d"},
+		{
+			name:    "two records",
+			records: [][]byte{{}, {0x00}},
+			want:    hex.EncodeToString(nodeHash(LeafHash([]byte{}), LeafHash([]byte{0x00}))),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hex.EncodeToString(Root(tt.records)); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Three leaves split 2+1, the third is hashed with the root of the first two
+func TestRootIsUnbalanced(t *testing.T) {
+	rs := records(3)
+	want := nodeHash(nodeHash(LeafHash(rs[0]), LeafHash(rs[1])), LeafHash(rs[2]))
+	if got := Root(rs); hex.EncodeToString(got) != hex.EncodeToString(want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+}
+
+func TestProof(t *testing.T) {
+	for _, size := range []int{1, 2, 3, 4, 5, 7, 8, 9, 16, 17, 100} {
+		rs := records(size)
+		root := Root(rs)
+		for index := 0; index < size; index++ {
+			t.Run(fmt.Sprintf("%d of %d", index, size), func(t *testing.T) {
+				proof, err := Proof(rs, index)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !Verify(root, rs[index], index, size, proof) {
+					t.Fatal("proof does not verify")
+				}
+				if Verify(root, []byte("imp-x"), index, size, proof) {
+					t.Fatal("verified another record")
+				}
+				if size > 1 && Verify(root, rs[index], (index+1)%size, size, proof) {
+					t.Fatal("verified at another index")
+				}
+				if len(proof) > 0 {
+					if Verify(root, rs[index], index, size, proof[:len(proof)-1]) {
+						t.Fatal("verified a truncated proof")
+					}
+					tampered := append([][]byte(nil), proof...)
+					tampered[0] = LeafHash([]byte("imp-x"))
+					if Verify(root, rs[index], index, size, tampered) {
+						t.Fatal("verified a tampered proof")
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestProofOutOfRange(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		index int
+	}{
+		{name: "negative", size: 3, index: -1},
+		{name: "past the end", size: 3, index: 3},
+		{name: "no records", size: 0, index: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Proof(records(tt.size), tt.index); err == nil {
+				t.Fatal("no error")
+			}
+			if Verify(Root(records(tt.size)), []byte("imp-0"), tt.index, tt.size, nil) {
+				t.Fatal("verified out of range")
+			}
+		})
+	}
+}
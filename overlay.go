@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// overlayStub buffers the writes of chaincode functions over a stub. Reads
+// of single keys see the buffered writes, range and history queries only
+// see the underlying stub. Nothing it buffers reaches the stub until flush.
+type overlayStub struct {
+	shim.ChaincodeStubInterface
+	writes map[string][]byte // nil for a deleted key
+	order  []string          // keys in the order they were first written
+	events []BatchEvent
+}
+
+// BatchEvent is an event set by one operation of a batch
+type BatchEvent struct {
+	Name    string
+	Payload []byte
+}
+
+func newOverlayStub(stub shim.ChaincodeStubInterface) *overlayStub {
+	return &overlayStub{ChaincodeStubInterface: stub, writes: make(map[string][]byte)}
+}
+
+func (s *overlayStub) GetState(key string) ([]byte, error) {
+	if value, ok := s.writes[key]; ok {
+		return value, nil
+	}
+	return s.ChaincodeStubInterface.GetState(key)
+}
+
+func (s *overlayStub) PutState(key string, value []byte) error {
+	if _, ok := s.writes[key]; !ok {
+		s.order = append(s.order, key)
+	}
+	s.writes[key] = value
+	return nil
+}
+
+func (s *overlayStub) DelState(key string) error {
+	return s.PutState(key, nil)
+}
+
+func (s *overlayStub) SetEvent(name string, payload []byte) error {
+	s.events = append(s.events, BatchEvent{Name: name, Payload: payload})
+	return nil
+}
+
+// flush writes every buffered key once to the underlying stub. A transaction
+// carries a single event, so several events go out together as "batch".
+func (s *overlayStub) flush() error {
+	for _, key := range s.order {
+		var err error
+		if value := s.writes[key]; value == nil {
+			err = s.ChaincodeStubInterface.DelState(key)
+		} else {
+			err = s.ChaincodeStubInterface.PutState(key, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, nested := s.ChaincodeStubInterface.(*overlayStub); nested || len(s.events) == 1 {
+		for _, event := range s.events {
+			err := s.ChaincodeStubInterface.SetEvent(event.Name, event.Payload)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(s.events) == 0 {
+		return nil
+	}
+	events, _ := json.Marshal(s.events)
+	return s.ChaincodeStubInterface.SetEvent("batch", events)
+}
@@ -0,0 +1,249 @@
+// Package payload defines the documents parties sign (contracts, media logs
+// and settlement attestations) and their canonical, domain-separated encoding.
+// Clients import it to produce exactly the bytes the chaincode verifies.
+//
+// Every payload starts with a header that names what is being signed:
+//
+//	"hwxf-sig" | schema version | type tag | channel ID | chaincode name
+//
+// followed by the document fields in a fixed order. Strings are written as a
+// 4-byte big-endian length and their bytes, integers as 8 big-endian bytes
+// and lists as a 4-byte count followed by their items, so no two different
+// documents encode to the same bytes and a signature made for one type can
+// not be replayed as another.
+package payload
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"chaincodedev/chaincode/liqi/hwxf/logformat"
+	"chaincodedev/chaincode/liqi/hwxf/merkle"
+)
+
+const (
+	MAGIC   = "hwxf-sig"
+	VERSION = 11
+
+	TYPE_CONTRACT    = "contract"
+	TYPE_LOG         = "log"
+	TYPE_ATTESTATION = "attestation"
+	TYPE_COMMIT      = "commit"
+)
+
+// Domain identifies the chaincode instance a signature is made for
+type Domain struct {
+	ChannelID     string
+	ChaincodeName string
+}
+
+type Contract struct {
+	AdvertiserId           string
+	MediaId                string
+	AntiCheatIds           []string
+	PaymentThreshold       string
+	PaymentAmountMedia     string
+	PaymentAmountAntiCheat string
+	AntiCheatShareType     string
+	AntiCheatPriority      []string
+	TimeStamp              int64
+	Options                ContractOptions
+}
+
+// ContractOptions are the optional terms of a contract. Empty fields take
+// the chaincode defaults.
+type ContractOptions struct {
+	MissingJudgement   string // an anticheat has no judgement for a logged impression
+	ExtraJudgement     string // an anticheat judged an impression that is not in the media log
+	DuplicateJudgement string // an impression id appears more than once in a file
+	JudgementScale     string // how anticheat scores are read, a [-1,1] score or a fraud probability
+	AllAbstain         string // outcome of an impression no anticheat could judge
+	ActiveFrom         int64  // start of the traffic window the contract pays for, unix seconds, 0 for no bound
+	ActiveTo           int64  // end of the traffic window, unix seconds, 0 for no bound
+	CommitWindow       int64  // seconds after a chunk is submitted the anticheats have to commit their judgements
+	RevealWindow       int64  // seconds after the commit phase the anticheats have to reveal them
+	Aggregator         string // how the judgements of the anticheats decide an impression
+	TieBreak           string // outcome of an impression the aggregator can not decide
+	QuorumK            int    // votes a side needs with the quorum aggregator
+	HoldPeriod         int64  // seconds the advertiser's escrow is held before it can be taken back, within the governance bounds
+}
+
+// FileCommitment pins the content of an off-chain file at submission time
+type FileCommitment struct {
+	Address     string
+	Digest      string // hex encoded SHA-256 of the file bytes
+	Size        int64
+	RecordCount int
+	MerkleRoot  string // hex encoded merkle.Root of the canonical file records
+}
+
+// Log is one numbered chunk of the media log of a contract
+type Log struct {
+	FileCommitment
+	TimeStamp       int64
+	AntiCheatNum    int
+	ChunkIndex      int // from 0
+	ChunkCount      int
+	Revision        int   // 0 for the first submission of the chunk
+	PeriodStart     int64 // the log covers traffic in [PeriodStart, PeriodEnd), unix seconds
+	PeriodEnd       int64
+	ImpressionCount int
+	PlacementIds    []string
+}
+
+// Digest returns the hex encoded SHA-256 of data, as stored in FileCommitment.Digest
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Decode parses data, the file fetched from c.Address, and returns an error
+// unless it is the file c was committed for and every line could be read
+func (c FileCommitment) Decode(data []byte) (*logformat.File, error) {
+	if int64(len(data)) != c.Size {
+		return nil, fmt.Errorf("%s: size %d does not match committed size %d", c.Address, len(data), c.Size)
+	}
+	if digest := Digest(data); digest != c.Digest {
+		return nil, fmt.Errorf("%s: digest %s does not match committed digest %s", c.Address, digest, c.Digest)
+	}
+	file, err := logformat.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", c.Address, err)
+	}
+	if err := file.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", c.Address, err)
+	}
+	if len(file.Records) != c.RecordCount {
+		return nil, fmt.Errorf("%s: %d records, committed %d", c.Address, len(file.Records), c.RecordCount)
+	}
+	if root := hex.EncodeToString(merkle.Root(file.Canonical())); root != c.MerkleRoot {
+		return nil, fmt.Errorf("%s: merkle root %s does not match committed root %s", c.Address, root, c.MerkleRoot)
+	}
+	return file, nil
+}
+
+// VerifyRecord checks a merkle.Proof that record is the index-th record of the committed file
+func (c FileCommitment) VerifyRecord(record []byte, index int, proof [][]byte) error {
+	root, err := hex.DecodeString(c.MerkleRoot)
+	if err != nil {
+		return err
+	}
+	if !merkle.Verify(root, record, index, c.RecordCount, proof) {
+		return fmt.Errorf("%s: record %d is not included in merkle root %s", c.Address, index, c.MerkleRoot)
+	}
+	return nil
+}
+
+// Encoder writes the canonical form of a payload
+type Encoder struct {
+	buf bytes.Buffer
+}
+
+// NewEncoder starts a payload of type typeTag for domain d
+func NewEncoder(d Domain, typeTag string) *Encoder {
+	e := &Encoder{}
+	e.String(MAGIC)
+	e.Int(VERSION)
+	e.String(typeTag)
+	e.String(d.ChannelID)
+	e.String(d.ChaincodeName)
+	return e
+}
+
+func (e *Encoder) String(s string) *Encoder {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(s)))
+	e.buf.Write(n[:])
+	e.buf.WriteString(s)
+	return e
+}
+
+func (e *Encoder) Int(v int64) *Encoder {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(v))
+	e.buf.Write(n[:])
+	return e
+}
+
+func (e *Encoder) Strings(ss []string) *Encoder {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(ss)))
+	e.buf.Write(n[:])
+	for _, s := range ss {
+		e.String(s)
+	}
+	return e
+}
+
+func (e *Encoder) Bytes() []byte {
+	return e.buf.Bytes()
+}
+
+// Encode returns the bytes signed by every party of the contract
+func (c Contract) Encode(d Domain) []byte {
+	return NewEncoder(d, TYPE_CONTRACT).
+		String(c.AdvertiserId).
+		String(c.MediaId).
+		Strings(c.AntiCheatIds).
+		String(c.PaymentThreshold).
+		String(c.PaymentAmountMedia).
+		String(c.PaymentAmountAntiCheat).
+		String(c.AntiCheatShareType).
+		Strings(c.AntiCheatPriority).
+		Int(c.TimeStamp).
+		String(c.Options.MissingJudgement).
+		String(c.Options.ExtraJudgement).
+		String(c.Options.DuplicateJudgement).
+		String(c.Options.JudgementScale).
+		String(c.Options.AllAbstain).
+		Int(c.Options.ActiveFrom).
+		Int(c.Options.ActiveTo).
+		Int(c.Options.CommitWindow).
+		Int(c.Options.RevealWindow).
+		String(c.Options.Aggregator).
+		String(c.Options.TieBreak).
+		Int(int64(c.Options.QuorumK)).
+		Int(c.Options.HoldPeriod).
+		Bytes()
+}
+
+// Encode returns the bytes signed by the media and the anticheats for a log
+func (l Log) Encode(d Domain) []byte {
+	return NewEncoder(d, TYPE_LOG).
+		String(l.Address).
+		String(l.Digest).
+		Int(l.Size).
+		Int(int64(l.RecordCount)).
+		String(l.MerkleRoot).
+		Int(l.TimeStamp).
+		Int(int64(l.AntiCheatNum)).
+		Int(int64(l.ChunkIndex)).
+		Int(int64(l.ChunkCount)).
+		Int(int64(l.Revision)).
+		Int(l.PeriodStart).
+		Int(l.PeriodEnd).
+		Int(int64(l.ImpressionCount)).
+		Strings(l.PlacementIds).
+		Bytes()
+}
+
+// JudgementCommit returns the hex hash an anticheat commits to before it
+// reveals result, the commitment of its result file for revision of log
+// logId. The anticheat id is part of the hash, so another anticheat can not
+// commit to the same hash and reveal a copy of the result.
+func JudgementCommit(d Domain, logId string, revision int, antiCheatId string, result FileCommitment, salt string) string {
+	return Digest(NewEncoder(d, TYPE_COMMIT).
+		String(logId).
+		Int(int64(revision)).
+		String(antiCheatId).
+		String(result.Address).
+		String(result.Digest).
+		Int(result.Size).
+		Int(int64(result.RecordCount)).
+		String(result.MerkleRoot).
+		String(salt).
+		Bytes())
+}
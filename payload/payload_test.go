@@ -0,0 +1,158 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"chaincodedev/chaincode/liqi/hwxf/logformat"
+	"chaincodedev/chaincode/liqi/hwxf/merkle"
+)
+
+var domain = Domain{ChannelID: "mychannel", ChaincodeName: "hwxf"}
+
+func TestEncoder(t *testing.T) {
+	tests := []struct {
+		name string
+		got  []byte
+		want string // hex
+	}{
+		{name: "empty string", got: (&Encoder{}).String("").Bytes(), want: "00000000"},
+		{name: "string", got: (&Encoder{}).String("ab").Bytes(), want: "000000026162"},
+		{name: "int", got: (&Encoder{}).Int(258).Bytes(), want: "0000000000000102"},
+		{name: "negative int", got: (&Encoder{}).Int(-1).Bytes(), want: "ffffffffffffffff"},
+		{name: "strings", got: (&Encoder{}).Strings([]string{"a", ""}).Bytes(), want: "00000002" + "0000000161" + "00000000"},
+		{name: "nil strings", got: (&Encoder{}).Strings(nil).Bytes(), want: "00000000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hex.EncodeToString(tt.got); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeader(t *testing.T) {
+	got := NewEncoder(domain, TYPE_LOG).Bytes()
+	want := (&Encoder{}).String(MAGIC).Int(VERSION).String(TYPE_LOG).String("mychannel").String("hwxf").Bytes()
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+}
+
+// Every field of a payload, and the domain and type it is signed for, changes its bytes
+func TestEncodingsAreDistinct(t *testing.T) {
+	contract := Contract{
+		AdvertiserId:           "adv",
+		MediaId:                "media",
+		AntiCheatIds:           []string{"ac1", "ac2"},
+		PaymentThreshold:       "0.8",
+		PaymentAmountMedia:     "100",
+		PaymentAmountAntiCheat: "10",
+		AntiCheatShareType:     "average",
+		AntiCheatPriority:      []string{"ac1", "ac2"},
+		TimeStamp:              1500000000,
+	}
+	log := Log{
+		FileCommitment: FileCommitment{Address: "ipfs://x", Digest: "00", Size: 10, RecordCount: 2, MerkleRoot: "11"},
+		TimeStamp:      1500000000,
+		AntiCheatNum:   2,
+		ChunkCount:     1,
+	}
+	result := FileCommitment{Address: "ipfs://y", Digest: "22", Size: 5, RecordCount: 2, MerkleRoot: "33"}
+	joined := contract
+	joined.AntiCheatIds = []string{"ac1ac2"}
+	shifted := contract
+	shifted.AdvertiserId, shifted.MediaId = "advm", "edia"
+	options := contract
+	options.Options.QuorumK = 1
+	revised := log
+	revised.Revision = 1
+	other := Domain{ChannelID: "other", ChaincodeName: "hwxf"}
+
+	tests := []struct {
+		name string
+		a, b []byte
+	}{
+		{name: "anticheat ids are not concatenated", a: contract.Encode(domain), b: joined.Encode(domain)},
+		{name: "strings are length prefixed", a: contract.Encode(domain), b: shifted.Encode(domain)},
+		{name: "options are signed", a: contract.Encode(domain), b: options.Encode(domain)},
+		{name: "revision is signed", a: log.Encode(domain), b: revised.Encode(domain)},
+		{name: "channel is signed", a: log.Encode(domain), b: log.Encode(other)},
+		{name: "type is signed", a: NewEncoder(domain, TYPE_LOG).Bytes(), b: NewEncoder(domain, TYPE_CONTRACT).Bytes()},
+		{
+			name: "commit binds the anticheat",
+			a:    []byte(JudgementCommit(domain, "c_0", 0, "ac1", result, "salt")),
+			b:    []byte(JudgementCommit(domain, "c_0", 0, "ac2", result, "salt")),
+		},
+		{
+			name: "commit binds the revision",
+			a:    []byte(JudgementCommit(domain, "c_0", 0, "ac1", result, "salt")),
+			b:    []byte(JudgementCommit(domain, "c_0", 1, "ac1", result, "salt")),
+		},
+		{
+			name: "commit binds the salt",
+			a:    []byte(JudgementCommit(domain, "c_0", 0, "ac1", result, "salt")),
+			b:    []byte(JudgementCommit(domain, "c_0", 0, "ac1", result, "pepper")),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if bytes.Equal(tt.a, tt.b) {
+				t.Fatalf("both encode to %x", tt.a)
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	data := []byte("#hwxf v2 tsv\nimp-1\nimp-2\n")
+	file, err := logformat.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed := FileCommitment{
+		Address:     "ipfs://x",
+		Digest:      Digest(data),
+		Size:        int64(len(data)),
+		RecordCount: 2,
+		MerkleRoot:  hex.EncodeToString(merkle.Root(file.Canonical())),
+	}
+	tests := []struct {
+		name    string
+		change  func(c *FileCommitment)
+		wantErr string
+	}{
+		{name: "committed", change: func(c *FileCommitment) {}},
+		{name: "size", change: func(c *FileCommitment) { c.Size++ }, wantErr: "committed size"},
+		{name: "digest", change: func(c *FileCommitment) { c.Digest = Digest(nil) }, wantErr: "committed digest"},
+		{name: "record count", change: func(c *FileCommitment) { c.RecordCount = 3 }, wantErr: "committed 3"},
+		{name: "merkle root", change: func(c *FileCommitment) { c.MerkleRoot = Digest(nil) }, wantErr: "committed root"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := committed
+			tt.change(&c)
+			_, err := c.Decode(data)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	proof, err := merkle.Proof(file.Canonical(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := committed.VerifyRecord(file.Canonical()[1], 1, proof); err != nil {
+		t.Fatal(err)
+	}
+	if err := committed.VerifyRecord(file.Canonical()[0], 1, proof); err == nil {
+		t.Fatal("verified record 0 as record 1")
+	}
+}
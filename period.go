@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const PERIOD_INDEX = "period"
+
+// ReportingPeriod is the traffic window [Start, End) a media log covers, in unix seconds
+type ReportingPeriod struct {
+	Start int64
+	End   int64
+}
+
+func (p ReportingPeriod) overlaps(o ReportingPeriod) bool {
+	return p.Start < o.End && o.Start < p.End
+}
+
+// getTxTime returns the transaction timestamp in unix seconds, the same on every endorser
+func getTxTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return ts.Seconds, nil
+}
+
+// parseLogMetadata reads the period start and end, impression count and comma separated placement ids of a log
+func parseLogMetadata(log *Log, start string, end string, impressionCount string, placementIds string) error {
+	var err error
+	log.PeriodStart, err = strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return fmt.Errorf("period start format error: %s", start)
+	}
+	log.PeriodEnd, err = strconv.ParseInt(end, 10, 64)
+	if err != nil {
+		return fmt.Errorf("period end format error: %s", end)
+	}
+	log.ImpressionCount, err = strconv.Atoi(impressionCount)
+	if err != nil || log.ImpressionCount < 0 {
+		return fmt.Errorf("impression count format error: %s", impressionCount)
+	}
+	if placementIds == "" {
+		return fmt.Errorf("Incorrect arguments. Expecting at least one placement id")
+	}
+	log.PlacementIds = strings.Split(placementIds, ",")
+	seen := make(map[string]bool, len(log.PlacementIds))
+	for _, placementId := range log.PlacementIds {
+		if placementId == "" || seen[placementId] {
+			return fmt.Errorf("placement ids format error: %s", placementIds)
+		}
+		seen[placementId] = true
+	}
+	return nil
+}
+
+// checkReportingPeriod rejects a log chunk whose period is empty, not over yet,
+// outside the active window of the contract, or overlapping a period the
+// media already reported for one of the placements, under another contract or
+// another chunk of this one. Only the revision it replaces is left out.
+func checkReportingPeriod(stub shim.ChaincodeStubInterface, contractId string, contract Contract, log Log) error {
+	period := ReportingPeriod{Start: log.PeriodStart, End: log.PeriodEnd}
+	if period.End <= period.Start {
+		return fmt.Errorf("period end %d is not after period start %d", period.End, period.Start)
+	}
+	if period.End > log.TimeStamp {
+		return fmt.Errorf("period end %d is in the future", period.End)
+	}
+	if contract.Options.ActiveFrom != 0 && period.Start < contract.Options.ActiveFrom {
+		return fmt.Errorf("period start %d is before the contract is active from %d", period.Start, contract.Options.ActiveFrom)
+	}
+	if contract.Options.ActiveTo != 0 && period.End > contract.Options.ActiveTo {
+		return fmt.Errorf("period end %d is after the contract is active to %d", period.End, contract.Options.ActiveTo)
+	}
+	if log.ImpressionCount > log.RecordCount {
+		return fmt.Errorf("impression count %d is more than the %d log records", log.ImpressionCount, log.RecordCount)
+	}
+
+	for _, placementId := range log.PlacementIds {
+		it, err := stub.GetStateByPartialCompositeKey(PERIOD_INDEX, []string{contract.MediaId, placementId})
+		if err != nil {
+			return err
+		}
+		for it.HasNext() {
+			kv, err := it.Next()
+			if err != nil {
+				it.Close()
+				return err
+			}
+			_, keys, err := stub.SplitCompositeKey(kv.Key)
+			if err != nil {
+				it.Close()
+				return err
+			}
+			if keys[2] == contractId && keys[3] == strconv.Itoa(log.ChunkIndex) {
+				continue
+			}
+			var other ReportingPeriod
+			if err := json.Unmarshal(kv.Value, &other); err != nil {
+				it.Close()
+				return err
+			}
+			if period.overlaps(other) {
+				it.Close()
+				return fmt.Errorf("period [%d, %d) of placement %s overlaps [%d, %d) reported for contract %s chunk %s", period.Start, period.End, placementId, other.Start, other.End, keys[2], keys[3])
+			}
+		}
+		it.Close()
+	}
+	return nil
+}
+
+// indexReportingPeriod records the period of a log chunk under media, placement, contract and chunk,
+// replacing the period of the chunk submitted before, if any
+func indexReportingPeriod(stub shim.ChaincodeStubInterface, contractId string, contract Contract, previous *Log, log Log) error {
+	if previous != nil {
+		for _, placementId := range previous.PlacementIds {
+			key, err := stub.CreateCompositeKey(PERIOD_INDEX, []string{contract.MediaId, placementId, contractId, strconv.Itoa(previous.ChunkIndex)})
+			if err != nil {
+				return err
+			}
+			err = stub.DelState(key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	period, _ := json.Marshal(ReportingPeriod{Start: log.PeriodStart, End: log.PeriodEnd})
+	for _, placementId := range log.PlacementIds {
+		key, err := stub.CreateCompositeKey(PERIOD_INDEX, []string{contract.MediaId, placementId, contractId, strconv.Itoa(log.ChunkIndex)})
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(key, period)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
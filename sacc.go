@@ -1,20 +1,18 @@
 package main
 
 import (
-	"bytes"
+	"chaincodedev/chaincode/liqi/hwxf/payload"
+	"chaincodedev/chaincode/liqi/hwxf/settlement"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/protos/peer"
-	//"os/exec"
-    "net/http"
-    "io/ioutil"
+	"math"
 	"strconv"
 	"strings"
-	"time"
-	"utils/DSA"
 )
 
 const (
@@ -32,42 +30,86 @@ type Account struct {
 	Credit    string
 	Assets    string
 	PublicKey string
+	Algorithm string
 }
 
-type Contract struct {
-	AdvertiserId           string
-	MediaId                string
-	AntiCheatIds           []string
-	PaymentThreshold       string
-	PaymentAmountMedia     string
-	PaymentAmountAntiCheat string
-	AntiCheatShareType     string
-	AntiCheatPriority      []string
-	TimeStamp              int64
-}
+// Contract and Log are signed documents, their canonical encoding lives in package payload
+type Contract = payload.Contract
 
+// ContractSignature collects the signatures of the parties, and the
+// approvals of the parties bound to their X.509 identity
 type ContractSignature struct {
 	Signature map[string][]byte
+	Approvals map[string]Approval
+}
+
+// add records what acceptSignature returned for id
+func (cs *ContractSignature) add(id string, sig []byte, approval *Approval) {
+	if approval != nil {
+		if cs.Approvals == nil {
+			cs.Approvals = make(map[string]Approval)
+		}
+		cs.Approvals[id] = *approval
+		return
+	}
+	if cs.Signature == nil {
+		cs.Signature = make(map[string][]byte)
+	}
+	cs.Signature[id] = sig
+}
+
+// count returns how many parties signed or approved
+func (cs ContractSignature) count() int {
+	return len(cs.Signature) + len(cs.Approvals)
 }
 
 type SignatureContract struct {
 	Contract          Contract
 	ContractSignature ContractSignature
+	State             string // lifecycle state, see contractState
 }
 
-type Log struct {
-	Address                string
-	TimeStamp              int64
-	AntiCheatNum           int
-}
+type Log = payload.Log
+
+type FileCommitment = payload.FileCommitment
+
+type ContractOptions = payload.ContractOptions
 
 type MediaLogSubmit struct {
 	Log               Log
 	ContractSignature ContractSignature
 	AntiCheatResultAddress map[string]string
+	AntiCheatResultCommitment map[string]FileCommitment
+	Revisions         []LogRevision
+	JudgementCommits  map[string]JudgementCommit
+	RevealFrom        int64 // set when every anticheat committed before the commit window is over
+	Judged            bool
+	Defaulted         []string // anticheats without a revealed judgement once the chunk was judged
+	Credits           map[string]float64 // anticheat credits when the chunk was judged, for the credit aggregator
+}
+
+// LogRevision is a chunk submission replaced by reviseLog, with the media signature or approval it had
+type LogRevision struct {
+	Log       Log
+	Signature []byte
+	Approval  *Approval `json:",omitempty"`
+	Reason    string
+	TxId      string
+	TimeStamp int64
+}
+
+type LogRevisedEvent struct {
+	LogId        string
+	Revision     int
+	Reason       string
+	AntiCheatIds []string
 }
 
 func (t *SimpleAsset) Init(stub shim.ChaincodeStubInterface) peer.Response {
+	err := initGovernance(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	return shim.Success(nil)
 }
 
@@ -84,20 +126,62 @@ func (t *SimpleAsset) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
 		result, err = generatorContract(stub, args)
 	} else if fn == "mediaSubmit" {
 		err = mediaSubmit(stub, args)
+	} else if fn == "reviseLog" {
+		err = reviseLog(stub, args)
 	} else if fn == "getContract" {
 		result, err = getContract(stub, args[0])
 	} else if fn == "getContractList" {
 		result, err = getContractList(stub, args)
 	} else if fn == "getLogList" {
 		result, err = getLogList(stub, args)
+	} else if fn == "verifyRecordInclusion" {
+		result, err = verifyRecordInclusion(stub, args)
 	} else if fn == "mediaAntiConfirm" {
 		err = mediaAntiConfirm(stub, args)
+	} else if fn == "anticheatCommit" {
+		err = anticheatCommit(stub, args)
 	} else if fn == "anticheatConfirm" {
 		err = anticheatConfirm(stub, args)
+	} else if fn == "closeReveal" {
+		err = closeReveal(stub, args)
 	} else if fn == "settleAccount" {
-		err = settleAccount(stub, args)
+		result, err = settleAccount(stub, args)
+	} else if fn == "submitAttestation" {
+		result, err = submitAttestation(stub, args)
+	} else if fn == "getAttestationList" {
+		result, err = getAttestationList(stub, args)
+	} else if fn == "setGovernance" {
+		err = setGovernance(stub, args)
+	} else if fn == "getGovernance" {
+		result, err = getGovernance(stub, args)
+	} else if fn == "getSettlement" {
+		result, err = getSettlement(stub, args)
+	} else if fn == "openDispute" {
+		err = openDispute(stub, args)
+	} else if fn == "decideDispute" {
+		result, err = decideDispute(stub, args)
+	} else if fn == "releaseSettlement" {
+		result, err = releaseSettlement(stub, args)
+	} else if fn == "getDispute" {
+		result, err = getDispute(stub, args)
+	} else if fn == "simulateSettlement" {
+		result, err = simulateSettlement(stub, args)
+	} else if fn == "getFraudBreakdown" {
+		result, err = getFraudBreakdown(stub, args)
+	} else if fn == "getChunkProgress" {
+		result, err = getChunkProgressQuery(stub, args)
+	} else if fn == "getReconcileReport" {
+		result, err = getReconcileReport(stub, args)
 	} else if fn == "getAllConfirmContractKey" {
 		result, err = getAllConfirmContractKey(stub, args)
+	} else if fn == "getBalance" {
+		result, err = getBalance(stub, args)
+	} else if fn == "getStatement" {
+		result, err = getStatement(stub, args)
+	} else if fn == "batch" {
+		result, err = batch(stub, args)
+	} else if fn == "agreeEarlyRelease" {
+		err = agreeEarlyRelease(stub, args)
 	} else if fn == "advertiserChargeGet" {
 		err = advertiserChargeGet(stub, args)
 	}
@@ -113,43 +197,71 @@ func (t *SimpleAsset) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
 * 0: Type
 * 1: Credit
 * 2: Assets
-* 3: PublicKey
+* 3: PublicKey, ignored for X509, the creator certificate is bound instead
+* 4: Algorithm, optional, ECDSA-P256 by default
  */
 func setAccount(stub shim.ChaincodeStubInterface, args []string) (string, error) {
 
-	if len(args) != 4 {
-		return "", fmt.Errorf("Incorrect number of arguments. Expecting 4")
+	if len(args) != 4 && len(args) != 5 {
+		return "", fmt.Errorf("Incorrect number of arguments. Expecting 4 or 5")
+	}
+	algorithm := ALGORITHM_ECDSA_P256
+	if len(args) == 5 {
+		algorithm = args[4]
+	}
+	if err := checkAlgorithm(algorithm); err != nil {
+		return "", err
 	}
 
 	id, err := cid.GetID(stub)
 	if err != nil {
 		return "", fmt.Errorf(fmt.Sprintf("Could not Get ID, err %s", err))
 	}
+	if algorithm == ALGORITHM_X509 {
+		args[3], err = getCreatorCertificate(stub)
+		if err != nil {
+			return "", err
+		}
+	}
 	fmt.Printf("Id:\n%s\n", id)
 	fmt.Printf("Type:\n%s\n", args[0])
 	fmt.Printf("Credit:\n%s\n", args[1])
 	fmt.Printf("Assets:\n%s\n", args[2])
 	fmt.Printf("PublicKey:\n%s\n", args[3])
+	fmt.Printf("Algorithm:\n%s\n", algorithm)
 
-	var account = Account{Type: args[0], Credit: args[1], Assets: args[2], PublicKey: args[3]}
+	var account = Account{Type: args[0], Credit: args[1], Assets: args[2], PublicKey: args[3], Algorithm: algorithm}
 
-	accountAsBytes, _ := json.Marshal(account)
-	stub.PutState(id, accountAsBytes)
-
-	return id, nil
-}
-
-func getAccountPublicKey(stub shim.ChaincodeStubInterface, id string) (string, error) {
-	accountAsBytes, err := stub.GetState(id)
+	//the ledger balance follows the declared assets
+	assets, err := parseAmount(args[2])
 	if err != nil {
 		return "", err
 	}
-	var account Account
-	err = json.Unmarshal(accountAsBytes, &account)
+	j, err := newJournal(stub)
+	if err != nil {
+		return "", err
+	}
+	balance, err := j.balance(id)
+	if err != nil {
+		return "", err
+	}
+	if assets > balance {
+		err = j.transfer(LEDGER_ISSUANCE, id, assets-balance, "", REASON_DEPOSIT)
+	} else {
+		err = j.transfer(id, LEDGER_ISSUANCE, balance-assets, "", REASON_WITHDRAWAL)
+	}
+	if err != nil {
+		return "", err
+	}
+	err = j.commit()
 	if err != nil {
 		return "", err
 	}
-	return account.PublicKey, nil
+
+	accountAsBytes, _ := json.Marshal(account)
+	stub.PutState(id, accountAsBytes)
+
+	return id, nil
 }
 
 func initContract(args []string, timeStamp int64, advertiserId string) Contract {
@@ -167,102 +279,201 @@ func initContract(args []string, timeStamp int64, advertiserId string) Contract
 	return contract
 }
 
+// freezeTime reads when the escrow of a contract can be taken back from contractId+"_freeze"
+func freezeTime(stub shim.ChaincodeStubInterface, contractId string) (int64, error) {
+	timePaymentByte, err := stub.GetState(contractId + "_freeze")
+	if err != nil {
+		return 0, err
+	}
+
+	timePayment := strings.Split(string(timePaymentByte), "_")
+	if len(timePayment) != 2 {
+		return 0, fmt.Errorf("timePayment format error: %s", string(timePaymentByte))
+	}
+
+	timeStamp, err := strconv.ParseInt(timePayment[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("timePayment format error: %s", string(timePaymentByte))
+	}
+	return timeStamp, nil
+}
+
 /*
+* the advertiser and the media both call it to let the advertiser take the
+* escrow back before its hold period is over
 * 0: contractKey
-* 1: true代表不判断时间直接返回广告主钱
  */
-func advertiserChargeGet(stub shim.ChaincodeStubInterface, args []string) error {
-	if len(args) < 1 {
-		return fmt.Errorf("Incorrect arguments. Expecting less 1 value")
+func agreeEarlyRelease(stub shim.ChaincodeStubInterface, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Incorrect arguments. Expecting 1 value")
 	}
-
-	timePaymentByte, err := stub.GetState(args[0] + "_freeze")
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return fmt.Errorf("could not get ID: %w", err)
+	}
+	sc, err := getSignatureContract(stub, args[0])
+	if err != nil {
+		return err
+	}
+	if id != sc.Contract.AdvertiserId && id != sc.Contract.MediaId {
+		return fmt.Errorf("only the advertiser and the media can agree to an early release")
+	}
+	err = checkContractState(args[0], sc, STATE_PROPOSED, STATE_ACTIVE)
+	if err != nil {
+		return err
+	}
+	agreed, err := getEarlyRelease(stub, args[0])
 	if err != nil {
 		return err
 	}
+	if contains(agreed, id) {
+		return nil
+	}
+	agreedJson, _ := json.Marshal(append(agreed, id))
+	return stub.PutState(args[0]+"_early_release", agreedJson)
+}
 
-	timePayment := strings.Split(string(timePaymentByte), "_")
-	if len(timePayment) != 2 {
-		return fmt.Errorf("timePayment format error: %s", string(timePaymentByte))
+func getEarlyRelease(stub shim.ChaincodeStubInterface, contractId string) ([]string, error) {
+	var agreed []string
+	agreedAsBytes, err := stub.GetState(contractId + "_early_release")
+	if err != nil || agreedAsBytes == nil {
+		return agreed, err
 	}
+	err = json.Unmarshal(agreedAsBytes, &agreed)
+	return agreed, err
+}
 
-	timeStamp, err1 := strconv.Atoi(timePayment[0])
-	payment, err2 := strconv.ParseFloat(timePayment[1], 64)
-	if err1 != nil || err2 != nil {
-		return fmt.Errorf("timePayment format error: %s", string(timePaymentByte))
+/*
+* the advertiser takes the escrow of a contract back once its hold period is
+* over, or before if the advertiser and the media agreed to an early release
+* 0: contractKey
+ */
+func advertiserChargeGet(stub shim.ChaincodeStubInterface, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Incorrect arguments. Expecting 1 value")
 	}
 
-	if len(args) < 2 || args[1] != "true" {
-		if timeStamp > int(time.Now().Unix()) {
-			return fmt.Errorf("time is not up for your money: %d", timeStamp)
-		}
+	timeStamp, err := freezeTime(stub, args[0])
+	if err != nil {
+		return err
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return err
 	}
 
 	id, err := cid.GetID(stub)
 	if err != nil {
 		return fmt.Errorf(fmt.Sprintf("Could not Get ID, err %s", err))
 	}
-
-	ac, err := stub.GetState(id)
+	sc, err := getSignatureContract(stub, args[0])
 	if err != nil {
 		return err
 	}
-
-	var account Account
-	err = json.Unmarshal(ac, &account)
+	if sc.Contract.AdvertiserId != id {
+		return fmt.Errorf("only the advertiser of the contract can take its money back")
+	}
+	//once a chunk is settled the escrow belongs to the settlement
+	err = checkContractState(args[0], sc, STATE_PROPOSED, STATE_ACTIVE)
 	if err != nil {
 		return err
 	}
+	if timeStamp > now {
+		agreed, err := getEarlyRelease(stub, args[0])
+		if err != nil {
+			return err
+		}
+		if !contains(agreed, sc.Contract.AdvertiserId) || !contains(agreed, sc.Contract.MediaId) {
+			return fmt.Errorf("time is not up for your money: %d", timeStamp)
+		}
+	}
 
-	assets, err := strconv.ParseFloat(account.Assets, 64)
+	j, err := newJournal(stub)
+	if err != nil {
+		return err
+	}
+	err = refundEscrows(args[0], id, j)
+	if err != nil {
+		return err
+	}
+	err = j.commit()
+	if err != nil {
+		return err
+	}
+	err = putContractState(stub, args[0], sc, STATE_REFUNDED)
 	if err != nil {
-		return fmt.Errorf("acouont.Assets format error1: %s", string(account.Assets))
+		return err
 	}
-	account.Assets = strconv.FormatFloat(assets+payment, 'E', -1, 64)
+	stub.PutState(args[0]+"_freeze", []byte(fmt.Sprintf("%d_%s", timeStamp, formatAmount(0))))
+	return nil
+}
 
-	accountAsBytes, _ := json.Marshal(account)
-	stub.PutState(id, accountAsBytes)
-    stub.PutState(args[0] + "_freeze", []byte(fmt.Sprintf("%d_%f", timeStamp+86400*7, 0.0)))
+// refundEscrows moves what is left in the escrows of a contract back to its advertiser
+func refundEscrows(contractId string, advertiserId string, j *Journal) error {
+	for _, purpose := range []string{ESCROW_MEDIA, ESCROW_ANTICHEAT, ESCROW_FEE} {
+		escrow := escrowAccount(contractId, purpose)
+		balance, err := j.balance(escrow)
+		if err != nil {
+			return err
+		}
+		err = j.transfer(escrow, advertiserId, balance, contractId, REASON_ESCROW_REFUND)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 /*
-* 0: advertiser id
-* 1: payment
-* 2: contractKey
+* moves the media and anticheat payments and the platform fee of a contract
+* from the advertiser into escrow, held for the hold period of the contract
  */
-func advertiserCharge(stub shim.ChaincodeStubInterface, advertiserId string, paymentStr string, contractKey string) error {
-	payment, err := strconv.ParseFloat(paymentStr, 64)
+func advertiserCharge(stub shim.ChaincodeStubInterface, advertiserId string, contract Contract, contractKey string, governance Governance) error {
+	holdPeriod, err := governance.holdPeriod(contract.Options)
 	if err != nil {
-		return fmt.Errorf("payment format error1: %s", string(paymentStr))
+		return err
 	}
-
-	ac, err := stub.GetState(advertiserId)
+	media, err := parseAmount(contract.PaymentAmountMedia)
 	if err != nil {
 		return err
 	}
-
-	var account Account
-	err = json.Unmarshal(ac, &account)
+	antiCheat, err := parseAmount(contract.PaymentAmountAntiCheat)
 	if err != nil {
 		return err
 	}
-
-	assets, err := strconv.ParseFloat(account.Assets, 64)
+	fee, err := governance.Fee.charge(media + antiCheat)
 	if err != nil {
-		return fmt.Errorf("acouont.Assets format error2: %s", string(account.Assets))
+		return err
 	}
-
-	if assets < payment {
+	j, err := newJournal(stub)
+	if err != nil {
+		return err
+	}
+	assets, err := j.balance(advertiserId)
+	if err != nil {
+		return err
+	}
+	if assets < media+antiCheat+fee {
 		return fmt.Errorf("advertiser has not enough Assets")
 	}
-	account.Assets = strconv.FormatFloat(assets-payment, 'E', -1, 64)
-
-	accountAsBytes, _ := json.Marshal(account)
-	stub.PutState(advertiserId, accountAsBytes)
+	err = j.transfer(advertiserId, escrowAccount(contractKey, ESCROW_MEDIA), media, contractKey, REASON_ESCROW)
+	if err != nil {
+		return err
+	}
+	err = j.transfer(advertiserId, escrowAccount(contractKey, ESCROW_ANTICHEAT), antiCheat, contractKey, REASON_ESCROW)
+	if err != nil {
+		return err
+	}
+	err = j.transfer(advertiserId, escrowAccount(contractKey, ESCROW_FEE), fee, contractKey, REASON_ESCROW)
+	if err != nil {
+		return err
+	}
+	err = j.commit()
+	if err != nil {
+		return err
+	}
 
-	timeStamp := time.Now().Unix()
-	stub.PutState(contractKey+"_freeze", []byte(fmt.Sprintf("%d_%f", timeStamp+86400*7, payment)))
+	stub.PutState(contractKey+"_freeze", []byte(fmt.Sprintf("%d_%s", contract.TimeStamp+holdPeriod, formatAmount(media+antiCheat))))
 	return nil
 }
 
@@ -274,36 +485,61 @@ func advertiserCharge(stub shim.ChaincodeStubInterface, advertiserId string, pay
 * 4: Payment_Amount_AntiCheat
 * 5: AntiCheat_Share_Type
 * 6: AntiCheat_Priority
-* 7: PrivateKey
+* 7: TimeStamp of the contract, unix seconds, within SIGNATURE_TIME_SKEW of the transaction
+* 8: Signature of the contract payload, hex, empty for X509 accounts
+* 9: Options, optional JSON of ContractOptions
  */
 func generatorContract(stub shim.ChaincodeStubInterface, args []string) (string, error) {
-	if len(args) != 8 {
-		return "", fmt.Errorf("Incorrect arguments. Expecting 8 value")
+	if len(args) != 9 && len(args) != 10 {
+		return "", fmt.Errorf("Incorrect arguments. Expecting 9 or 10 value")
+	}
+	var optionsJson string
+	if len(args) == 10 {
+		optionsJson = args[9]
+	}
+	options, err := settlement.ParseContractOptions(optionsJson)
+	if err != nil {
+		return "", err
 	}
 	id, err := cid.GetID(stub)
 	if err != nil {
 		return "", fmt.Errorf(fmt.Sprintf("Could not Get ID, err %s", err))
 	}
-	timeStamp := time.Now().Unix()
+	timeStamp, err := parseSignedTime(stub, args[7])
+	if err != nil {
+		return "", err
+	}
 	key := fmt.Sprintf("%s_%s_%s_%d", id, args[0], args[1], timeStamp)
 
 	contract := initContract(args[:7], timeStamp, id)
+	contract.Options = options
+	err = settlement.CheckOptions(contract)
+	if err != nil {
+		return "", err
+	}
+	governance, err := getGovernanceInfo(stub)
+	if err != nil {
+		return "", err
+	}
 	var signatureContract SignatureContract
 	signatureContract.Contract = contract
-	contractJson, _ := json.Marshal(contract)
-	signature, err := DSA.Sign(string(contractJson), args[7])
+	signatureContract.State = STATE_PROPOSED
+	contractPayload, err := getContractPayload(stub, contract)
+	if err != nil {
+		return "", err
+	}
+	signature, approval, err := acceptSignature(stub, id, contractPayload, args[8])
 	if err != nil {
 		return "", err
 	}
 
 	// 冻结合约金额
-	err = advertiserCharge(stub, id, args[3], key)
+	err = advertiserCharge(stub, id, contract, key, governance)
 	if err != nil {
 		return "", err
 	}
 	var contractSignature ContractSignature
-	contractSignature.Signature = make(map[string][]byte, 0)
-	contractSignature.Signature[id] = signature
+	contractSignature.add(id, signature, approval)
 	signatureContract.ContractSignature = contractSignature
 	signatureContractJson, _ := json.Marshal(signatureContract)
 	stub.PutState(key, []byte(signatureContractJson))
@@ -333,7 +569,7 @@ func getAllConfirmContractKey(stub shim.ChaincodeStubInterface, args []string) (
 }
 
 /*
-* 0: privateKey path
+* 0: signature of the contract payload, hex, empty for X509 accounts
 * 1: contractKey
  */
 func mediaAntiConfirm(stub shim.ChaincodeStubInterface, args []string) error {
@@ -346,37 +582,41 @@ func mediaAntiConfirm(stub shim.ChaincodeStubInterface, args []string) error {
 		return fmt.Errorf(fmt.Sprintf("Could not Get ID, err %s", err))
 	}
 
-	sc, err := stub.GetState(args[1])
-	var signatureContract SignatureContract
-	err = json.Unmarshal(sc, &signatureContract)
+	signatureContract, err := getSignatureContract(stub, args[1])
+	if err != nil {
+		return err
+	}
+	//the advertiser signed when it proposed the contract
+	if id != signatureContract.Contract.MediaId && !contains(signatureContract.Contract.AntiCheatIds, id) {
+		return fmt.Errorf("%s is not the media or an anticheat of contract %s", id, args[1])
+	}
+	err = checkContractState(args[1], signatureContract, STATE_PROPOSED)
 	if err != nil {
 		return err
 	}
 
-	for k, v := range signatureContract.ContractSignature.Signature {
-		publicKey, err := getAccountPublicKey(stub, k)
-		if err != nil {
-			return err
-		}
-
-		contractJson, _ := json.Marshal(signatureContract.Contract)
-		valid, err := DSA.Verify(string(contractJson), v, publicKey)
-		if !valid {
-			return fmt.Errorf(fmt.Sprintf("verify id %s failed", k))
-		}
+	contractPayload, err := getContractPayload(stub, signatureContract.Contract)
+	if err != nil {
+		return err
+	}
+	err = verifyAllSignatures(stub, contractPayload, signatureContract.ContractSignature)
+	if err != nil {
+		return err
 	}
 
-	contractJson, _ := json.Marshal(signatureContract.Contract)
-	signature, err := DSA.Sign(string(contractJson), args[0])
+	signature, approval, err := acceptSignature(stub, id, contractPayload, args[0])
 	if err != nil {
 		return err
 	}
 
-	signatureContract.ContractSignature.Signature[id] = signature
+	signatureContract.ContractSignature.add(id, signature, approval)
+	if signatureContract.ContractSignature.count() == len(signatureContract.Contract.AntiCheatIds)+2 {
+		signatureContract.State = STATE_ACTIVE
+	}
 	signatureContractJson, _ := json.Marshal(signatureContract)
 	stub.PutState(args[1], []byte(signatureContractJson))
 
-	if len(signatureContract.ContractSignature.Signature) == len(signatureContract.Contract.AntiCheatIds)+2 {
+	if signatureContract.ContractSignature.count() == len(signatureContract.Contract.AntiCheatIds)+2 {
 		stub.PutState(signatureContract.Contract.AdvertiserId+"_contract", []byte(args[1]))
 		stub.PutState(signatureContract.Contract.MediaId+"_contract", []byte(args[1]))
 		for _, value := range signatureContract.Contract.AntiCheatIds {
@@ -386,6 +626,74 @@ func mediaAntiConfirm(stub shim.ChaincodeStubInterface, args []string) error {
 	return nil
 }
 
+// getFraudBreakdown returns why the impressions of a settled contract were judged fake,
+// only the parties of the contract may query it
+// args[0]: contractId
+func getFraudBreakdown(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("Incorrect arguments. Expecting 1 argument")
+	}
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return "", fmt.Errorf("could not get ID: %w", err)
+	}
+	sc, err := stub.GetState(args[0])
+	if err != nil {
+		return "", err
+	}
+	var signatureContract SignatureContract
+	err = json.Unmarshal(sc, &signatureContract)
+	if err != nil {
+		return "", err
+	}
+	if !isContractParty(signatureContract.Contract, id) {
+		return "", fmt.Errorf("%s is not a party of contract %s", id, args[0])
+	}
+	fraud, err := stub.GetState(args[0] + "_fraud")
+	if err != nil {
+		return "", err
+	}
+	return string(fraud), nil
+}
+
+func isContractParty(contract Contract, id string) bool {
+	if id == contract.AdvertiserId || id == contract.MediaId {
+		return true
+	}
+	for _, antiCheatId := range contract.AntiCheatIds {
+		if id == antiCheatId {
+			return true
+		}
+	}
+	return false
+}
+
+func getSignatureContract(stub shim.ChaincodeStubInterface, contractId string) (SignatureContract, error) {
+	var signatureContract SignatureContract
+	sc, err := stub.GetState(contractId)
+	if err != nil {
+		return signatureContract, err
+	}
+	if sc == nil {
+		return signatureContract, fmt.Errorf("no contract %s", contractId)
+	}
+	err = json.Unmarshal(sc, &signatureContract)
+	return signatureContract, err
+}
+
+func getMediaLogSubmit(stub shim.ChaincodeStubInterface, logId string) (MediaLogSubmit, error) {
+	var mediaLogSubmit MediaLogSubmit
+	mls, err := stub.GetState(logId)
+	if err != nil {
+		return mediaLogSubmit, err
+	}
+	if mls == nil {
+		return mediaLogSubmit, fmt.Errorf("no log %s", logId)
+	}
+	err = json.Unmarshal(mls, &mediaLogSubmit)
+	return mediaLogSubmit, err
+}
+
 // get contract msg according to contract id
 func getContract(stub shim.ChaincodeStubInterface, contractId string) (string, error) {
 	sc, err := stub.GetState(contractId)
@@ -427,16 +735,95 @@ func getHistoryListResult(resultsIterator shim.HistoryQueryIteratorInterface) []
 	return s
 }
 
+// parseFileCommitment checks the address, hex SHA-256 digest, byte size, record count and hex merkle root of a file
+func parseFileCommitment(address string, digest string, size string, recordCount string, merkleRoot string) (FileCommitment, error) {
+	var commitment FileCommitment
+	if address == "" {
+		return commitment, fmt.Errorf("Incorrect arguments. Expecting Address as string")
+	}
+	if d, err := hex.DecodeString(digest); err != nil || len(d) != sha256.Size {
+		return commitment, fmt.Errorf("digest format error: %s", digest)
+	}
+	sizeInt, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || sizeInt < 0 {
+		return commitment, fmt.Errorf("size format error: %s", size)
+	}
+	count, err := strconv.Atoi(recordCount)
+	if err != nil || count < 0 {
+		return commitment, fmt.Errorf("record count format error: %s", recordCount)
+	}
+	if r, err := hex.DecodeString(merkleRoot); err != nil || len(r) != sha256.Size {
+		return commitment, fmt.Errorf("merkle root format error: %s", merkleRoot)
+	}
+	commitment = FileCommitment{Address: address, Digest: strings.ToLower(digest), Size: sizeInt, RecordCount: count, MerkleRoot: strings.ToLower(merkleRoot)}
+	return commitment, nil
+}
+
 // args[0]:contract id
-// args[1]:file location
-// args[2]:private key
+// args[1]:chunk index, from 0
+// args[2]:chunk count, the same for every chunk of the contract
+// args[3]:file location
+// args[4]:file sha256 digest, hex
+// args[5]:file size in bytes
+// args[6]:record count
+// args[7]:merkle root of the records, hex
+// args[8]:period start, unix seconds
+// args[9]:period end, unix seconds, exclusive
+// args[10]:impression count
+// args[11]:placement ids, comma separated
+// args[12]:time stamp of the log, unix seconds, within SIGNATURE_TIME_SKEW of the transaction
+// args[13]:signature of the log payload, hex, empty for X509 accounts
 func mediaSubmit(stub shim.ChaincodeStubInterface, args []string) error {
-	if len(args) != 3 {
-		return fmt.Errorf("Incorrect arguments. Expecting 3 value")
+	if len(args) != 14 {
+		return fmt.Errorf("Incorrect arguments. Expecting 14 value")
 	}
+	return submitLogChunk(stub, args[:12], args[12], args[13], "")
+}
+
+// reviseLog replaces a submitted chunk that no anticheat has judged yet.
+// The replaced submission is kept in the revision history with the reason.
+// args[0] - args[11]: as mediaSubmit
+// args[12]:reason of the revision
+// args[13]:time stamp of the log, as mediaSubmit
+// args[14]:signature of the log payload, as mediaSubmit
+func reviseLog(stub shim.ChaincodeStubInterface, args []string) error {
+	if len(args) != 15 {
+		return fmt.Errorf("Incorrect arguments. Expecting 15 value")
+	}
+	if args[12] == "" {
+		return fmt.Errorf("Incorrect arguments. Expecting a reason for the revision")
+	}
+	return submitLogChunk(stub, args[:12], args[13], args[14], args[12])
+}
+
+// submitLogChunk submits a chunk of the media log, or revises it when reason is not empty
+func submitLogChunk(stub shim.ChaincodeStubInterface, args []string, timeStamp string, signature string, reason string) error {
 	contractId := args[0]
-	fileLocation := args[1]
-	privateKey := args[2]
+	progress, err := getChunkProgress(stub, contractId)
+	if err != nil {
+		return err
+	}
+	chunkIndex, chunkCount, err := parseChunk(progress, args[1], args[2])
+	if err != nil {
+		return err
+	}
+	if progress != nil && progress.Settled[chunkIndex] {
+		return fmt.Errorf("chunk %d of contract %s is already settled", chunkIndex, contractId)
+	}
+	commitment, err := parseFileCommitment(args[3], args[4], args[5], args[6], args[7])
+	if err != nil {
+		return err
+	}
+	log := Log{FileCommitment: commitment, ChunkIndex: chunkIndex, ChunkCount: chunkCount}
+	err = parseLogMetadata(&log, args[8], args[9], args[10], args[11])
+	if err != nil {
+		return err
+	}
+	log.TimeStamp, err = parseSignedTime(stub, timeStamp)
+	if err != nil {
+		return err
+	}
+	logId := getLogId(contractId, chunkIndex)
 	id, err := cid.GetID(stub)
 	if err != nil {
 		return fmt.Errorf(fmt.Sprintf("Could not Get ID, err %s", err))
@@ -450,25 +837,88 @@ func mediaSubmit(stub shim.ChaincodeStubInterface, args []string) error {
 	if err != nil {
 		return err
 	}
+	if signatureContract.Contract.MediaId != id {
+		return fmt.Errorf("only the media of the contract can submit its log")
+	}
 	//if all people have signed contract
 	antiCheatIds := signatureContract.Contract.AntiCheatIds
-	if len(antiCheatIds)+2 != len(signatureContract.ContractSignature.Signature) {
-		return fmt.Errorf("Could not submit, at Least one AntiCheatOrg not signed.")
+	err = checkContractState(contractId, signatureContract, STATE_ACTIVE, STATE_SETTLING)
+	if err != nil {
+		return err
+	}
+
+	var previous *MediaLogSubmit
+	previousAsBytes, err := stub.GetState(logId)
+	if err != nil {
+		return err
+	}
+	if previousAsBytes != nil {
+		previous = &MediaLogSubmit{}
+		err = json.Unmarshal(previousAsBytes, previous)
+		if err != nil {
+			return err
+		}
+	}
+	if reason == "" && previous != nil {
+		return fmt.Errorf("chunk %d of contract %s is already submitted, use reviseLog to replace it", chunkIndex, contractId)
+	}
+	if reason != "" {
+		if previous == nil {
+			return fmt.Errorf("chunk %d of contract %s is not submitted yet", chunkIndex, contractId)
+		}
+		if len(previous.JudgementCommits) > 0 || previous.Judged {
+			return fmt.Errorf("chunk %d of contract %s is already judged by %d anticheats", chunkIndex, contractId, len(previous.JudgementCommits))
+		}
+		log.Revision = previous.Log.Revision + 1
 	}
 	//#######
-	log := Log{Address: fileLocation, AntiCheatNum: len(antiCheatIds)}
-	logJson, _ := json.Marshal(log)
-	signature, err := DSA.Sign(string(logJson), privateKey)
+	log.AntiCheatNum = len(antiCheatIds)
+	err = checkReportingPeriod(stub, contractId, signatureContract.Contract, log)
+	if err != nil {
+		return err
+	}
+	logPayload, err := getLogPayload(stub, log)
+	if err != nil {
+		return err
+	}
+	sig, approval, err := acceptSignature(stub, id, logPayload, signature)
 	if err != nil {
 		return err
 	}
-	contractSignature := ContractSignature{Signature: map[string][]byte{id: signature}}
-	mediaLogSubmit := MediaLogSubmit{Log: log, ContractSignature: contractSignature, AntiCheatResultAddress: make(map[string]string, 0)}
+	contractSignature := ContractSignature{Signature: make(map[string][]byte)}
+	contractSignature.add(id, sig, approval)
+	mediaLogSubmit := MediaLogSubmit{Log: log, ContractSignature: contractSignature, AntiCheatResultAddress: make(map[string]string, 0), AntiCheatResultCommitment: make(map[string]FileCommitment, 0)}
+	var previousLog *Log
+	if previous != nil {
+		previousLog = &previous.Log
+		revision := LogRevision{Log: previous.Log, Signature: previous.ContractSignature.Signature[id], Reason: reason, TxId: stub.GetTxID(), TimeStamp: log.TimeStamp}
+		if previousApproval, ok := previous.ContractSignature.Approvals[id]; ok {
+			revision.Approval = &previousApproval
+		}
+		mediaLogSubmit.Revisions = append(previous.Revisions, revision)
+	}
 	mls, _ := json.Marshal(mediaLogSubmit)
-	stub.PutState(contractId+"_log", mls)
+	stub.PutState(logId, mls)
+	err = indexReportingPeriod(stub, contractId, signatureContract.Contract, previousLog, log)
+	if err != nil {
+		return err
+	}
+	if progress == nil {
+		progress = &ChunkProgress{ChunkCount: chunkCount, Submitted: make([]bool, chunkCount), Settled: make([]bool, chunkCount)}
+	}
+	progress.Submitted[chunkIndex] = true
+	err = putChunkProgress(stub, contractId, progress)
+	if err != nil {
+		return err
+	}
 	//######
 	for _, id := range antiCheatIds {
-		stub.PutState(id+"_log", []byte(contractId+"_log"))
+		stub.PutState(id+"_log", []byte(logId))
+	}
+	if reason != "" {
+		//tell the anticheats to fetch the chunk again
+		event, _ := json.Marshal(LogRevisedEvent{LogId: logId, Revision: log.Revision, Reason: reason, AntiCheatIds: antiCheatIds})
+		return stub.SetEvent("logRevised", event)
 	}
 	return nil
 }
@@ -487,16 +937,88 @@ func getLogList(stub shim.ChaincodeStubInterface, args []string) (string, error)
 	return strings.Join(resultList, "\n"), nil
 }
 
+// args[0]:log id of the chunk
+// args[1]:media id for the media log, or an anticheat id for its result
+// args[2]:record index, from 0
+// args[3]:record, in logformat canonical form
+// args[4]:merkle proof, comma separated hex hashes from the leaf up
+func verifyRecordInclusion(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 5 {
+		return "", fmt.Errorf("Incorrect arguments. Expecting 5 value")
+	}
+	contractId, _, err := splitLogId(args[0])
+	if err != nil {
+		return "", err
+	}
+	msl, err := stub.GetState(args[0])
+	if err != nil {
+		return "", err
+	}
+	var mediaLogSubmit MediaLogSubmit
+	err = json.Unmarshal(msl, &mediaLogSubmit)
+	if err != nil {
+		return "", err
+	}
+	commitment, ok := mediaLogSubmit.AntiCheatResultCommitment[args[1]]
+	if !ok {
+		sc, err := stub.GetState(contractId)
+		if err != nil {
+			return "", err
+		}
+		var signatureContract SignatureContract
+		err = json.Unmarshal(sc, &signatureContract)
+		if err != nil {
+			return "", err
+		}
+		if signatureContract.Contract.MediaId != args[1] {
+			return "", fmt.Errorf("no commitment of %s for log %s", args[1], args[0])
+		}
+		commitment = mediaLogSubmit.Log.FileCommitment
+	}
+	index, err := strconv.Atoi(args[2])
+	if err != nil {
+		return "", fmt.Errorf("index format error: %s", args[2])
+	}
+	proof := make([][]byte, 0)
+	if args[4] != "" {
+		for _, h := range strings.Split(args[4], ",") {
+			node, err := hex.DecodeString(h)
+			if err != nil {
+				return "", fmt.Errorf("proof format error: %s", h)
+			}
+			proof = append(proof, node)
+		}
+	}
+	err = commitment.VerifyRecord([]byte(args[3]), index, proof)
+	if err != nil {
+		return "", err
+	}
+	return "true", nil
+}
+
+// anticheatConfirm reveals the result an anticheat committed to with anticheatCommit
 // args[0]:log id
-// args[1]:filepath
-// args[2]:private key
+// args[1]:revision of the log that was judged
+// args[2]:filepath
+// args[3]:file sha256 digest, hex
+// args[4]:file size in bytes
+// args[5]:record count
+// args[6]:merkle root of the records, hex
+// args[7]:salt of the judgement commit
+// args[8]:signature of the log payload, hex, empty for X509 accounts
 func anticheatConfirm(stub shim.ChaincodeStubInterface, args []string) error {
-	if len(args) != 3 {
-		return fmt.Errorf("Incorrect arguments. Expecting 3 value")
+	if len(args) != 9 {
+		return fmt.Errorf("Incorrect arguments. Expecting 9 value")
 	}
 	logId := args[0]
-	fileLocation := args[1]
-	privateKey := args[2]
+	revision, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("revision format error: %s", args[1])
+	}
+	commitment, err := parseFileCommitment(args[2], args[3], args[4], args[5], args[6])
+	if err != nil {
+		return err
+	}
 	id, err := cid.GetID(stub)
 	if err != nil {
 		return fmt.Errorf(fmt.Sprintf("Could not Get ID, err %s", err))
@@ -507,178 +1029,227 @@ func anticheatConfirm(stub shim.ChaincodeStubInterface, args []string) error {
 	if err != nil {
 		return err
 	}
-	logJson, err := json.Marshal(mediaLogSubmit.Log)
-	for id, sig := range mediaLogSubmit.ContractSignature.Signature {
-		acc, _ := stub.GetState(id)
-		var account Account
-		err = json.Unmarshal(acc, &account)
-		if err != nil {
-			return err
-		}
-		valid, err := DSA.Verify(string(logJson), sig, account.PublicKey)
-		if err != nil {
-			return err
-		}
-		if valid == false {
-			return errors.New("not valid")
-		}
+	if mediaLogSubmit.Log.Revision != revision {
+		return fmt.Errorf("log %s was revised, judge revision %d", logId, mediaLogSubmit.Log.Revision)
+	}
+	contractId, _, err := splitLogId(logId)
+	if err != nil {
+		return err
+	}
+	sc, err := getSignatureContract(stub, contractId)
+	if err != nil {
+		return err
+	}
+	options := sc.Contract.Options
+	err = checkReveal(stub, id, logId, mediaLogSubmit, options, commitment, args[7])
+	if err != nil {
+		return err
+	}
+	logPayload, err := getLogPayload(stub, mediaLogSubmit.Log)
+	if err != nil {
+		return err
+	}
+	err = verifyAllSignatures(stub, logPayload, mediaLogSubmit.ContractSignature)
+	if err != nil {
+		return err
 	}
 	//anticheat Sign
-	sig, err := DSA.Sign(string(logJson), privateKey)
+	sig, approval, err := acceptSignature(stub, id, logPayload, args[8])
 	if err != nil {
 		return err
 	}
-	mediaLogSubmit.ContractSignature.Signature[id] = sig
+	mediaLogSubmit.ContractSignature.add(id, sig, approval)
 
 	//put filelocation
-	mediaLogSubmit.AntiCheatResultAddress[id] = fileLocation
+	mediaLogSubmit.AntiCheatResultAddress[id] = commitment.Address
+	if mediaLogSubmit.AntiCheatResultCommitment == nil {
+		mediaLogSubmit.AntiCheatResultCommitment = make(map[string]FileCommitment, 0)
+	}
+	mediaLogSubmit.AntiCheatResultCommitment[id] = commitment
     mediaLogSubmitJson, _ := json.Marshal(mediaLogSubmit)
     stub.PutState(logId, []byte(mediaLogSubmitJson))
-	//if all have signed
-	if mediaLogSubmit.Log.AntiCheatNum == len(mediaLogSubmit.AntiCheatResultAddress) {
-		contractId := logId[0:len(logId)-4]
-		buf := new(bytes.Buffer)
-		for id, address := range mediaLogSubmit.AntiCheatResultAddress {
-			if address==""{
-                return fmt.Errorf("address nil, id is:"+id)
-            }
-            buf.WriteString(id+"\t"+address)
-			buf.WriteString(",")
-		}
-		arg := make([]string, 0)
-		arg = append(arg, contractId)
-        bufStr :=buf.String()
-		arg = append(arg, bufStr[0:len(bufStr)-1])
-		return settleAccount(stub, arg)
+	now, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	if allRevealed(mediaLogSubmit, options, now) {
+		return markJudged(stub, logId, sc.Contract, &mediaLogSubmit)
 	}
 	return nil
 }
 
-//args[0]: contractId
-//args[1]: account-fileAddress map
-func settleAccount(stub shim.ChaincodeStubInterface, args []string) error { //To Do: verify with public key
-	if len(args) != 2 {
-		return fmt.Errorf("Incorrect arguments. Expecting 2 value")
+//settleAccount settles a chunk whose attestations reached the oracle quorum,
+//for when the quorum was reached otherwise than by submitAttestation, e.g. by
+//a change of governance. Only oracles and governance admins may trigger it.
+//args[0]: log id of the chunk
+func settleAccount(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("Incorrect arguments. Expecting 1 value")
 	}
-	scAsBytes, err := stub.GetState(args[0])
+	id, err := cid.GetID(stub)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("could not get ID: %w", err)
 	}
-    var sc SignatureContract
-	err = json.Unmarshal(scAsBytes, &sc)
+	governance, err := getGovernanceInfo(stub)
 	if err != nil {
-        return err
-    }
-    antiCheatIds := sc.Contract.AntiCheatIds
-	antiCheatPriorityString := sc.Contract.AntiCheatPriority
-    //transfer string into float64
-	var antiCheatPriorityFloat = make([]float64, len(antiCheatPriorityString))
-	for i := 0; i < len(antiCheatPriorityString); i++ {
-		priority, err := strconv.ParseFloat(antiCheatPriorityString[i], 64)
-		if err != nil {
-			return err
-		}
-		antiCheatPriorityFloat[i] = priority
+		return "", err
 	}
-	antiCheatAddressMap, err := getAddressMap(args[1]) //get address map from string
-    if err != nil {
-		return err
+	if !governance.isOracle(id) && !governance.isAdmin(id) {
+		return "", fmt.Errorf("%s may not trigger settlement", id)
 	}
-	var antiCheatResults = make([][]float64, len(antiCheatIds))
-	for i := 0; i < len(antiCheatIds); i++ {
-        value,ok := antiCheatAddressMap[antiCheatIds[i]]
-        if !ok {
-            return fmt.Errorf("not ok: "+antiCheatIds[i])
-        }
-        if value==""{
-            return fmt.Errorf("value null: "+antiCheatIds[i])
-        }
-		antiCheatResult, err := getAntiCheatResult(antiCheatAddressMap[antiCheatIds[i]])
-		if err != nil {
-			return err
-		}
-		antiCheatResults[i] = antiCheatResult
-	}
-    //print middleRes
-    //if len(args) == 2{
-    //    tmp := strconv.FormatFloat(antiCheatResults[0][0], 'f', 6, 64)
-    //    return fmt.Errorf("antiCheatResults[0][0] :"+tmp)
-    //}
-	//count right and wrong judgement for each antiCheat
-	var countArray = make([][2]int, len(antiCheatResults))
-	var realFlow, fakeFlow float64
-	for j := 0; j < len(antiCheatResults[0]); j++ {
-		var sum float64
-		for i := 0; i < len(antiCheatResults); i++ {
-			sum += antiCheatResults[i][j] * antiCheatPriorityFloat[i]
-		}
-		//count media's realFlow and fakeFlow
-		if sum >= 0 {
-			realFlow += 1
-		} else {
-			fakeFlow += 1
-		}
-		//count anticheat right and wrong nums
-		for i := 0; i < len(antiCheatResults); i++ {
-			if (sum >= 0 && antiCheatResults[i][j] == 1) || (sum < 0 && antiCheatResults[i][j] == -1) {
-				countArray[i][0]++ //countArray[i][0] counts the right num
-			} else {
-				countArray[i][1]++ //countArray[i][1] counts the wrong num
+	return settleChunk(stub, args[0])
+}
+
+//settleChunk settles one chunk of the media log from the attestation a
+//quorum of oracles agreed on, and pays out the contract once every chunk is
+//settled. Settling a settled chunk changes nothing and returns the
+//settlement record as it is.
+func settleChunk(stub shim.ChaincodeStubInterface, logId string) (string, error) {
+	contractId, chunkIndex, err := splitLogId(logId)
+	if err != nil {
+		return "", err
+	}
+	progress, err := getChunkProgress(stub, contractId)
+	if err != nil {
+		return "", err
+	}
+	if progress == nil || chunkIndex >= progress.ChunkCount {
+		return "", fmt.Errorf("no chunk %d submitted for contract %s", chunkIndex, contractId)
+	}
+	if progress.Settled[chunkIndex] {
+		return getSettlementRecordJson(stub, contractId)
+	}
+	sc, err := getSignatureContract(stub, contractId)
+	if err != nil {
+		return "", err
+	}
+	err = checkContractState(contractId, sc, STATE_ACTIVE, STATE_SETTLING)
+	if err != nil {
+		return "", err
+	}
+	contractPayload, err := getContractPayload(stub, sc.Contract)
+	if err != nil {
+		return "", err
+	}
+	err = verifyAllSignatures(stub, contractPayload, sc.ContractSignature)
+	if err != nil {
+		return "", err
+	}
+	mediaLogSubmit, err := getMediaLogSubmit(stub, logId)
+	if err != nil {
+		return "", err
+	}
+	logPayload, err := getLogPayload(stub, mediaLogSubmit.Log)
+	if err != nil {
+		return "", err
+	}
+	err = verifyAllSignatures(stub, logPayload, mediaLogSubmit.ContractSignature)
+	if err != nil {
+		return "", err
+	}
+	attestation, attestationDigest, oracles, err := getAgreedAttestation(stub, logId, sc.Contract, mediaLogSubmit)
+	if err != nil {
+		return "", err
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return "", err
+	}
+	record, err := getSettlementRecord(stub, contractId)
+	if err != nil {
+		return "", err
+	}
+	record.ContractDigest = payload.Digest(contractPayload)
+	record.Chunks = append(record.Chunks, ChunkSettlement{
+		LogId:             logId,
+		Revision:          attestation.Revision,
+		LogDigest:         attestation.LogDigest,
+		ResultDigests:     attestation.ResultDigests,
+		Defaulted:         mediaLogSubmit.Defaulted,
+		AttestationDigest: attestationDigest,
+		Oracles:           oracles,
+		Tally:             attestation.Tally,
+		TxId:              stub.GetTxID(),
+		TimeStamp:         now,
+	})
+	reportJson, _ := json.Marshal(attestation.Report)
+	stub.PutState(logId+"_reconcile", reportJson)
+	progress.Tally.Add(attestation.Tally)
+	progress.Settled[chunkIndex] = true
+	record.Tally = progress.Tally
+	for _, settled := range progress.Settled {
+		if !settled {
+			err = putChunkProgress(stub, contractId, progress)
+			if err != nil {
+				return "", err
+			}
+			err = putContractState(stub, contractId, sc, STATE_SETTLING)
+			if err != nil {
+				return "", err
 			}
+			return putSettlementRecord(stub, record)
 		}
 	}
-	err = payToMedia(stub, sc.Contract, realFlow, fakeFlow)
+	//every chunk is settled, pay out the contract
+	progress.Finalized = true
+	err = putChunkProgress(stub, contractId, progress)
 	if err != nil {
-		return err
+		return "", err
 	}
-	return calculateMoneyAndCredit(stub, countArray, antiCheatIds, sc.Contract.PaymentAmountAntiCheat)
-}
-
-func getAddressMap(addressStr string) (map[string]string, error) {
-	strs := strings.Split(addressStr, ",")
-	var addressMap = make(map[string]string, 0)
-	for _, str := range strs {
-		address := strings.Split(strings.Replace(str,"\t","    ",-1), "    ")
-		if len(address) < 2 {
-			return nil, fmt.Errorf("address format error")
-		}
-		addressMap[address[0]] = address[1]
+	fraudJson, _ := json.Marshal(progress.Tally.Fraud)
+	stub.PutState(contractId+"_fraud", fraudJson)
+	governance, err := getGovernanceInfo(stub)
+	if err != nil {
+		return "", err
+	}
+	if governance.DisputeWindow > 0 {
+		record.HeldUntil = now + governance.DisputeWindow
+	}
+	j, err := newJournal(stub)
+	if err != nil {
+		return "", err
+	}
+	err = payOut(stub, governance, contractId, sc.Contract, progress.Tally, record, j)
+	if err != nil {
+		return "", err
+	}
+	err = j.commit()
+	if err != nil {
+		return "", err
 	}
-	return addressMap, nil
+	record.Transfers = j.entries
+	record.TxId = stub.GetTxID()
+	record.TimeStamp = now
+	record.Finalized = true
+	err = putContractState(stub, contractId, sc, STATE_SETTLED)
+	if err != nil {
+		return "", err
+	}
+	return putSettlementRecord(stub, record)
 }
 
-//get file using ipfs
-func getAntiCheatResult(address string) ([]float64, error) {
-	if address == "" {
-		return nil, fmt.Errorf("Incorrect arguments. Expecting Address as string")
-	}
-	//cmd := "curl " + address
-    resp, err := http.Get("http://"+address)
-	//output, err := exec.Command("sh", "-c", cmd).Output()
-	if err != nil {
-		return nil, err
-	}
-    defer resp.Body.Close()
-    output, err := ioutil.ReadAll(resp.Body)
-	strs := strings.Split(string(output), "\n")
-    if strs[len(strs)-1]==""{
-        strs = strs[0:len(strs)-1]
-    }
-	var result = make([]float64, len(strs))
-	for i := 0; i < len(strs); i++ {
-        if len(strings.Split(strs[i], "    "))<2 {
-            continue
-        }
-		num, err := strconv.ParseFloat(strings.Split(strs[i], "    ")[1], 64)
-		if err != nil {
-			return nil, err
-		}
-		result[i] = num
+// payOut pays the escrows of a settled contract out on its tally. If no
+// impression could be judged there is nothing to pay for, the escrows go
+// back to the advertiser and no credit changes.
+func payOut(stub shim.ChaincodeStubInterface, governance Governance, contractId string, sc Contract, tally settlement.Tally, record *SettlementRecord, j *Journal) error {
+	if tally.RealFlow+tally.FakeFlow == 0 {
+		record.HeldUntil = 0
+		record.Refunded = true
+		return refundEscrows(contractId, sc.AdvertiserId, j)
+	}
+	err := payToMedia(stub, contractId, sc, tally.RealFlow, tally.FakeFlow, record, j)
+	if err != nil {
+		return err
+	}
+	err = calculateMoneyAndCredit(stub, tally.CountArray, contractId, sc, record, j)
+	if err != nil {
+		return err
 	}
-	return result, nil
+	return payFee(governance, contractId, sc, record, j)
 }
 
-func payToMedia(stub shim.ChaincodeStubInterface, sc Contract, realFlow float64, fakeFlow float64) error {
+// realFlow+fakeFlow is not 0, see payOut
+func payToMedia(stub shim.ChaincodeStubInterface, contractId string, sc Contract, realFlow float64, fakeFlow float64, record *SettlementRecord, j *Journal) error {
 	realRate := realFlow / (realFlow + fakeFlow)
 	threshold, err := strconv.ParseFloat(sc.PaymentThreshold, 64)
 	if err != nil {
@@ -696,67 +1267,85 @@ func payToMedia(stub shim.ChaincodeStubInterface, sc Contract, realFlow float64,
 	if err != nil {
 		return err
 	}
+	record.RealRate = realRate
+	record.Threshold = threshold
 	//add or reduce media's credit according to it's performance
 	credit += (realRate - threshold) * amount * MEDIA_CREDIT
+	before := mediaAccount.Credit
 	mediaAccount.Credit = strconv.FormatFloat(credit, 'f', 6, 64)
-    if realRate >= threshold { //if media meets the demand, pay to media
-		assets, err := strconv.ParseFloat(mediaAccount.Assets, 64)
-		if err != nil {
-			return err
-		}
-		assets += amount
-		mediaAccount.Assets = strconv.FormatFloat(assets, 'E', -1, 64)
+	record.post(sc.MediaId, "Credit", before, mediaAccount.Credit, "media performance")
+	escrow := escrowAccount(contractId, ESCROW_MEDIA)
+	escrowed, err := j.balance(escrow)
+	if err != nil {
+		return err
+	}
+	if realRate >= threshold { //if media meets the demand, pay to media
+		err = j.transfer(escrow, record.payee(sc.MediaId), escrowed, contractId, REASON_MEDIA_PAYMENT)
+		record.MediaPaid = true
 	} else { //if media doesn't meet the demand, restore the money to advertiser
-		arg := make([]string, 0)
-		arg = append(arg, "false")
-		advertiserChargeGet(stub, arg)
+		err = j.transfer(escrow, record.payee(sc.AdvertiserId), escrowed, contractId, REASON_MEDIA_REFUND)
+	}
+	if err != nil {
+		return err
 	}
 	accountAsBytes, _ := json.Marshal(mediaAccount)
 	stub.PutState(sc.MediaId, accountAsBytes)
 	return nil
 }
 
-func calculateMoneyAndCredit(stub shim.ChaincodeStubInterface, countArray [][2]int, antiCheatIds []string, money string) error {
+func calculateMoneyAndCredit(stub shim.ChaincodeStubInterface, countArray [][3]float64, contractId string, sc Contract, record *SettlementRecord, j *Journal) error {
+	antiCheatIds := sc.AntiCheatIds
 	var sum float64
 	for _, num := range countArray {
-		sum += float64(num[0])
+		sum += num[0]
 	}
 	creditArray := calculateCredit(countArray)
+	record.CreditChange = creditArray
+	record.AntiCheatShare = make([]float64, len(antiCheatIds))
+	escrow := escrowAccount(contractId, ESCROW_ANTICHEAT)
+	pool, err := j.balance(escrow)
+	if err != nil {
+		return err
+	}
+	var paid int64
 	for i := 0; i < len(antiCheatIds); i++ {
 		account, err := getAccountInfo(stub, antiCheatIds[i])
 		if err != nil {
 			return err
 		}
-		//calculate anticheat assets
-		assets, err := strconv.ParseFloat(account.Assets, 64)
-		if err != nil {
-			return err
+		//calculate anticheat share of the escrow
+		if sum > 0 {
+			record.AntiCheatShare[i] = countArray[i][0] / sum
+			share := int64(math.Floor(float64(pool) * countArray[i][0] / sum))
+			err = j.transfer(escrow, record.payee(antiCheatIds[i]), share, contractId, REASON_ANTICHEAT_SHARE)
+			if err != nil {
+				return err
+			}
+			paid += share
 		}
-        moneyFloat,err := strconv.ParseFloat(money, 64)
-        if err != nil {
-            return err
-        }
-        assets += float64(countArray[i][0]) / sum * moneyFloat
-		account.Assets = strconv.FormatFloat(assets, 'E', -1, 64)
 		//calculate anticheat credit
 		credit, err := strconv.ParseFloat(account.Credit, 64)
 		if err != nil {
 			return err
 		}
 		credit += creditArray[i]
+		before := account.Credit
 		account.Credit = strconv.FormatFloat(credit, 'E', -1, 64)
+		record.post(antiCheatIds[i], "Credit", before, account.Credit, "anticheat performance")
 		accountAsBytes, _ := json.Marshal(account)
 		stub.PutState(antiCheatIds[i], accountAsBytes)
 	}
-	return nil
+	//what rounding leaves, or all of it if no anticheat was right, goes back to the advertiser
+	return j.transfer(escrow, record.payee(sc.AdvertiserId), pool-paid, contractId, REASON_ANTICHEAT_REFUND)
 }
 
-func calculateCredit(countArray [][2]int) []float64 {
+// abstained judgements neither add nor reduce credit
+func calculateCredit(countArray [][3]float64) []float64 {
 	var length = len(countArray)
 	var pointArray = make([]float64, length)
 	var sum float64
 	for i := 0; i < length; i++ {
-		pointArray[i] = float64(countArray[i][0]*RIGHT_CREDIT - countArray[i][1]*WRONG_CREDIT)
+		pointArray[i] = countArray[i][0]*RIGHT_CREDIT - countArray[i][1]*WRONG_CREDIT
 		sum += pointArray[i]
 	}
 	avg := sum / float64(length)
@@ -771,7 +1360,26 @@ func getAccount(stub shim.ChaincodeStubInterface, args []string) (string, error)
 		return "", fmt.Errorf("Incorrect arguments. Expecting 1 argument")
 	}
 	accountAsBytes, err := stub.GetState(args[0])
-	return string(accountAsBytes), err
+	if err != nil || accountAsBytes == nil {
+		return string(accountAsBytes), err
+	}
+	var account Account
+	err = json.Unmarshal(accountAsBytes, &account)
+	if err != nil {
+		return "", err
+	}
+	//assets are the ledger balance
+	j, err := newJournal(stub)
+	if err != nil {
+		return "", err
+	}
+	balance, err := j.balance(args[0])
+	if err != nil {
+		return "", err
+	}
+	account.Assets = formatAmount(balance)
+	accountAsBytes, _ = json.Marshal(account)
+	return string(accountAsBytes), nil
 }
 
 func getAccountInfo(stub shim.ChaincodeStubInterface, id string) (Account, error) {
@@ -0,0 +1,241 @@
+package settlement
+
+import (
+	"fmt"
+	"math"
+)
+
+// aggregators a contract can decide impressions with
+const (
+	AGGREGATOR_WEIGHTED    = "weighted"    // sum of score times anticheat priority
+	AGGREGATOR_MAJORITY    = "majority"    // one vote per anticheat, the side with more votes wins
+	AGGREGATOR_QUORUM      = "quorum"      // a side needs QuorumK votes, and the other side fewer
+	AGGREGATOR_CREDIT      = "credit"      // sum of score times anticheat credit when the chunk was judged
+	AGGREGATOR_DAWID_SKENE = "dawid-skene" // EM estimate of each anticheat's error rates
+
+	DAWID_SKENE_ITERATIONS = 50
+	DAWID_SKENE_TOLERANCE  = 1e-9
+	DAWID_SKENE_SMOOTHING  = 0.01
+)
+
+// verdicts of an aggregator on one impression
+const (
+	VERDICT_REAL = iota
+	VERDICT_FAKE
+	VERDICT_TIE  // the anticheats voted but neither side won, decided by the contract TieBreak
+	VERDICT_NONE // every anticheat abstained, decided by the contract AllAbstain
+)
+
+// Aggregator decides every impression from the anticheat judgements.
+// judgements[i] is nil for an anticheat that defaulted, weights[i] is the
+// weight of anticheat i for the aggregators that use one.
+type Aggregator interface {
+	Decide(impressions []string, judgements []map[string]Judgement, weights []float64) []int
+}
+
+func AggregatorName(o ContractOptions) string {
+	return policyOrDefault(o.Aggregator, AGGREGATOR_WEIGHTED)
+}
+
+// TieBreak is the outcome of a tied impression. It defaults to real, as the
+// weighted sum did before ties were configurable.
+func TieBreak(o ContractOptions) string {
+	return policyOrDefault(o.TieBreak, OUTCOME_REAL)
+}
+
+// NewAggregator returns the aggregator the contract options choose
+func NewAggregator(o ContractOptions) (Aggregator, error) {
+	switch AggregatorName(o) {
+	case AGGREGATOR_WEIGHTED, AGGREGATOR_CREDIT:
+		return weightedAggregator{}, nil
+	case AGGREGATOR_MAJORITY:
+		return quorumAggregator{}, nil
+	case AGGREGATOR_QUORUM:
+		return quorumAggregator{k: o.QuorumK}, nil
+	case AGGREGATOR_DAWID_SKENE:
+		return dawidSkeneAggregator{}, nil
+	}
+	return nil, fmt.Errorf("unknown aggregator %s", o.Aggregator)
+}
+
+// vote reads a judgement as a vote, 1 real, -1 fake and 0 none
+func vote(judgement Judgement, ok bool) float64 {
+	if !ok || judgement.Abstain || judgement.Score == 0 {
+		return 0
+	}
+	if judgement.Score > 0 {
+		return 1
+	}
+	return -1
+}
+
+// weightedAggregator sums the scores times the weights, a positive sum meaning real
+type weightedAggregator struct{}
+
+func (weightedAggregator) Decide(impressions []string, judgements []map[string]Judgement, weights []float64) []int {
+	verdicts := make([]int, len(impressions))
+	for n, impression := range impressions {
+		var sum float64
+		var voted bool
+		for i := range judgements {
+			judgement, ok := judgements[i][impression]
+			if vote(judgement, ok) == 0 {
+				continue
+			}
+			sum += judgement.Score * weights[i]
+			voted = true
+		}
+		switch {
+		case !voted:
+			verdicts[n] = VERDICT_NONE
+		case sum > 0:
+			verdicts[n] = VERDICT_REAL
+		case sum < 0:
+			verdicts[n] = VERDICT_FAKE
+		default:
+			verdicts[n] = VERDICT_TIE
+		}
+	}
+	return verdicts
+}
+
+// quorumAggregator counts one vote per anticheat. A side wins with at least
+// k votes while the other has fewer, k 0 meaning a plain majority.
+type quorumAggregator struct {
+	k int
+}
+
+func (a quorumAggregator) Decide(impressions []string, judgements []map[string]Judgement, weights []float64) []int {
+	verdicts := make([]int, len(impressions))
+	for n, impression := range impressions {
+		var real, fake int
+		for i := range judgements {
+			judgement, ok := judgements[i][impression]
+			switch vote(judgement, ok) {
+			case 1:
+				real++
+			case -1:
+				fake++
+			}
+		}
+		switch {
+		case real+fake == 0:
+			verdicts[n] = VERDICT_NONE
+		case a.k == 0 && real > fake, a.k > 0 && real >= a.k && fake < a.k:
+			verdicts[n] = VERDICT_REAL
+		case a.k == 0 && fake > real, a.k > 0 && fake >= a.k && real < a.k:
+			verdicts[n] = VERDICT_FAKE
+		default:
+			verdicts[n] = VERDICT_TIE
+		}
+	}
+	return verdicts
+}
+
+// dawidSkeneAggregator estimates by expectation maximization how likely
+// each impression is fake together with the rate at which every anticheat
+// calls a real impression fake and a fake one real, so a reliable anticheat
+// outweighs several careless ones. It starts from the majority vote.
+type dawidSkeneAggregator struct{}
+
+func (dawidSkeneAggregator) Decide(impressions []string, judgements []map[string]Judgement, weights []float64) []int {
+	votes := make([][]float64, len(impressions))
+	fake := make([]float64, len(impressions)) // probability impression n is fake
+	for n, impression := range impressions {
+		votes[n] = make([]float64, len(judgements))
+		var real, fakeVotes float64
+		for i := range judgements {
+			judgement, ok := judgements[i][impression]
+			votes[n][i] = vote(judgement, ok)
+			if votes[n][i] > 0 {
+				real++
+			} else if votes[n][i] < 0 {
+				fakeVotes++
+			}
+		}
+		if real+fakeVotes > 0 {
+			fake[n] = fakeVotes / (real + fakeVotes)
+		} else {
+			fake[n] = -1
+		}
+	}
+
+	// confusion[i][t][v] is how often anticheat i votes v (0 real, 1 fake) on an impression of truth t
+	confusion := make([][2][2]float64, len(judgements))
+	for iteration := 0; iteration < DAWID_SKENE_ITERATIONS; iteration++ {
+		//M-step
+		var prior, voted float64
+		for i := range confusion {
+			confusion[i] = [2][2]float64{{DAWID_SKENE_SMOOTHING, DAWID_SKENE_SMOOTHING}, {DAWID_SKENE_SMOOTHING, DAWID_SKENE_SMOOTHING}}
+		}
+		for n := range impressions {
+			if fake[n] < 0 {
+				continue
+			}
+			prior += fake[n]
+			voted++
+			for i, v := range votes[n] {
+				if v == 0 {
+					continue
+				}
+				label := 0
+				if v < 0 {
+					label = 1
+				}
+				confusion[i][0][label] += 1 - fake[n]
+				confusion[i][1][label] += fake[n]
+			}
+		}
+		if voted == 0 {
+			break
+		}
+		prior = (prior + DAWID_SKENE_SMOOTHING) / (voted + 2*DAWID_SKENE_SMOOTHING)
+		for i := range confusion {
+			for t := 0; t < 2; t++ {
+				total := confusion[i][t][0] + confusion[i][t][1]
+				confusion[i][t][0] /= total
+				confusion[i][t][1] /= total
+			}
+		}
+		//E-step
+		var change float64
+		for n := range impressions {
+			if fake[n] < 0 {
+				continue
+			}
+			pReal, pFake := math.Log(1-prior), math.Log(prior)
+			for i, v := range votes[n] {
+				if v == 0 {
+					continue
+				}
+				label := 0
+				if v < 0 {
+					label = 1
+				}
+				pReal += math.Log(confusion[i][0][label])
+				pFake += math.Log(confusion[i][1][label])
+			}
+			p := 1 / (1 + math.Exp(pReal-pFake))
+			change = math.Max(change, math.Abs(p-fake[n]))
+			fake[n] = p
+		}
+		if change < DAWID_SKENE_TOLERANCE {
+			break
+		}
+	}
+
+	verdicts := make([]int, len(impressions))
+	for n := range impressions {
+		switch {
+		case fake[n] < 0:
+			verdicts[n] = VERDICT_NONE
+		case fake[n] < 0.5:
+			verdicts[n] = VERDICT_REAL
+		case fake[n] > 0.5:
+			verdicts[n] = VERDICT_FAKE
+		default:
+			verdicts[n] = VERDICT_TIE
+		}
+	}
+	return verdicts
+}
@@ -0,0 +1,290 @@
+package settlement
+
+import (
+	"strings"
+	"testing"
+
+	"chaincodedev/chaincode/liqi/hwxf/logformat"
+	"chaincodedev/chaincode/liqi/hwxf/payload"
+)
+
+// judged returns the judgements of one anticheat, "r" real, "f" fake, "a"
+// abstain and "-" no judgement, one letter per impression
+func judged(votes string) map[string]Judgement {
+	judgements := make(map[string]Judgement)
+	for n, v := range votes {
+		impression := string(rune('a' + n))
+		switch v {
+		case 'r':
+			judgements[impression] = Judgement{Score: 1}
+		case 'f':
+			judgements[impression] = Judgement{Score: -1}
+		case 'a':
+			judgements[impression] = Judgement{Abstain: true}
+		}
+	}
+	return judgements
+}
+
+func verdictString(verdicts []int) string {
+	letters := []byte("rftn")
+	var s []byte
+	for _, v := range verdicts {
+		s = append(s, letters[v])
+	}
+	return string(s)
+}
+
+func TestAggregators(t *testing.T) {
+	impressions := []string{"a", "b", "c", "d", "e"}
+	tests := []struct {
+		name       string
+		options    ContractOptions
+		judgements []map[string]Judgement
+		weights    []float64
+		want       string // r real, f fake, t tie, n none
+	}{
+		{
+			name:       "weighted",
+			judgements: []map[string]Judgement{judged("rffaa"), judged("frrfa"), judged("rfrf-")},
+			weights:    []float64{3, 1, 1},
+			want:       "rfffn",
+		},
+		{
+			name:       "weighted all abstain and defaulted",
+			judgements: []map[string]Judgement{judged("aa---"), nil},
+			weights:    []float64{1, 1},
+			want:       "nnnnn",
+		},
+		{
+			name:       "weighted graded scores",
+			judgements: []map[string]Judgement{{"a": {Score: 0.2}, "b": {Score: -0.2}}, {"a": {Score: -0.1}, "b": {Score: 0.3}}},
+			weights:    []float64{1, 1},
+			want:       "rrnnn",
+		},
+		{
+			name:       "majority ignores weights",
+			options:    ContractOptions{Aggregator: AGGREGATOR_MAJORITY},
+			judgements: []map[string]Judgement{judged("rffaa"), judged("frrfa"), judged("rfrf-")},
+			weights:    []float64{3, 1, 1},
+			want:       "rfrfn",
+		},
+		{
+			name:       "majority tie",
+			options:    ContractOptions{Aggregator: AGGREGATOR_MAJORITY},
+			judgements: []map[string]Judgement{judged("rf"), judged("fr")},
+			weights:    []float64{1, 1},
+			want:       "ttnnn",
+		},
+		{
+			name:       "quorum of two",
+			options:    ContractOptions{Aggregator: AGGREGATOR_QUORUM, QuorumK: 2},
+			judgements: []map[string]Judgement{judged("rrfrr"), judged("rafrf"), judged("aaarf")},
+			weights:    []float64{1, 1, 1},
+			want:       "rtfrf",
+		},
+		{
+			name:       "credit weights",
+			options:    ContractOptions{Aggregator: AGGREGATOR_CREDIT},
+			judgements: []map[string]Judgement{judged("rf"), judged("fr")},
+			weights:    []float64{1, 2},
+			want:       "frnnn",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aggregator, err := NewAggregator(tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := verdictString(aggregator.Decide(impressions, tt.judgements, tt.weights)); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// A reliable anticheat outweighs two that vote the same way on everything
+func TestDawidSkene(t *testing.T) {
+	var reliable, careless string
+	impressions := make([]string, 0, 20)
+	for n := 0; n < 20; n++ {
+		impressions = append(impressions, string(rune('a'+n)))
+		if n%2 == 0 {
+			reliable += "f"
+		} else {
+			reliable += "r"
+		}
+		careless += "r"
+	}
+	//the careless ones agree with the reliable one on the real impressions, a third one agrees on the fake ones
+	judgements := []map[string]Judgement{judged(reliable), judged(careless), judged(careless), judged(reliable)}
+	verdicts := dawidSkeneAggregator{}.Decide(impressions, judgements, nil)
+	if got := verdictString(verdicts); got != reliable {
+		t.Fatalf("got %s, want %s", got, reliable)
+	}
+	verdicts = dawidSkeneAggregator{}.Decide([]string{"a"}, []map[string]Judgement{judged("a")}, nil)
+	if got := verdictString(verdicts); got != "n" {
+		t.Fatalf("got %s for an abstained impression", got)
+	}
+}
+
+func TestTallyJudgements(t *testing.T) {
+	impressions := []string{"a", "b", "c", "d"}
+	antiCheatIds := []string{"ac1", "ac2", "ac3"}
+	fake := map[string]Judgement{"a": {Score: 1}, "b": {Score: -1, Reasons: []string{"BOT"}}, "c": {Score: -0.5, Reasons: []string{"BOT", "GIVT"}}, "d": {Abstain: true}}
+	other := map[string]Judgement{"a": {Score: 1}, "b": {Score: 1}, "c": {Score: -1}}
+	tests := []struct {
+		name        string
+		options     ContractOptions
+		judgements  []map[string]Judgement
+		realFlow    float64
+		fakeFlow    float64
+		counts      [][3]float64
+		reasons     map[string]int
+		unspecified int
+	}{
+		{
+			name:       "defaults",
+			judgements: []map[string]Judgement{fake, other, nil},
+			realFlow:   2,
+			fakeFlow:   1,
+			counts:     [][3]float64{{1.5, 1, 1}, {3, 0, 1}, {}},
+			reasons:    map[string]int{"BOT": 1, "GIVT": 1},
+		},
+		{
+			name:        "all abstain is fake, missing counts as wrong",
+			options:     ContractOptions{AllAbstain: OUTCOME_FAKE},
+			judgements:  []map[string]Judgement{fake, other, nil},
+			realFlow:    2,
+			fakeFlow:    2,
+			counts:      [][3]float64{{1.5, 1, 1}, {3, 1, 0}, {}},
+			reasons:     map[string]int{"BOT": 1, "GIVT": 1},
+			unspecified: 1,
+		},
+		{
+			name:        "all abstain is fake, missing abstains",
+			options:     ContractOptions{AllAbstain: OUTCOME_FAKE, MissingJudgement: POLICY_ABSTAIN},
+			judgements:  []map[string]Judgement{fake, other, nil},
+			realFlow:    2,
+			fakeFlow:    2,
+			counts:      [][3]float64{{1.5, 1, 1}, {3, 0, 1}, {}},
+			reasons:     map[string]int{"BOT": 1, "GIVT": 1},
+			unspecified: 1,
+		},
+		{
+			name:       "ties excluded",
+			options:    ContractOptions{Aggregator: AGGREGATOR_MAJORITY, TieBreak: OUTCOME_EXCLUDE},
+			judgements: []map[string]Judgement{fake, other, nil},
+			realFlow:   1,
+			fakeFlow:   1,
+			counts:     [][3]float64{{1.5, 0, 2}, {2, 0, 2}, {}},
+			reasons:    map[string]int{"BOT": 1, "GIVT": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tally, err := TallyJudgements(impressions, antiCheatIds, tt.judgements, []float64{1, 1, 1}, tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tally.RealFlow != tt.realFlow || tally.FakeFlow != tt.fakeFlow {
+				t.Fatalf("got flows %g/%g, want %g/%g", tally.RealFlow, tally.FakeFlow, tt.realFlow, tt.fakeFlow)
+			}
+			for i := range tt.counts {
+				if tally.CountArray[i] != tt.counts[i] {
+					t.Fatalf("got counts %v, want %v", tally.CountArray, tt.counts)
+				}
+			}
+			for code, n := range tt.reasons {
+				if tally.Fraud.Reasons[code] != n {
+					t.Fatalf("got reasons %v, want %v", tally.Fraud.Reasons, tt.reasons)
+				}
+			}
+			if tally.Fraud.FakeImpressions != int(tt.fakeFlow) || tally.Fraud.Unspecified != tt.unspecified {
+				t.Fatalf("got %d fake impressions", tally.Fraud.FakeImpressions)
+			}
+		})
+	}
+}
+
+func TestTallyAdd(t *testing.T) {
+	var total Tally
+	chunk := Tally{
+		RealFlow:   2,
+		FakeFlow:   1,
+		CountArray: [][3]float64{{1, 2, 3}},
+		Fraud:      FraudBreakdown{FakeImpressions: 1, Reasons: map[string]int{"BOT": 1}, ByAntiCheat: map[string]map[string]int{"ac1": {"BOT": 1}}},
+	}
+	total.Add(chunk)
+	total.Add(chunk)
+	if total.RealFlow != 4 || total.FakeFlow != 2 || total.CountArray[0] != [3]float64{2, 4, 6} ||
+		total.Fraud.FakeImpressions != 2 || total.Fraud.Reasons["BOT"] != 2 || total.Fraud.ByAntiCheat["ac1"]["BOT"] != 2 {
+		t.Fatalf("got %+v", total)
+	}
+	if chunk.Fraud.Reasons["BOT"] != 1 {
+		t.Fatal("Add changed the added tally")
+	}
+}
+
+func TestSettle(t *testing.T) {
+	contract := payload.Contract{
+		AntiCheatIds:      []string{"ac1", "ac2"},
+		AntiCheatPriority: []string{"2", "1"},
+	}
+	mediaLog := parse(t, "#hwxf v2 tsv\nimp-1\nimp-2\nimp-3\n")
+	results := []*logformat.File{
+		parse(t, "#hwxf v2 tsv\nimp-1\t1\nimp-2\t-1\tBOT\nimp-3\t1\n"),
+		parse(t, "#hwxf v2 tsv\nimp-1\t-1\nimp-2\t1\nimp-3\t-1\n"),
+	}
+	tests := []struct {
+		name     string
+		contract func(c *payload.Contract)
+		log      payload.Log
+		results  []*logformat.File
+		credits  map[string]float64
+		realFlow float64
+		wantErr  string
+	}{
+		{name: "priorities", log: payload.Log{ImpressionCount: 3}, results: results, realFlow: 2},
+		{
+			name:     "credits",
+			contract: func(c *payload.Contract) { c.Options.Aggregator = AGGREGATOR_CREDIT },
+			log:      payload.Log{ImpressionCount: 3},
+			results:  results,
+			credits:  map[string]float64{"ac1": -5, "ac2": 1},
+			realFlow: 1,
+		},
+		{name: "defaulted anticheat", log: payload.Log{ImpressionCount: 3}, results: []*logformat.File{nil, results[1]}, realFlow: 1},
+		{name: "impression count", log: payload.Log{ImpressionCount: 4}, results: results, wantErr: "media log has 3 impressions, submitted 4"},
+		{name: "result count", log: payload.Log{ImpressionCount: 3}, results: results[:1], wantErr: "1 anticheat results for 2 anticheats"},
+		{
+			name:     "bad priority",
+			contract: func(c *payload.Contract) { c.AntiCheatPriority = []string{"x", "1"} },
+			log:      payload.Log{ImpressionCount: 3},
+			results:  results,
+			wantErr:  "anticheat priority format error: x",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := contract
+			if tt.contract != nil {
+				tt.contract(&c)
+			}
+			tally, _, err := Settle(c, tt.log, mediaLog, tt.results, tt.credits)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tally.RealFlow != tt.realFlow || tally.RealFlow+tally.FakeFlow != 3 {
+				t.Fatalf("got flows %g/%g, want %g real", tally.RealFlow, tally.FakeFlow, tt.realFlow)
+			}
+		})
+	}
+}
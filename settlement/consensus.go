@@ -0,0 +1,201 @@
+package settlement
+
+import (
+	"fmt"
+	"math"
+
+	"chaincodedev/chaincode/liqi/hwxf/logformat"
+)
+
+const (
+	SCALE_SCORE       = "score"       // judgement in [-1,1], negative means fake
+	SCALE_PROBABILITY = "probability" // judgement in [0,1], the probability the impression is fake
+
+	OUTCOME_REAL    = "real"
+	OUTCOME_FAKE    = "fake"
+	OUTCOME_EXCLUDE = "exclude" // counted neither as real nor as fake flow
+)
+
+// Judgement is an anticheat verdict on one impression on the score scale
+type Judgement struct {
+	Score   float64
+	Abstain bool
+	Reasons []string
+}
+
+// FraudBreakdown tells why the impressions of a contract were judged fake.
+// Reasons counts the fake impressions an anticheat that judged them fake
+// gave the code for, so one impression may count under several codes.
+type FraudBreakdown struct {
+	FakeImpressions int
+	Unspecified     int // fake impressions no anticheat gave a reason for
+	Reasons         map[string]int
+	ByAntiCheat     map[string]map[string]int
+}
+
+// Tally is the outcome of the judgements of a contract
+type Tally struct {
+	RealFlow   float64
+	FakeFlow   float64
+	CountArray [][3]float64
+	Fraud      FraudBreakdown
+}
+
+func JudgementScale(o ContractOptions) string {
+	return policyOrDefault(o.JudgementScale, SCALE_SCORE)
+}
+
+func AllAbstainOutcome(o ContractOptions) string {
+	return policyOrDefault(o.AllAbstain, OUTCOME_EXCLUDE)
+}
+
+// ToJudgement reads a result record on the contract scale.
+// A probability p of fraud becomes the score 1-2p.
+func ToJudgement(record logformat.Record, scale string) (Judgement, error) {
+	if record.Abstain {
+		return Judgement{Abstain: true}, nil
+	}
+	if !record.HasScore {
+		return Judgement{}, fmt.Errorf("line %d: no score for %s", record.Line, record.ID)
+	}
+	switch scale {
+	case SCALE_PROBABILITY:
+		if record.Score < 0 || record.Score > 1 {
+			return Judgement{}, fmt.Errorf("line %d: probability %g of %s out of [0,1]", record.Line, record.Score, record.ID)
+		}
+		return Judgement{Score: 1 - 2*record.Score, Reasons: record.Reasons}, nil
+	default:
+		if record.Score < -1 || record.Score > 1 {
+			return Judgement{}, fmt.Errorf("line %d: score %g of %s out of [-1,1]", record.Line, record.Score, record.ID)
+		}
+		return Judgement{Score: record.Score, Reasons: record.Reasons}, nil
+	}
+}
+
+// TallyJudgements decides every impression with the aggregator of the
+// contract, weights being the anticheat priorities or credits, and counts for
+// each anticheat how much it was right (countArray[i][0]), wrong ([1]) and
+// how often it abstained ([2]). A graded judgement counts by its strength,
+// so a 0.2 on the wrong side costs less than a 1. An anticheat without
+// judgements, one that defaulted on the chunk, counts nothing.
+func TallyJudgements(impressions []string, antiCheatIds []string, judgements []map[string]Judgement, weights []float64, options ContractOptions) (Tally, error) {
+	aggregator, err := NewAggregator(options)
+	if err != nil {
+		return Tally{}, err
+	}
+	verdicts := aggregator.Decide(impressions, judgements, weights)
+	var countArray = make([][3]float64, len(judgements))
+	var realFlow, fakeFlow float64
+	fraud := FraudBreakdown{Reasons: make(map[string]int), ByAntiCheat: make(map[string]map[string]int)}
+	countMissing := MissingJudgementPolicy(options) == POLICY_WRONG
+	allAbstain := AllAbstainOutcome(options)
+	tieBreak := TieBreak(options)
+	for n, impression := range impressions {
+		outcome := OUTCOME_REAL
+		switch verdicts[n] {
+		case VERDICT_FAKE:
+			outcome = OUTCOME_FAKE
+		case VERDICT_TIE:
+			outcome = tieBreak
+		case VERDICT_NONE:
+			outcome = allAbstain
+		}
+		if outcome == OUTCOME_EXCLUDE {
+			for i := 0; i < len(judgements); i++ {
+				if judgements[i] != nil {
+					countArray[i][2]++
+				}
+			}
+			continue
+		}
+		real := outcome == OUTCOME_REAL
+		//count media's realFlow and fakeFlow
+		if real {
+			realFlow += 1
+		} else {
+			fakeFlow += 1
+			addFraudReasons(&fraud, impression, antiCheatIds, judgements)
+		}
+		//count anticheat right and wrong
+		for i := 0; i < len(judgements); i++ {
+			if judgements[i] == nil {
+				continue
+			}
+			judgement, ok := judgements[i][impression]
+			if !ok {
+				if countMissing {
+					countArray[i][1]++
+				} else {
+					countArray[i][2]++
+				}
+				continue
+			}
+			if judgement.Abstain || judgement.Score == 0 {
+				countArray[i][2]++
+			} else if real == (judgement.Score > 0) {
+				countArray[i][0] += math.Abs(judgement.Score)
+			} else {
+				countArray[i][1] += math.Abs(judgement.Score)
+			}
+		}
+	}
+	return Tally{RealFlow: realFlow, FakeFlow: fakeFlow, CountArray: countArray, Fraud: fraud}, nil
+}
+
+// Add accumulates the tally of one chunk
+func (t *Tally) Add(o Tally) {
+	t.RealFlow += o.RealFlow
+	t.FakeFlow += o.FakeFlow
+	if t.CountArray == nil {
+		t.CountArray = make([][3]float64, len(o.CountArray))
+	}
+	for i := range o.CountArray {
+		for j := range o.CountArray[i] {
+			t.CountArray[i][j] += o.CountArray[i][j]
+		}
+	}
+	t.Fraud.FakeImpressions += o.Fraud.FakeImpressions
+	t.Fraud.Unspecified += o.Fraud.Unspecified
+	if t.Fraud.Reasons == nil {
+		t.Fraud.Reasons = make(map[string]int)
+	}
+	for code, n := range o.Fraud.Reasons {
+		t.Fraud.Reasons[code] += n
+	}
+	if t.Fraud.ByAntiCheat == nil {
+		t.Fraud.ByAntiCheat = make(map[string]map[string]int)
+	}
+	for id, reasons := range o.Fraud.ByAntiCheat {
+		if t.Fraud.ByAntiCheat[id] == nil {
+			t.Fraud.ByAntiCheat[id] = make(map[string]int)
+		}
+		for code, n := range reasons {
+			t.Fraud.ByAntiCheat[id][code] += n
+		}
+	}
+}
+
+// addFraudReasons adds the reasons of the anticheats that judged a fake impression fake
+func addFraudReasons(fraud *FraudBreakdown, impression string, antiCheatIds []string, judgements []map[string]Judgement) {
+	fraud.FakeImpressions++
+	reasons := make(map[string]bool)
+	for i := 0; i < len(judgements); i++ {
+		judgement, ok := judgements[i][impression]
+		if !ok || judgement.Abstain || judgement.Score >= 0 {
+			continue
+		}
+		for _, code := range judgement.Reasons {
+			reasons[code] = true
+			if fraud.ByAntiCheat[antiCheatIds[i]] == nil {
+				fraud.ByAntiCheat[antiCheatIds[i]] = make(map[string]int)
+			}
+			fraud.ByAntiCheat[antiCheatIds[i]][code]++
+		}
+	}
+	if len(reasons) == 0 {
+		fraud.Unspecified++
+	}
+	for code := range reasons {
+		fraud.Reasons[code]++
+	}
+}
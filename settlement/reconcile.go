@@ -0,0 +1,183 @@
+package settlement
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"chaincodedev/chaincode/liqi/hwxf/logformat"
+	"chaincodedev/chaincode/liqi/hwxf/payload"
+)
+
+// policies for impressions that don't line up between the media log and the anticheat results
+const (
+	POLICY_REJECT  = "reject"  // settlement fails
+	POLICY_WRONG   = "wrong"   // missing judgement counts as a wrong one for the anticheat
+	POLICY_ABSTAIN = "abstain" // missing judgement is neither right nor wrong
+	POLICY_IGNORE  = "ignore"  // extra judgement is dropped
+	POLICY_FIRST   = "first"   // first of duplicate ids is kept
+	POLICY_LAST    = "last"    // last of duplicate ids is kept
+)
+
+type ContractOptions = payload.ContractOptions
+
+type AntiCheatReconcile struct {
+	Missing    []string
+	Extra      []string
+	Duplicates []string
+}
+
+// ReconcileReport lists the impression ids the media log and the anticheat results disagree on
+type ReconcileReport struct {
+	ImpressionCount      int
+	DuplicateImpressions []string
+	AntiCheats           map[string]*AntiCheatReconcile
+}
+
+func policyOrDefault(policy string, def string) string {
+	if policy == "" {
+		return def
+	}
+	return policy
+}
+
+func MissingJudgementPolicy(o ContractOptions) string {
+	return policyOrDefault(o.MissingJudgement, POLICY_WRONG)
+}
+
+func ExtraJudgementPolicy(o ContractOptions) string {
+	return policyOrDefault(o.ExtraJudgement, POLICY_IGNORE)
+}
+
+func DuplicateJudgementPolicy(o ContractOptions) string {
+	return policyOrDefault(o.DuplicateJudgement, POLICY_REJECT)
+}
+
+func checkPolicy(name string, policy string, allowed ...string) error {
+	for _, a := range allowed {
+		if policy == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s policy must be one of %v, got %s", name, allowed, policy)
+}
+
+// ParseContractOptions reads and checks the JSON options of a contract
+func ParseContractOptions(optionsJson string) (ContractOptions, error) {
+	var options ContractOptions
+	if optionsJson != "" {
+		err := json.Unmarshal([]byte(optionsJson), &options)
+		if err != nil {
+			return options, fmt.Errorf("contract options format error: %s", err)
+		}
+	}
+	if err := checkPolicy("MissingJudgement", MissingJudgementPolicy(options), POLICY_REJECT, POLICY_WRONG, POLICY_ABSTAIN); err != nil {
+		return options, err
+	}
+	if err := checkPolicy("ExtraJudgement", ExtraJudgementPolicy(options), POLICY_REJECT, POLICY_IGNORE); err != nil {
+		return options, err
+	}
+	if err := checkPolicy("DuplicateJudgement", DuplicateJudgementPolicy(options), POLICY_REJECT, POLICY_FIRST, POLICY_LAST); err != nil {
+		return options, err
+	}
+	if err := checkPolicy("JudgementScale", JudgementScale(options), SCALE_SCORE, SCALE_PROBABILITY); err != nil {
+		return options, err
+	}
+	if err := checkPolicy("AllAbstain", AllAbstainOutcome(options), OUTCOME_REAL, OUTCOME_FAKE, OUTCOME_EXCLUDE); err != nil {
+		return options, err
+	}
+	if options.ActiveFrom < 0 || options.ActiveTo < 0 || (options.ActiveTo != 0 && options.ActiveTo <= options.ActiveFrom) {
+		return options, fmt.Errorf("contract active window [%d, %d) format error", options.ActiveFrom, options.ActiveTo)
+	}
+	if err := checkPolicy("Aggregator", AggregatorName(options), AGGREGATOR_WEIGHTED, AGGREGATOR_MAJORITY, AGGREGATOR_QUORUM, AGGREGATOR_CREDIT, AGGREGATOR_DAWID_SKENE); err != nil {
+		return options, err
+	}
+	if err := checkPolicy("TieBreak", TieBreak(options), OUTCOME_REAL, OUTCOME_FAKE, OUTCOME_EXCLUDE); err != nil {
+		return options, err
+	}
+	if options.QuorumK < 0 || (AggregatorName(options) == AGGREGATOR_QUORUM) != (options.QuorumK > 0) {
+		return options, fmt.Errorf("QuorumK %d must be set with the quorum aggregator, and only with it", options.QuorumK)
+	}
+	if options.CommitWindow < 0 || options.RevealWindow < 0 {
+		return options, fmt.Errorf("commit window %d and reveal window %d must not be negative", options.CommitWindow, options.RevealWindow)
+	}
+	return options, nil
+}
+
+// CheckOptions checks the options of a contract against its anticheats
+func CheckOptions(contract payload.Contract) error {
+	if contract.Options.QuorumK > len(contract.AntiCheatIds) {
+		return fmt.Errorf("QuorumK %d is more than the %d anticheats", contract.Options.QuorumK, len(contract.AntiCheatIds))
+	}
+	if len(contract.AntiCheatPriority) != len(contract.AntiCheatIds) {
+		return fmt.Errorf("%d anticheat priorities for %d anticheats", len(contract.AntiCheatPriority), len(contract.AntiCheatIds))
+	}
+	return nil
+}
+
+// ReconcileImpressions returns the distinct impression ids of the media log, in log order
+func ReconcileImpressions(log *logformat.File, options ContractOptions, report *ReconcileReport) ([]string, error) {
+	seen := make(map[string]bool, len(log.Records))
+	impressions := make([]string, 0, len(log.Records))
+	for _, record := range log.Records {
+		if seen[record.ID] {
+			report.DuplicateImpressions = append(report.DuplicateImpressions, record.ID)
+			continue
+		}
+		seen[record.ID] = true
+		impressions = append(impressions, record.ID)
+	}
+	report.ImpressionCount = len(impressions)
+	if len(report.DuplicateImpressions) > 0 && DuplicateJudgementPolicy(options) == POLICY_REJECT {
+		return nil, fmt.Errorf("media log has %d duplicate impression ids, first %s", len(report.DuplicateImpressions), report.DuplicateImpressions[0])
+	}
+	return impressions, nil
+}
+
+// ReconcileJudgements keys the judgements of anticheat id by impression id.
+// Judgements for ids outside impressions, duplicates and missing ids are
+// reported and handled by the contract policies.
+func ReconcileJudgements(id string, result *logformat.File, impressions []string, options ContractOptions, report *ReconcileReport) (map[string]Judgement, error) {
+	logged := make(map[string]bool, len(impressions))
+	for _, impression := range impressions {
+		logged[impression] = true
+	}
+	reconcile := &AntiCheatReconcile{}
+	report.AntiCheats[id] = reconcile
+
+	duplicatePolicy := DuplicateJudgementPolicy(options)
+	scale := JudgementScale(options)
+	judgements := make(map[string]Judgement, len(result.Records))
+	for _, record := range result.Records {
+		judgement, err := ToJudgement(record, scale)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", id, err)
+		}
+		if !logged[record.ID] {
+			reconcile.Extra = append(reconcile.Extra, record.ID)
+			continue
+		}
+		if _, ok := judgements[record.ID]; ok {
+			reconcile.Duplicates = append(reconcile.Duplicates, record.ID)
+			if duplicatePolicy != POLICY_LAST {
+				continue
+			}
+		}
+		judgements[record.ID] = judgement
+	}
+	for _, impression := range impressions {
+		if _, ok := judgements[impression]; !ok {
+			reconcile.Missing = append(reconcile.Missing, impression)
+		}
+	}
+
+	if len(reconcile.Extra) > 0 && ExtraJudgementPolicy(options) == POLICY_REJECT {
+		return nil, fmt.Errorf("%s judged %d impressions not in the media log, first %s", id, len(reconcile.Extra), reconcile.Extra[0])
+	}
+	if len(reconcile.Duplicates) > 0 && duplicatePolicy == POLICY_REJECT {
+		return nil, fmt.Errorf("%s judged %d impressions more than once, first %s", id, len(reconcile.Duplicates), reconcile.Duplicates[0])
+	}
+	if len(reconcile.Missing) > 0 && MissingJudgementPolicy(options) == POLICY_REJECT {
+		return nil, fmt.Errorf("%s has no judgement for %d impressions, first %s", id, len(reconcile.Missing), reconcile.Missing[0])
+	}
+	return judgements, nil
+}
@@ -0,0 +1,189 @@
+package settlement
+
+import (
+	"strings"
+	"testing"
+
+	"chaincodedev/chaincode/liqi/hwxf/logformat"
+)
+
+func parse(t *testing.T, data string) *logformat.File {
+	f, err := logformat.Parse([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestReconcileImpressions(t *testing.T) {
+	log := parse(t, "#hwxf v2 tsv\nimp-1\nimp-2\nimp-1\nimp-3\n")
+	tests := []struct {
+		name    string
+		policy  string
+		want    string
+		wantErr string
+	}{
+		{name: "duplicates rejected by default", wantErr: "1 duplicate impression ids, first imp-1"},
+		{name: "first kept", policy: POLICY_FIRST, want: "imp-1 imp-2 imp-3"},
+		{name: "last kept", policy: POLICY_LAST, want: "imp-1 imp-2 imp-3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := ReconcileReport{}
+			impressions, err := ReconcileImpressions(log, ContractOptions{DuplicateJudgement: tt.policy}, &report)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(impressions, " "); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+			if report.ImpressionCount != 3 || len(report.DuplicateImpressions) != 1 {
+				t.Fatalf("got report %+v", report)
+			}
+		})
+	}
+}
+
+func TestReconcileJudgements(t *testing.T) {
+	impressions := []string{"imp-1", "imp-2", "imp-3"}
+	tests := []struct {
+		name       string
+		result     string
+		options    ContractOptions
+		want       map[string]float64
+		missing    int
+		extra      int
+		duplicates int
+		wantErr    string
+	}{
+		{
+			name:   "joined by id, not by line",
+			result: "#hwxf v2 tsv\nimp-3\t-1\nimp-1\t1\nimp-2\t0.5\n",
+			want:   map[string]float64{"imp-1": 1, "imp-2": 0.5, "imp-3": -1},
+		},
+		{
+			name:    "missing counted by default",
+			result:  "#hwxf v2 tsv\nimp-1\t1\n",
+			want:    map[string]float64{"imp-1": 1},
+			missing: 2,
+		},
+		{
+			name:    "missing rejected",
+			result:  "#hwxf v2 tsv\nimp-1\t1\n",
+			options: ContractOptions{MissingJudgement: POLICY_REJECT},
+			wantErr: "no judgement for 2 impressions, first imp-2",
+		},
+		{
+			name:   "extra ignored by default",
+			result: "#hwxf v2 tsv\nimp-1\t1\nimp-2\t1\nimp-3\t1\nimp-9\t-1\n",
+			want:   map[string]float64{"imp-1": 1, "imp-2": 1, "imp-3": 1},
+			extra:  1,
+		},
+		{
+			name:    "extra rejected",
+			result:  "#hwxf v2 tsv\nimp-1\t1\nimp-2\t1\nimp-3\t1\nimp-9\t-1\n",
+			options: ContractOptions{ExtraJudgement: POLICY_REJECT},
+			wantErr: "1 impressions not in the media log, first imp-9",
+		},
+		{
+			name:    "duplicates rejected by default",
+			result:  "#hwxf v2 tsv\nimp-1\t1\nimp-1\t-1\nimp-2\t1\nimp-3\t1\n",
+			wantErr: "more than once, first imp-1",
+		},
+		{
+			name:       "first duplicate kept",
+			result:     "#hwxf v2 tsv\nimp-1\t1\nimp-1\t-1\nimp-2\t1\nimp-3\t1\n",
+			options:    ContractOptions{DuplicateJudgement: POLICY_FIRST},
+			want:       map[string]float64{"imp-1": 1, "imp-2": 1, "imp-3": 1},
+			duplicates: 1,
+		},
+		{
+			name:       "last duplicate kept",
+			result:     "#hwxf v2 tsv\nimp-1\t1\nimp-1\t-1\nimp-2\t1\nimp-3\t1\n",
+			options:    ContractOptions{DuplicateJudgement: POLICY_LAST},
+			want:       map[string]float64{"imp-1": -1, "imp-2": 1, "imp-3": 1},
+			duplicates: 1,
+		},
+		{
+			name:    "probability scale",
+			result:  "#hwxf v2 tsv\nimp-1\t0\nimp-2\t0.75\nimp-3\t1\n",
+			options: ContractOptions{JudgementScale: SCALE_PROBABILITY},
+			want:    map[string]float64{"imp-1": 1, "imp-2": -0.5, "imp-3": -1},
+		},
+		{
+			name:    "score out of scale",
+			result:  "#hwxf v2 tsv\nimp-1\t2\n",
+			wantErr: "ac1: line 2: score 2 of imp-1 out of [-1,1]",
+		},
+		{
+			name:    "media log is not a result",
+			result:  "#hwxf v2 tsv\nimp-1\n",
+			wantErr: "no score for imp-1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := ReconcileReport{AntiCheats: make(map[string]*AntiCheatReconcile)}
+			judgements, err := ReconcileJudgements("ac1", parse(t, tt.result), impressions, tt.options, &report)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(judgements) != len(tt.want) {
+				t.Fatalf("got %v, want %v", judgements, tt.want)
+			}
+			for id, score := range tt.want {
+				if judgements[id].Score != score {
+					t.Fatalf("got %v, want %v", judgements, tt.want)
+				}
+			}
+			r := report.AntiCheats["ac1"]
+			if len(r.Missing) != tt.missing || len(r.Extra) != tt.extra || len(r.Duplicates) != tt.duplicates {
+				t.Fatalf("got report %+v", r)
+			}
+		})
+	}
+}
+
+func TestParseContractOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string
+	}{
+		{name: "defaults"},
+		{name: "all set", json: `{"MissingJudgement":"abstain","ExtraJudgement":"reject","DuplicateJudgement":"last","JudgementScale":"probability","AllAbstain":"fake","Aggregator":"quorum","QuorumK":2,"TieBreak":"exclude"}`},
+		{name: "not json", json: "{", wantErr: "contract options format error"},
+		{name: "unknown policy", json: `{"MissingJudgement":"ignore"}`, wantErr: "MissingJudgement policy must be one of"},
+		{name: "unknown aggregator", json: `{"Aggregator":"median"}`, wantErr: "Aggregator policy must be one of"},
+		{name: "quorum without k", json: `{"Aggregator":"quorum"}`, wantErr: "QuorumK 0 must be set"},
+		{name: "k without quorum", json: `{"QuorumK":1}`, wantErr: "QuorumK 1 must be set"},
+		{name: "empty active window", json: `{"ActiveFrom":10,"ActiveTo":10}`, wantErr: "active window"},
+		{name: "negative reveal window", json: `{"RevealWindow":-1}`, wantErr: "must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseContractOptions(tt.json)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+// Package settlement computes the outcome of a judged log chunk: it
+// reconciles the media log with the anticheat results and tallies the
+// judgements. It does no I/O, so the off-chain settlement worker and the
+// chaincode agree on the numbers as long as they read the same files.
+package settlement
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"chaincodedev/chaincode/liqi/hwxf/logformat"
+	"chaincodedev/chaincode/liqi/hwxf/payload"
+)
+
+// Settle reconciles and tallies a chunk. results are the anticheat result
+// files in the order of contract.AntiCheatIds, nil for an anticheat that
+// defaulted on the chunk. credits are the anticheat credits recorded when
+// the chunk was judged, only the credit aggregator reads them.
+func Settle(contract payload.Contract, log payload.Log, mediaLog *logformat.File, results []*logformat.File, credits map[string]float64) (Tally, ReconcileReport, error) {
+	antiCheatIds := contract.AntiCheatIds
+	report := ReconcileReport{AntiCheats: make(map[string]*AntiCheatReconcile, len(antiCheatIds))}
+	if len(results) != len(antiCheatIds) {
+		return Tally{}, report, fmt.Errorf("%d anticheat results for %d anticheats", len(results), len(antiCheatIds))
+	}
+	if err := CheckOptions(contract); err != nil {
+		return Tally{}, report, err
+	}
+	weights := make([]float64, len(antiCheatIds))
+	if AggregatorName(contract.Options) == AGGREGATOR_CREDIT {
+		for i, id := range antiCheatIds {
+			//a negative credit gives no say
+			weights[i] = math.Max(credits[id], 0)
+		}
+	} else {
+		//transfer string into float64
+		for i, p := range contract.AntiCheatPriority {
+			var err error
+			weights[i], err = strconv.ParseFloat(p, 64)
+			if err != nil {
+				return Tally{}, report, fmt.Errorf("anticheat priority format error: %s", p)
+			}
+		}
+	}
+	impressions, err := ReconcileImpressions(mediaLog, contract.Options, &report)
+	if err != nil {
+		return Tally{}, report, err
+	}
+	if len(impressions) != log.ImpressionCount {
+		return Tally{}, report, fmt.Errorf("media log has %d impressions, submitted %d", len(impressions), log.ImpressionCount)
+	}
+	judgements := make([]map[string]Judgement, len(antiCheatIds))
+	for i, id := range antiCheatIds {
+		if results[i] == nil {
+			continue
+		}
+		judgements[i], err = ReconcileJudgements(id, results[i], impressions, contract.Options, &report)
+		if err != nil {
+			return Tally{}, report, err
+		}
+	}
+	tally, err := TallyJudgements(impressions, antiCheatIds, judgements, weights, contract.Options)
+	return tally, report, err
+}
+
+// Attestation is what an oracle computed off-chain for a judged chunk.
+// It names the exact files it was computed from by their committed digests.
+type Attestation struct {
+	LogId         string
+	Revision      int
+	LogDigest     string
+	ResultDigests map[string]string // anticheat id to result digest, without the defaulted anticheats
+	Tally         Tally
+	Report        ReconcileReport
+}
+
+// Encode returns the bytes an oracle signs. The attestation is carried as
+// its JSON, whose map keys encoding/json sorts, so equal attestations encode
+// to equal bytes.
+func (a Attestation) Encode(d payload.Domain) []byte {
+	body, _ := json.Marshal(a)
+	return payload.NewEncoder(d, payload.TYPE_ATTESTATION).String(string(body)).Bytes()
+}
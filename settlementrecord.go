@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"chaincodedev/chaincode/liqi/hwxf/settlement"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// SettlementRecord keeps what the settlement of a contract was computed
+// from and what it changed, stored at contractId+"_settlement"
+type SettlementRecord struct {
+	ContractId     string
+	ContractDigest string // payload.Digest of the signed contract payload
+	Chunks         []ChunkSettlement
+	Tally          settlement.Tally // sum of the chunk tallies
+	RealRate       float64
+	Threshold      float64
+	MediaPaid      bool
+	AntiCheatShare []float64      // share of PaymentAmountAntiCheat of each anticheat, in contract order
+	CreditChange   []float64      // credit change of each anticheat from calculateCredit
+	Postings       []Posting      // credit changes
+	Transfers      []JournalEntry // money moved out of the escrow
+	TxId           string         // transaction that paid out the contract
+	TimeStamp      int64
+	Finalized      bool
+	PlatformFee    string // paid to FeeAccount
+	FeeAccount     string
+	HeldUntil      int64 // end of the dispute window, 0 if the payouts were not held
+	Released       bool  // the held payouts went to their payees
+	Refunded       bool  // no impression could be judged, the escrows went back to the advertiser
+}
+
+// ChunkSettlement is the settled attestation of one chunk
+type ChunkSettlement struct {
+	LogId             string
+	Revision          int
+	LogDigest         string
+	ResultDigests     map[string]string
+	Defaulted         []string
+	AttestationDigest string
+	Oracles           []string // oracles that signed the attestation
+	Tally             settlement.Tally
+	TxId              string
+	TimeStamp         int64
+}
+
+// Posting is one change the settlement made to an account field
+type Posting struct {
+	AccountId string
+	Field     string // Credit
+	Before    string
+	After     string
+	Amount    float64
+	Reason    string
+}
+
+func getSettlementRecord(stub shim.ChaincodeStubInterface, contractId string) (*SettlementRecord, error) {
+	recordAsBytes, err := stub.GetState(contractId + "_settlement")
+	if err != nil {
+		return nil, err
+	}
+	if recordAsBytes == nil {
+		return &SettlementRecord{ContractId: contractId}, nil
+	}
+	var record SettlementRecord
+	err = json.Unmarshal(recordAsBytes, &record)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// putSettlementRecord stores record and returns it as JSON
+func putSettlementRecord(stub shim.ChaincodeStubInterface, record *SettlementRecord) (string, error) {
+	recordAsBytes, _ := json.Marshal(record)
+	err := stub.PutState(record.ContractId+"_settlement", recordAsBytes)
+	if err != nil {
+		return "", err
+	}
+	return string(recordAsBytes), nil
+}
+
+func getSettlementRecordJson(stub shim.ChaincodeStubInterface, contractId string) (string, error) {
+	recordAsBytes, err := stub.GetState(contractId + "_settlement")
+	if err != nil {
+		return "", err
+	}
+	return string(recordAsBytes), nil
+}
+
+// payee is where a payout of the settlement goes, held in escrow while it may be disputed
+func (r *SettlementRecord) payee(account string) string {
+	if r.HeldUntil == 0 || r.Released {
+		return account
+	}
+	return heldAccount(r.ContractId, account)
+}
+
+// post records a change of field of an account from before to after, both as stored
+func (r *SettlementRecord) post(accountId string, field string, before string, after string, reason string) {
+	b, _ := strconv.ParseFloat(before, 64)
+	a, _ := strconv.ParseFloat(after, 64)
+	r.Postings = append(r.Postings, Posting{AccountId: accountId, Field: field, Before: before, After: after, Amount: a - b, Reason: reason})
+}
+
+// getSettlement returns the settlement record of a contract, only the
+// parties of the contract may query it
+// args[0]: contractId
+func getSettlement(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("Incorrect arguments. Expecting 1 argument")
+	}
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return "", fmt.Errorf("could not get ID: %w", err)
+	}
+	sc, err := getSignatureContract(stub, args[0])
+	if err != nil {
+		return "", err
+	}
+	if !isContractParty(sc.Contract, id) {
+		return "", fmt.Errorf("%s is not a party of contract %s", id, args[0])
+	}
+	return getSettlementRecordJson(stub, args[0])
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strconv"
+
+	"chaincodedev/chaincode/liqi/hwxf/payload"
+	"chaincodedev/chaincode/liqi/hwxf/signing"
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	ALGORITHM_ECDSA_P256 = signing.ALGORITHM_ECDSA_P256
+	ALGORITHM_ED25519    = signing.ALGORITHM_ED25519
+	ALGORITHM_SM2        = signing.ALGORITHM_SM2
+	ALGORITHM_X509       = "X509"
+
+	SIGNATURE_TIME_SKEW = 300 // how far the time stamp of a signed payload may be from the transaction time, seconds
+)
+
+// checkAlgorithm returns an error unless accounts can be created with algorithm
+func checkAlgorithm(algorithm string) error {
+	if algorithm == ALGORITHM_X509 {
+		return nil
+	}
+	_, err := signing.Lookup(algorithm)
+	return err
+}
+
+// Approval records that the creator of transaction TxId approved a payload
+// for an account bound to its X.509 identity. It is no signature: what binds
+// the creator to the payload is its signature of the transaction, which the
+// approval names.
+type Approval struct {
+	Certificate string // PEM of the creator certificate, the PublicKey of the account
+	Digest      string // payload.Digest of the approved payload
+	TxId        string
+	TimeStamp   int64
+}
+
+// acceptSignature checks the hex encoded signature of account id over msg,
+// made off the chain with the private key of the account, and returns it.
+// Accounts bound to their X.509 identity pass no signature, the transaction
+// creator, who must hold the bound certificate, approves msg instead.
+func acceptSignature(stub shim.ChaincodeStubInterface, id string, msg []byte, signature string) ([]byte, *Approval, error) {
+	account, err := getAccountInfo(stub, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if account.Algorithm == ALGORITHM_X509 {
+		if signature != "" {
+			return nil, nil, fmt.Errorf("account %s is bound to its X509 identity, expecting no signature", id)
+		}
+		creator, err := getCreatorCertificate(stub)
+		if err != nil {
+			return nil, nil, err
+		}
+		if creator != account.PublicKey {
+			return nil, nil, fmt.Errorf("creator certificate is not the one bound to account %s", id)
+		}
+		now, err := getTxTime(stub)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, &Approval{Certificate: creator, Digest: payload.Digest(msg), TxId: stub.GetTxID(), TimeStamp: now}, nil
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil || len(sig) == 0 {
+		return nil, nil, fmt.Errorf("signature format error: %s", signature)
+	}
+	err = verifyWithAccount(stub, id, msg, sig, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sig, nil, nil
+}
+
+// parseSignedTime reads the time stamp a client put in the payload it
+// signed, which must be close to the transaction time
+func parseSignedTime(stub shim.ChaincodeStubInterface, timeStamp string) (int64, error) {
+	t, err := strconv.ParseInt(timeStamp, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("time stamp format error: %s", timeStamp)
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return 0, err
+	}
+	if t < now-SIGNATURE_TIME_SKEW || t > now+SIGNATURE_TIME_SKEW {
+		return 0, fmt.Errorf("time stamp %d is more than %d seconds from the transaction time %d", t, SIGNATURE_TIME_SKEW, now)
+	}
+	return t, nil
+}
+
+// getCreatorCertificate returns the PEM encoded X.509 certificate of the transaction creator
+func getCreatorCertificate(stub shim.ChaincodeStubInterface) (string, error) {
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return "", fmt.Errorf("Could not Get X509 Certificate, err %s", err)
+	}
+	if cert == nil {
+		return "", fmt.Errorf("creator has no X509 certificate")
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})), nil
+}
+
+// verifyWithAccount checks sig over msg against the public key and algorithm
+// of account id, or for an account bound to its X.509 identity that approval
+// is of msg by the bound certificate
+func verifyWithAccount(stub shim.ChaincodeStubInterface, id string, msg []byte, sig []byte, approval *Approval) error {
+	account, err := getAccountInfo(stub, id)
+	if err != nil {
+		return err
+	}
+	if account.Algorithm == ALGORITHM_X509 {
+		if approval == nil || approval.Certificate != account.PublicKey || approval.Digest != payload.Digest(msg) {
+			return fmt.Errorf("verify approval of id %s failed", id)
+		}
+		return nil
+	}
+	valid, err := signing.Verify(account.Algorithm, msg, sig, account.PublicKey)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return fmt.Errorf("verify id %s failed", id)
+	}
+	return nil
+}
+
+// getSigningDomain returns the channel and chaincode name mixed into every signed payload
+func getSigningDomain(stub shim.ChaincodeStubInterface) (payload.Domain, error) {
+	var domain payload.Domain
+	domain.ChannelID = stub.GetChannelID()
+
+	sp, err := stub.GetSignedProposal()
+	if err != nil {
+		return domain, err
+	}
+	var proposal peer.Proposal
+	if err := proto.Unmarshal(sp.ProposalBytes, &proposal); err != nil {
+		return domain, err
+	}
+	var cpp peer.ChaincodeProposalPayload
+	if err := proto.Unmarshal(proposal.Payload, &cpp); err != nil {
+		return domain, err
+	}
+	var cis peer.ChaincodeInvocationSpec
+	if err := proto.Unmarshal(cpp.Input, &cis); err != nil {
+		return domain, err
+	}
+	domain.ChaincodeName = cis.GetChaincodeSpec().GetChaincodeId().GetName()
+	if domain.ChannelID == "" || domain.ChaincodeName == "" {
+		return domain, fmt.Errorf("could not determine channel and chaincode name")
+	}
+	return domain, nil
+}
+
+func getContractPayload(stub shim.ChaincodeStubInterface, contract Contract) ([]byte, error) {
+	domain, err := getSigningDomain(stub)
+	if err != nil {
+		return nil, err
+	}
+	return contract.Encode(domain), nil
+}
+
+func getLogPayload(stub shim.ChaincodeStubInterface, log Log) ([]byte, error) {
+	domain, err := getSigningDomain(stub)
+	if err != nil {
+		return nil, err
+	}
+	return log.Encode(domain), nil
+}
+
+// verifyAllSignatures checks every signature and approval collected in cs over msg
+func verifyAllSignatures(stub shim.ChaincodeStubInterface, msg []byte, cs ContractSignature) error {
+	for id, sig := range cs.Signature {
+		if err := verifyWithAccount(stub, id, msg, sig, nil); err != nil {
+			return err
+		}
+	}
+	for id, approval := range cs.Approvals {
+		approval := approval
+		if err := verifyWithAccount(stub, id, msg, nil, &approval); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+// Package signing signs and verifies payload bytes with the keys of ledger
+// accounts. Parties sign off the chain with their own private key and submit
+// the hex encoded signature, the chaincode only verifies it: a private key
+// never travels in a transaction and every endorser computes the same result.
+//
+// Keys are PEM strings, the same way Account.PublicKey is stored.
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+
+	smx509 "github.com/tjfoc/gmsm/x509"
+)
+
+const (
+	ALGORITHM_ECDSA_P256 = "ECDSA-P256"
+	ALGORITHM_ED25519    = "ED25519"
+	ALGORITHM_SM2        = "SM2"
+)
+
+// Scheme signs and verifies payloads for one algorithm
+type Scheme interface {
+	Sign(msg []byte, privateKey string) ([]byte, error)
+	Verify(msg []byte, sig []byte, publicKey string) (bool, error)
+}
+
+var schemes = map[string]Scheme{
+	ALGORITHM_ECDSA_P256: ecdsaScheme{},
+	ALGORITHM_ED25519:    ed25519Scheme{},
+	ALGORITHM_SM2:        sm2Scheme{},
+}
+
+// Lookup returns the scheme of algorithm. Accounts created before
+// Account.Algorithm existed have it empty and use ECDSA P-256.
+func Lookup(algorithm string) (Scheme, error) {
+	if algorithm == "" {
+		algorithm = ALGORITHM_ECDSA_P256
+	}
+	scheme, ok := schemes[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signature algorithm: %s", algorithm)
+	}
+	return scheme, nil
+}
+
+// Sign signs msg with privateKey, for clients
+func Sign(algorithm string, msg []byte, privateKey string) ([]byte, error) {
+	scheme, err := Lookup(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return scheme.Sign(msg, privateKey)
+}
+
+// Verify checks sig over msg against publicKey
+func Verify(algorithm string, msg []byte, sig []byte, publicKey string) (bool, error) {
+	scheme, err := Lookup(algorithm)
+	if err != nil {
+		return false, err
+	}
+	return scheme.Verify(msg, sig, publicKey)
+}
+
+func decodePem(key string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, fmt.Errorf("key is not PEM encoded")
+	}
+	return block.Bytes, nil
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// ecdsaScheme signs the SHA-256 digest with low-S normalization, the same as Fabric's BCCSP
+type ecdsaScheme struct{}
+
+func (ecdsaScheme) Sign(msg []byte, privateKey string) ([]byte, error) {
+	der, err := decodePem(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParseECPrivateKey(der)
+	if err != nil {
+		k, err2 := x509.ParsePKCS8PrivateKey(der)
+		if err2 != nil {
+			return nil, err
+		}
+		var ok bool
+		if key, ok = k.(*ecdsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("private key is not an ECDSA key")
+		}
+	}
+	if key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("private key is not on curve P-256")
+	}
+	digest := sha256.Sum256(msg)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	halfOrder := new(big.Int).Rsh(key.Params().N, 1)
+	if s.Cmp(halfOrder) > 0 {
+		s.Sub(key.Params().N, s)
+	}
+	return asn1.Marshal(ecdsaSignature{r, s})
+}
+
+func (ecdsaScheme) Verify(msg []byte, sig []byte, publicKey string) (bool, error) {
+	der, err := decodePem(publicKey)
+	if err != nil {
+		return false, err
+	}
+	k, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return false, err
+	}
+	key, ok := k.(*ecdsa.PublicKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return false, fmt.Errorf("public key is not an ECDSA P-256 key")
+	}
+	var es ecdsaSignature
+	if _, err := asn1.Unmarshal(sig, &es); err != nil {
+		return false, err
+	}
+	if es.R == nil || es.S == nil || es.R.Sign() <= 0 || es.S.Sign() <= 0 {
+		return false, fmt.Errorf("invalid ECDSA signature")
+	}
+	digest := sha256.Sum256(msg)
+	return ecdsa.Verify(key, digest[:], es.R, es.S), nil
+}
+
+type ed25519Scheme struct{}
+
+func (ed25519Scheme) Sign(msg []byte, privateKey string) ([]byte, error) {
+	der, err := decodePem(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	k, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an Ed25519 key")
+	}
+	return ed25519.Sign(key, msg), nil
+}
+
+func (ed25519Scheme) Verify(msg []byte, sig []byte, publicKey string) (bool, error) {
+	der, err := decodePem(publicKey)
+	if err != nil {
+		return false, err
+	}
+	k, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return false, err
+	}
+	key, ok := k.(ed25519.PublicKey)
+	if !ok {
+		return false, fmt.Errorf("public key is not an Ed25519 key")
+	}
+	return ed25519.Verify(key, msg, sig), nil
+}
+
+// sm2Scheme follows GB/T 32918: SM3 digest over Z(A) and msg with the default user id
+type sm2Scheme struct{}
+
+func (sm2Scheme) Sign(msg []byte, privateKey string) ([]byte, error) {
+	key, err := smx509.ReadPrivateKeyFromPem([]byte(privateKey), nil)
+	if err != nil {
+		return nil, err
+	}
+	return key.Sign(rand.Reader, msg, nil)
+}
+
+func (sm2Scheme) Verify(msg []byte, sig []byte, publicKey string) (bool, error) {
+	key, err := smx509.ReadPublicKeyFromPem([]byte(publicKey))
+	if err != nil {
+		return false, err
+	}
+	return key.Verify(msg, sig), nil
+}
@@ -0,0 +1,136 @@
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// ecdsaKeys returns an ECDSA key pair on curve as PEM strings
+func ecdsaKeys(t *testing.T, curve elliptic.Curve) (string, string) {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encode("EC PRIVATE KEY", der), encode("PUBLIC KEY", pub)
+}
+
+// ed25519Keys returns an Ed25519 key pair as PEM strings
+func ed25519Keys(t *testing.T) (string, string) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDer, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encode("PRIVATE KEY", der), encode("PUBLIC KEY", pubDer)
+}
+
+func encode(typ string, der []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}))
+}
+
+// SM2 is left out, its keys need the gmsm build of the peer
+func TestSignVerify(t *testing.T) {
+	ecdsaKey, ecdsaPub := ecdsaKeys(t, elliptic.P256())
+	_, otherPub := ecdsaKeys(t, elliptic.P256())
+	p384Key, _ := ecdsaKeys(t, elliptic.P384())
+	ed25519Key, ed25519Pub := ed25519Keys(t)
+	_, otherEd25519Pub := ed25519Keys(t)
+	msg := []byte("contract payload")
+
+	tests := []struct {
+		name       string
+		algorithm  string
+		privateKey string
+		publicKey  string
+		verified   []byte // message verified, msg if nil
+		want       bool
+		wantErr    string
+	}{
+		{name: "ecdsa", algorithm: ALGORITHM_ECDSA_P256, privateKey: ecdsaKey, publicKey: ecdsaPub, want: true},
+		{name: "empty algorithm is ecdsa", privateKey: ecdsaKey, publicKey: ecdsaPub, want: true},
+		{name: "ecdsa tampered message", algorithm: ALGORITHM_ECDSA_P256, privateKey: ecdsaKey, publicKey: ecdsaPub, verified: []byte("contract payloae")},
+		{name: "ecdsa wrong key", algorithm: ALGORITHM_ECDSA_P256, privateKey: ecdsaKey, publicKey: otherPub},
+		{name: "ecdsa with an ed25519 key", algorithm: ALGORITHM_ECDSA_P256, privateKey: ecdsaKey, publicKey: ed25519Pub, wantErr: "not an ECDSA P-256 key"},
+		{name: "ecdsa P-384 key", algorithm: ALGORITHM_ECDSA_P256, privateKey: p384Key, wantErr: "not on curve P-256"},
+		{name: "ed25519", algorithm: ALGORITHM_ED25519, privateKey: ed25519Key, publicKey: ed25519Pub, want: true},
+		{name: "ed25519 tampered message", algorithm: ALGORITHM_ED25519, privateKey: ed25519Key, publicKey: ed25519Pub, verified: []byte("contract payloae")},
+		{name: "ed25519 wrong key", algorithm: ALGORITHM_ED25519, privateKey: ed25519Key, publicKey: otherEd25519Pub},
+		{name: "ed25519 with an ecdsa key", algorithm: ALGORITHM_ED25519, privateKey: ed25519Key, publicKey: ecdsaPub, wantErr: "not an Ed25519 key"},
+		{name: "unknown algorithm", algorithm: "RSA", privateKey: ecdsaKey, wantErr: "unsupported signature algorithm"},
+		{name: "key not PEM", algorithm: ALGORITHM_ECDSA_P256, privateKey: "key", wantErr: "not PEM encoded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig, err := Sign(tt.algorithm, msg, tt.privateKey)
+			if err == nil {
+				verified := tt.verified
+				if verified == nil {
+					verified = msg
+				}
+				var ok bool
+				ok, err = Verify(tt.algorithm, verified, sig, tt.publicKey)
+				if err == nil && ok != tt.want {
+					t.Fatalf("got %v, want %v", ok, tt.want)
+				}
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// Signatures with a high S are malleable, Sign only makes low S ones
+func TestECDSALowS(t *testing.T) {
+	key, _ := ecdsaKeys(t, elliptic.P256())
+	halfOrder := new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+	for i := 0; i < 32; i++ {
+		sig, err := Sign(ALGORITHM_ECDSA_P256, []byte{byte(i)}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var es ecdsaSignature
+		if _, err := asn1.Unmarshal(sig, &es); err != nil {
+			t.Fatal(err)
+		}
+		if es.S.Cmp(halfOrder) > 0 {
+			t.Fatalf("signature %d has a high S", i)
+		}
+	}
+}
+
+func TestECDSARejectsGarbage(t *testing.T) {
+	_, pub := ecdsaKeys(t, elliptic.P256())
+	if _, err := Verify(ALGORITHM_ECDSA_P256, []byte("msg"), []byte("not der"), pub); err == nil {
+		t.Fatal("verified a signature that is not DER")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"chaincodedev/chaincode/liqi/hwxf/payload"
+	"chaincodedev/chaincode/liqi/hwxf/settlement"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// where the tally of a simulated chunk comes from
+const (
+	SOURCE_SETTLED  = "settled"  // the chunk is settled
+	SOURCE_ATTESTED = "attested" // oracles attested the chunk, short of the quorum
+)
+
+type SimulatedChunk struct {
+	Index     int
+	Source    string
+	Tally     settlement.Tally
+	Defaulted []string // anticheats without a judgement in the simulation
+}
+
+// SettlementSimulation is what settling the contract now would do. Pending
+// lists the chunks neither settled nor attested, the simulation leaves them
+// out and the settlement worker tallies them off-chain. Record is empty if
+// every chunk is pending.
+type SettlementSimulation struct {
+	ContractId string
+	Chunks     []SimulatedChunk
+	Pending    []int
+	Record     SettlementRecord
+}
+
+// attestedTally returns the tally most current oracles attested for the
+// current revision of a judged chunk, the first in oracle order on a tie.
+// It returns "" as source if no oracle attested it.
+func attestedTally(stub shim.ChaincodeStubInterface, governance Governance, logId string, contract Contract) (SimulatedChunk, error) {
+	var chunk SimulatedChunk
+	mediaLogSubmit, err := getMediaLogSubmit(stub, logId)
+	if err != nil || !mediaLogSubmit.Judged {
+		//not submitted or not judged yet
+		return chunk, nil
+	}
+	attestations, err := getAttestations(stub, logId)
+	if err != nil {
+		return chunk, err
+	}
+	oracleIds := make([]string, 0, len(attestations))
+	for oracleId := range attestations {
+		oracleIds = append(oracleIds, oracleId)
+	}
+	sort.Strings(oracleIds)
+	votes := make(map[string]int)
+	best := ""
+	for _, oracleId := range oracleIds {
+		a := attestations[oracleId]
+		if !governance.isOracle(oracleId) || checkAttestation(a.Attestation, contract, mediaLogSubmit) != nil {
+			continue
+		}
+		attestationPayload, err := getAttestationPayload(stub, a.Attestation)
+		if err != nil {
+			return chunk, err
+		}
+		if payload.Digest(attestationPayload) != a.Digest {
+			continue
+		}
+		if verifyWithAccount(stub, oracleId, attestationPayload, a.Signature, a.Approval) != nil {
+			continue
+		}
+		votes[a.Digest]++
+		if best == "" || votes[a.Digest] > votes[best] {
+			best = a.Digest
+			chunk = SimulatedChunk{Source: SOURCE_ATTESTED, Tally: a.Attestation.Tally, Defaulted: mediaLogSubmit.Defaulted}
+		}
+	}
+	return chunk, nil
+}
+
+// simulateSettlement runs the payout of settleChunk over an overlay, so no
+// state is written, on the tallies of the settled chunks and of those the
+// oracles attested short of the quorum. It reads nothing but the state,
+// tallying the other chunks is left to the settlement worker. Only the
+// parties of the contract and the admins may query it.
+// args[0]: contractId
+func simulateSettlement(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("Incorrect arguments. Expecting 1 value")
+	}
+	contractId := args[0]
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return "", fmt.Errorf("could not get ID: %w", err)
+	}
+	governance, err := getGovernanceInfo(stub)
+	if err != nil {
+		return "", err
+	}
+	sc, err := getSignatureContract(stub, contractId)
+	if err != nil {
+		return "", err
+	}
+	if !isContractParty(sc.Contract, id) && !governance.isAdmin(id) {
+		return "", fmt.Errorf("%s may not simulate the settlement of contract %s", id, contractId)
+	}
+	progress, err := getChunkProgress(stub, contractId)
+	if err != nil {
+		return "", err
+	}
+	if progress == nil {
+		return "", fmt.Errorf("no chunk submitted for contract %s", contractId)
+	}
+	settled, err := getSettlementRecord(stub, contractId)
+	if err != nil {
+		return "", err
+	}
+	if settled.Finalized {
+		return "", fmt.Errorf("contract %s is settled, see getSettlement", contractId)
+	}
+	simulation := SettlementSimulation{ContractId: contractId}
+	var total settlement.Tally
+	for i := 0; i < progress.ChunkCount; i++ {
+		logId := getLogId(contractId, i)
+		chunk := SimulatedChunk{}
+		for _, c := range settled.Chunks {
+			if c.LogId == logId {
+				chunk = SimulatedChunk{Source: SOURCE_SETTLED, Tally: c.Tally, Defaulted: c.Defaulted}
+			}
+		}
+		if chunk.Source == "" {
+			chunk, err = attestedTally(stub, governance, logId, sc.Contract)
+			if err != nil {
+				return "", err
+			}
+		}
+		if chunk.Source == "" {
+			simulation.Pending = append(simulation.Pending, i)
+			continue
+		}
+		chunk.Index = i
+		total.Add(chunk.Tally)
+		simulation.Chunks = append(simulation.Chunks, chunk)
+	}
+	if len(simulation.Chunks) == 0 {
+		//nothing to pay out on yet
+		simulationAsBytes, _ := json.Marshal(simulation)
+		return string(simulationAsBytes), nil
+	}
+
+	//the payout of settleChunk, on writes that are thrown away
+	overlay := newOverlayStub(stub)
+	now, err := getTxTime(stub)
+	if err != nil {
+		return "", err
+	}
+	record := &SettlementRecord{ContractId: contractId, Tally: total, TimeStamp: now}
+	if governance.DisputeWindow > 0 {
+		record.HeldUntil = now + governance.DisputeWindow
+	}
+	j, err := newJournal(overlay)
+	if err != nil {
+		return "", err
+	}
+	err = payOut(overlay, governance, contractId, sc.Contract, total, record, j)
+	if err != nil {
+		return "", err
+	}
+	err = j.commit()
+	if err != nil {
+		return "", err
+	}
+	record.Transfers = j.entries
+	simulation.Record = *record
+	simulationAsBytes, _ := json.Marshal(simulation)
+	return string(simulationAsBytes), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// The simulation pays out on the settled and attested chunks only, the
+// others are left pending for the settlement worker to tally
+func TestSimulateSettlement(t *testing.T) {
+	f := newFixture(t, func(f *fixture, g *Governance) {
+		g.Oracles = []string{f.id("oracle"), f.id("fee")}
+		g.OracleQuorum = 2
+	})
+	contractId := f.contract(ContractOptions{})
+	logIds := []string{f.submit(contractId, 0, 2, testMediaLog), f.submit(contractId, 1, 2, testMediaLog)}
+	simulate := func() SettlementSimulation {
+		var simulation SettlementSimulation
+		if err := json.Unmarshal([]byte(f.must("media", "simulateSettlement", contractId)), &simulation); err != nil {
+			t.Fatal(err)
+		}
+		return simulation
+	}
+
+	simulation := simulate()
+	if len(simulation.Chunks) != 0 || len(simulation.Pending) != 2 || simulation.Record.ContractId != "" {
+		t.Fatalf("got %+v before any attestation", simulation)
+	}
+	f.fails("may not simulate", "oracle", "simulateSettlement", contractId)
+	f.fails("Expecting 1 value", "media", "simulateSettlement", contractId, `{"0":{}}`)
+
+	//judged and attested by one oracle of two
+	f.judge(logIds[0], testAllReal, testHalfFake)
+	f.attest(f.attestation(logIds[0], testMediaLog, map[string]string{"ac1": testAllReal, "ac2": testHalfFake}))
+	simulation = simulate()
+	if len(simulation.Chunks) != 1 || simulation.Chunks[0].Source != SOURCE_ATTESTED || len(simulation.Pending) != 1 || simulation.Pending[0] != 1 {
+		t.Fatalf("got chunks %+v, pending %v", simulation.Chunks, simulation.Pending)
+	}
+	if !simulation.Record.MediaPaid || simulation.Record.Finalized {
+		t.Fatalf("got record %+v", simulation.Record)
+	}
+	//nothing was written
+	if got := f.balance("media"); got != "0.00" {
+		t.Fatalf("media has %s", got)
+	}
+	if f.stub.State[contractId+"_settlement"] != nil {
+		t.Fatal("simulation stored a settlement")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	STATEMENT_JSON = "json"
+	STATEMENT_CSV  = "csv"
+)
+
+// StatementEntry is one posting to the account of a statement, amounts
+// formatted like the account Assets
+type StatementEntry struct {
+	TimeStamp    int64
+	TxId         string
+	Seq          int
+	ContractId   string
+	Counterparty string
+	Reason       string // REASON_* of the journal entry
+	Debit        string
+	Credit       string
+	Balance      string // running balance after the posting
+}
+
+// Statement lists the postings to an account from From to To, both included
+type Statement struct {
+	Account        string
+	From           int64
+	To             int64
+	OpeningBalance string
+	ClosingBalance string
+	Entries        []StatementEntry
+}
+
+// checkStatementAccess lets the owner of an account, the parties of a
+// contract for its escrows and the admins read a statement
+func checkStatementAccess(stub shim.ChaincodeStubInterface, account string) error {
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return fmt.Errorf("could not get ID: %w", err)
+	}
+	if id == account {
+		return nil
+	}
+	governance, err := getGovernanceInfo(stub)
+	if err != nil {
+		return err
+	}
+	if governance.isAdmin(id) {
+		return nil
+	}
+	if isEscrowAccount(account) {
+		contractId := account[:strings.Index(account, "/escrow/")]
+		sc, err := getSignatureContract(stub, contractId)
+		if err != nil {
+			return err
+		}
+		if isContractParty(sc.Contract, id) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s can not read the statement of %s", id, account)
+}
+
+func parseStatementTime(s string, unset int64) (int64, error) {
+	if s == "" {
+		return unset, nil
+	}
+	t, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("time format error: %s", s)
+	}
+	return t, nil
+}
+
+// buildStatement walks the postings of account in time order. The postings
+// before from only make the opening balance.
+func buildStatement(stub shim.ChaincodeStubInterface, account string, from int64, to int64) (*Statement, error) {
+	it, err := stub.GetStateByPartialCompositeKey(POSTING_INDEX, []string{account})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	var balance, opening int64
+	var entries []StatementEntry
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attrs, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(attrs) != 5 {
+			return nil, fmt.Errorf("posting key format error: %v", attrs)
+		}
+		timeStamp, _ := strconv.ParseInt(attrs[1], 10, 64)
+		if timeStamp > to {
+			break
+		}
+		amount, err := strconv.ParseInt(string(kv.Value), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		balance += amount
+		if timeStamp < from {
+			opening = balance
+			continue
+		}
+		entry, err := getJournalEntry(stub, attrs[2], attrs[3])
+		if err != nil {
+			return nil, err
+		}
+		statementEntry := StatementEntry{
+			TimeStamp:  timeStamp,
+			TxId:       attrs[2],
+			Seq:        entry.Seq,
+			ContractId: entry.ContractId,
+			Reason:     entry.Reason,
+			Balance:    formatAmount(balance),
+		}
+		var counterparties []string
+		for _, posting := range entry.Postings {
+			if posting.Account != account {
+				counterparties = append(counterparties, posting.Account)
+			}
+		}
+		statementEntry.Counterparty = strings.Join(counterparties, " ")
+		if amount < 0 {
+			statementEntry.Debit = formatAmount(-amount)
+		} else {
+			statementEntry.Credit = formatAmount(amount)
+		}
+		entries = append(entries, statementEntry)
+	}
+	return &Statement{
+		Account:        account,
+		From:           from,
+		To:             to,
+		OpeningBalance: formatAmount(opening),
+		ClosingBalance: formatAmount(balance),
+		Entries:        entries,
+	}, nil
+}
+
+func getJournalEntry(stub shim.ChaincodeStubInterface, txId string, seq string) (JournalEntry, error) {
+	var entry JournalEntry
+	key, err := stub.CreateCompositeKey(JOURNAL_INDEX, []string{txId, seq})
+	if err != nil {
+		return entry, err
+	}
+	entryAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return entry, err
+	}
+	if entryAsBytes == nil {
+		return entry, fmt.Errorf("journal entry %s/%s does not exist", txId, seq)
+	}
+	err = json.Unmarshal(entryAsBytes, &entry)
+	return entry, err
+}
+
+// csv of a statement for the finance team, one row per posting
+func (s *Statement) csv() (string, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"time", "tx_id", "seq", "contract_id", "counterparty", "reason", "debit", "credit", "balance"})
+	w.Write([]string{"", "", "", "", "", "opening", "", "", s.OpeningBalance})
+	for _, e := range s.Entries {
+		w.Write([]string{
+			time.Unix(e.TimeStamp, 0).UTC().Format(time.RFC3339),
+			e.TxId,
+			strconv.Itoa(e.Seq),
+			e.ContractId,
+			e.Counterparty,
+			e.Reason,
+			e.Debit,
+			e.Credit,
+			e.Balance,
+		})
+	}
+	w.Write([]string{"", "", "", "", "", "closing", "", "", s.ClosingBalance})
+	w.Flush()
+	return buf.String(), w.Error()
+}
+
+// getStatement lists every debit and credit of a ledger account with its
+// running balance. Postings of one second are in transaction id order.
+// args[0]: ledger account
+// args[1]: from, unix time, empty for the first posting
+// args[2]: to, unix time, empty for now
+// args[3]: json or csv, json if omitted
+func getStatement(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) < 3 || len(args) > 4 {
+		return "", fmt.Errorf("Incorrect arguments. Expecting 3 or 4 value")
+	}
+	account := args[0]
+	err := checkStatementAccess(stub, account)
+	if err != nil {
+		return "", err
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return "", err
+	}
+	from, err := parseStatementTime(args[1], 0)
+	if err != nil {
+		return "", err
+	}
+	to, err := parseStatementTime(args[2], now)
+	if err != nil {
+		return "", err
+	}
+	if from > to {
+		return "", fmt.Errorf("statement from %d is after to %d", from, to)
+	}
+	format := STATEMENT_JSON
+	if len(args) == 4 && args[3] != "" {
+		format = args[3]
+	}
+	statement, err := buildStatement(stub, account, from, to)
+	if err != nil {
+		return "", err
+	}
+	switch format {
+	case STATEMENT_JSON:
+		statementAsBytes, _ := json.Marshal(statement)
+		return string(statementAsBytes), nil
+	case STATEMENT_CSV:
+		return statement.csv()
+	}
+	return "", fmt.Errorf("unknown statement format %s", format)
+}
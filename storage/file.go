@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileFetcher reads file:///path addresses below Root. Addresses come from
+// the contract parties, so a path may not leave Root.
+type FileFetcher struct {
+	Root string
+}
+
+func (f FileFetcher) Fetch(ctx context.Context, u *url.URL, maxBytes int64) ([]byte, error) {
+	if f.Root == "" {
+		return nil, fmt.Errorf("no root directory for file addresses")
+	}
+	root, err := filepath.Abs(f.Root)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(root, filepath.FromSlash(filepath.Clean("/"+u.Host+u.Path)))
+	if path != root && !strings.HasPrefix(path, root+string(filepath.Separator)) {
+		return nil, fmt.Errorf("path %s is outside %s", u.Path, root)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err == nil && info.Size() > maxBytes {
+		return nil, ErrTooLarge{MaxBytes: maxBytes}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return readLimited(file, maxBytes)
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "logs", "media.log"), mediaLog, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "logs", "tampered.log"), tamper(mediaLog), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		root     string
+		address  string
+		maxBytes int64
+		wantErr  string
+		badFile  string
+	}{
+		{name: "committed file", root: root, address: "file:///logs/media.log"},
+		{name: "host form", root: root, address: "file://logs/media.log"},
+		{name: "digest mismatch", root: root, address: "file:///logs/tampered.log", badFile: "does not match committed digest"},
+		{name: "missing file", root: root, address: "file:///logs/other.log", wantErr: "no such file"},
+		{name: "dot dot stays in root", root: root, address: "file:///../secret", wantErr: "no such file"},
+		{name: "escaped dot dot stays in root", root: root, address: "file:///logs/%2e%2e/%2e%2e/secret", wantErr: "no such file"},
+		{name: "no root", address: "file:///logs/media.log", wantErr: "no root directory"},
+		{name: "over the limit", root: root, address: "file:///logs/media.log", maxBytes: 10, wantErr: "larger than 10 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := New()
+			store.Register("file", FileFetcher{Root: tt.root}, Limits{MaxBytes: tt.maxBytes})
+			data, err := store.Fetch(context.Background(), tt.address, 0)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = commit(t, tt.address, mediaLog).Decode(data)
+			if tt.badFile == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.badFile != "" && (err == nil || !strings.Contains(err.Error(), tt.badFile)) {
+				t.Fatalf("got error %v, want %q", err, tt.badFile)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// HTTPFetcher fetches http and https addresses. Client may carry its own
+// TLS configuration, nil uses http.DefaultClient.
+type HTTPFetcher struct {
+	Client *http.Client
+}
+
+func (f HTTPFetcher) Fetch(ctx context.Context, u *url.URL, maxBytes int64) ([]byte, error) {
+	return httpGet(ctx, f.Client, u.String(), nil, maxBytes)
+}
+
+func httpGet(ctx context.Context, client *http.Client, address string, header http.Header, maxBytes int64) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", address, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	if resp.ContentLength > maxBytes {
+		return nil, ErrTooLarge{MaxBytes: maxBytes}
+	}
+	return readLimited(resp.Body, maxBytes)
+}
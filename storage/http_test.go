@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"chaincodedev/chaincode/liqi/hwxf/logformat"
+	"chaincodedev/chaincode/liqi/hwxf/merkle"
+	"chaincodedev/chaincode/liqi/hwxf/payload"
+)
+
+var mediaLog = []byte("#hwxf v2 tsv\nimp-1\nimp-2\nimp-3\n")
+
+// commit returns the commitment a media would submit for data
+func commit(t *testing.T, address string, data []byte) payload.FileCommitment {
+	file, err := logformat.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload.FileCommitment{
+		Address:     address,
+		Digest:      payload.Digest(data),
+		Size:        int64(len(data)),
+		RecordCount: len(file.Records),
+		MerkleRoot:  hex.EncodeToString(merkle.Root(file.Canonical())),
+	}
+}
+
+// tamper returns data with one byte of a record changed
+func tamper(data []byte) []byte {
+	tampered := append([]byte(nil), data...)
+	tampered[len(tampered)-2] = '9'
+	return tampered
+}
+
+func TestHTTPFetch(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		maxBytes int64
+		wantErr  string // of the fetch
+		badFile  string // of decoding the fetched file against the commitment of mediaLog
+	}{
+		{
+			name:    "committed file",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.Write(mediaLog) },
+		},
+		{
+			name:    "digest mismatch",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.Write(tamper(mediaLog)) },
+			badFile: "does not match committed digest",
+		},
+		{
+			name:    "size mismatch",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.Write(mediaLog[:len(mediaLog)-1]) },
+			badFile: "does not match committed size",
+		},
+		{
+			name:    "not found",
+			handler: func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) },
+			wantErr: "404",
+		},
+		{
+			name:     "content length over the limit",
+			handler:  func(w http.ResponseWriter, r *http.Request) { w.Write(mediaLog) },
+			maxBytes: 10,
+			wantErr:  "larger than 10 bytes",
+		},
+		{
+			name: "chunked over the limit",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				for _, line := range strings.SplitAfter(string(mediaLog), "\n") {
+					w.Write([]byte(line))
+					w.(http.Flusher).Flush()
+				}
+			},
+			maxBytes: 10,
+			wantErr:  "larger than 10 bytes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+			store := New()
+			store.Register("http", HTTPFetcher{}, Limits{MaxBytes: tt.maxBytes})
+			commitment := commit(t, server.URL+"/media.log", mediaLog)
+			data, err := store.Fetch(context.Background(), commitment.Address, commitment.Size)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = commitment.Decode(data)
+			if tt.badFile == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.badFile != "" && (err == nil || !strings.Contains(err.Error(), tt.badFile)) {
+				t.Fatalf("got error %v, want %q", err, tt.badFile)
+			}
+		})
+	}
+}
+
+func TestLegacyAddressIsHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/logs/media.log" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(mediaLog)
+	}))
+	defer server.Close()
+	store := New()
+	store.Register("http", HTTPFetcher{}, Limits{})
+	data, err := store.Fetch(context.Background(), strings.TrimPrefix(server.URL, "http://")+"/logs/media.log", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(mediaLog) {
+		t.Fatalf("got %q", data)
+	}
+}
+
+func TestUnknownScheme(t *testing.T) {
+	_, err := New().Fetch(context.Background(), "ftp://example.com/media.log", 0)
+	if err == nil || !strings.Contains(err.Error(), "no storage backend") {
+		t.Fatalf("got error %v", err)
+	}
+}
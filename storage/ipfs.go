@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	CODEC_RAW    = 0x55
+	CODEC_DAG_PB = 0x70
+	SHA2_256     = 0x12
+
+	MAX_DAG_DEPTH = 32
+)
+
+// IPFSFetcher fetches ipfs://<cid> addresses block by block from a trustless
+// gateway and checks every block against its CID, so the gateway does not
+// have to be trusted. It reads raw blocks and UnixFS files built of dag-pb
+// nodes hashed with SHA-256, the defaults of ipfs add.
+type IPFSFetcher struct {
+	Gateway string // e.g. http://127.0.0.1:8080
+	Client  *http.Client
+}
+
+func (f IPFSFetcher) Fetch(ctx context.Context, u *url.URL, maxBytes int64) ([]byte, error) {
+	if f.Gateway == "" {
+		return nil, fmt.Errorf("no ipfs gateway")
+	}
+	if u.Path != "" && u.Path != "/" {
+		return nil, fmt.Errorf("ipfs paths are not supported, address the file by its own cid")
+	}
+	c, err := parseCID(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	err = f.fetchNode(ctx, c, &out, maxBytes, 0)
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// fetchNode appends the file content under c to out
+func (f IPFSFetcher) fetchNode(ctx context.Context, c cid, out *bytes.Buffer, maxBytes int64, depth int) error {
+	if depth > MAX_DAG_DEPTH {
+		return fmt.Errorf("ipfs dag deeper than %d", MAX_DAG_DEPTH)
+	}
+	header := http.Header{"Accept": []string{"application/vnd.ipld.raw"}}
+	// a block is never much larger than its file content, allow for the dag-pb framing
+	block, err := httpGet(ctx, f.Client, strings.TrimRight(f.Gateway, "/")+"/ipfs/"+c.String()+"?format=raw", header, maxBytes+1<<20)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(block)
+	if !bytes.Equal(digest[:], c.digest) {
+		return fmt.Errorf("block %s does not match its cid", c)
+	}
+	switch c.codec {
+	case CODEC_RAW:
+		if int64(out.Len()+len(block)) > maxBytes {
+			return ErrTooLarge{MaxBytes: maxBytes}
+		}
+		out.Write(block)
+		return nil
+	case CODEC_DAG_PB:
+		data, links, err := parseDagPB(block)
+		if err != nil {
+			return fmt.Errorf("block %s: %v", c, err)
+		}
+		if int64(out.Len()+len(data)) > maxBytes {
+			return ErrTooLarge{MaxBytes: maxBytes}
+		}
+		out.Write(data)
+		for _, link := range links {
+			child, err := decodeCID(link)
+			if err != nil {
+				return fmt.Errorf("block %s: %v", c, err)
+			}
+			err = f.fetchNode(ctx, child, out, maxBytes, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("cid codec 0x%x is not supported", c.codec)
+	}
+}
+
+type cid struct {
+	codec  uint64
+	digest []byte // SHA-256
+}
+
+// String returns the CIDv1 base32 form, which gateways accept for v0 CIDs too
+func (c cid) String() string {
+	b := appendVarint([]byte{1}, c.codec)
+	b = append(b, SHA2_256, byte(len(c.digest)))
+	b = append(b, c.digest...)
+	return "b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+}
+
+// parseCID reads a CIDv0 ("Qm...") or a base32 ("b...") or base58 ("z...") CIDv1
+func parseCID(s string) (cid, error) {
+	if len(s) == 46 && strings.HasPrefix(s, "Qm") {
+		b, err := base58Decode(s)
+		if err != nil {
+			return cid{}, fmt.Errorf("cid format error: %s", s)
+		}
+		return decodeCID(b)
+	}
+	if len(s) < 2 {
+		return cid{}, fmt.Errorf("cid format error: %s", s)
+	}
+	var b []byte
+	var err error
+	switch s[0] {
+	case 'b':
+		b, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(s[1:]))
+	case 'z':
+		b, err = base58Decode(s[1:])
+	default:
+		return cid{}, fmt.Errorf("cid multibase %c is not supported", s[0])
+	}
+	if err != nil {
+		return cid{}, fmt.Errorf("cid format error: %s", s)
+	}
+	return decodeCID(b)
+}
+
+// decodeCID reads a binary CID, a bare SHA-256 multihash being a CIDv0
+func decodeCID(b []byte) (cid, error) {
+	if len(b) == 34 && b[0] == SHA2_256 && b[1] == 32 {
+		return cid{codec: CODEC_DAG_PB, digest: b[2:]}, nil
+	}
+	version, n := readVarint(b)
+	if n <= 0 || version != 1 {
+		return cid{}, fmt.Errorf("cid version is not supported")
+	}
+	b = b[n:]
+	codec, n := readVarint(b)
+	if n <= 0 {
+		return cid{}, fmt.Errorf("cid format error")
+	}
+	b = b[n:]
+	hash, n := readVarint(b)
+	if n <= 0 || hash != SHA2_256 {
+		return cid{}, fmt.Errorf("cid hash function is not sha2-256")
+	}
+	b = b[n:]
+	size, n := readVarint(b)
+	if n <= 0 || size != sha256.Size || len(b[n:]) != sha256.Size {
+		return cid{}, fmt.Errorf("cid digest format error")
+	}
+	return cid{codec: codec, digest: b[n:]}, nil
+}
+
+// parseDagPB returns the UnixFS file data of a dag-pb node and the CIDs of its children
+func parseDagPB(block []byte) ([]byte, [][]byte, error) {
+	var unixfs []byte
+	var links [][]byte
+	err := readProtobuf(block, func(field uint64, value []byte) error {
+		switch field {
+		case 1:
+			unixfs = value
+		case 2:
+			return readProtobuf(value, func(field uint64, value []byte) error {
+				if field == 1 {
+					links = append(links, value)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var fileType uint64
+	var data []byte
+	err = readProtobuf(unixfs, func(field uint64, value []byte) error {
+		switch field {
+		case 1:
+			fileType, _ = readVarint(value)
+		case 2:
+			data = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	// 0 raw, 2 file
+	if fileType != 0 && fileType != 2 {
+		return nil, nil, fmt.Errorf("unixfs node of type %d is not a file", fileType)
+	}
+	return data, links, nil
+}
+
+// readProtobuf calls fn with each field of a protobuf message. Varint
+// values are passed as their encoded bytes.
+func readProtobuf(b []byte, fn func(field uint64, value []byte) error) error {
+	for len(b) > 0 {
+		tag, n := readVarint(b)
+		if n <= 0 {
+			return fmt.Errorf("protobuf format error")
+		}
+		b = b[n:]
+		var value []byte
+		switch tag & 7 {
+		case 0:
+			_, n = readVarint(b)
+			if n <= 0 {
+				return fmt.Errorf("protobuf format error")
+			}
+			value, b = b[:n], b[n:]
+		case 1, 5:
+			size := 8
+			if tag&7 == 5 {
+				size = 4
+			}
+			if len(b) < size {
+				return fmt.Errorf("protobuf format error")
+			}
+			value, b = b[:size], b[size:]
+		case 2:
+			size, n := readVarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return fmt.Errorf("protobuf format error")
+			}
+			value, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return fmt.Errorf("protobuf wire type %d is not supported", tag&7)
+		}
+		if err := fn(tag>>3, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readVarint returns an unsigned varint and its length, 0 if b is too short
+func readVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58Decode(s string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	zeros := 0
+	for zeros < len(s) && s[zeros] == '1' {
+		zeros++
+	}
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte(base58Alphabet, s[i])
+		if d < 0 {
+			return nil, fmt.Errorf("base58 format error")
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(d)))
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
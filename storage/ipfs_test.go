@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// gateway serves blocks by the CIDv1 string IPFSFetcher asks for
+type gateway map[string][]byte
+
+func (g gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Accept") != "application/vnd.ipld.raw" || r.URL.Query().Get("format") != "raw" {
+		http.Error(w, "raw blocks only", http.StatusBadRequest)
+		return
+	}
+	block, ok := g[strings.TrimPrefix(r.URL.Path, "/ipfs/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(block)
+}
+
+func (g gateway) add(codec uint64, block []byte) cid {
+	digest := sha256.Sum256(block)
+	c := cid{codec: codec, digest: digest[:]}
+	g[c.String()] = block
+	return c
+}
+
+func protobufField(field uint64, value []byte) []byte {
+	b := appendVarint(nil, field<<3|2)
+	b = appendVarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// binary returns the binary form of c, as dag-pb links carry it
+func (c cid) binary() []byte {
+	b := appendVarint([]byte{1}, c.codec)
+	b = append(b, SHA2_256, byte(len(c.digest)))
+	return append(b, c.digest...)
+}
+
+func TestIPFSFetch(t *testing.T) {
+	g := gateway{}
+	first := g.add(CODEC_RAW, []byte("#hwxf v2 tsv\nimp-1\n"))
+	second := g.add(CODEC_RAW, []byte("imp-2\nimp-3\n"))
+	//a dag-pb file node linking the two raw blocks, UnixFS type 2 without data of its own
+	var node []byte
+	for _, child := range []cid{first, second} {
+		node = append(node, protobufField(2, protobufField(1, child.binary()))...)
+	}
+	node = append(node, protobufField(1, []byte{0x08, 0x02})...)
+	file := g.add(CODEC_DAG_PB, node)
+	//"hello world\n" as ipfs add stores it, addressed by its CIDv0 below
+	g.add(CODEC_DAG_PB, append(append([]byte{0x0a, 0x12, 0x08, 0x02, 0x12, 0x0c}, "hello world\n"...), 0x18, 0x0c))
+	//a gateway serving other content than the cid names
+	named := sha256.Sum256([]byte("imp-1\n"))
+	liar := cid{codec: CODEC_RAW, digest: named[:]}
+	g[liar.String()] = []byte("imp-666\n")
+	missing := sha256.Sum256([]byte("absent"))
+	absent := cid{codec: CODEC_RAW, digest: missing[:]}
+
+	tests := []struct {
+		name     string
+		address  string
+		maxBytes int64
+		want     string
+		wantErr  string
+	}{
+		{name: "raw block", address: "ipfs://" + first.String(), want: "#hwxf v2 tsv\nimp-1\n"},
+		{name: "dag-pb file", address: "ipfs://" + file.String(), want: string(mediaLog)},
+		{name: "cid v0", address: "ipfs://QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o", want: "hello world\n"},
+		{name: "block does not match its cid", address: "ipfs://" + liar.String(), wantErr: "does not match its cid"},
+		{name: "missing block", address: "ipfs://" + absent.String(), wantErr: "404"},
+		{name: "path", address: "ipfs://" + file.String() + "/media.log", wantErr: "paths are not supported"},
+		{name: "bad cid", address: "ipfs://xyz", wantErr: "multibase"},
+		{name: "over the limit", address: "ipfs://" + file.String(), maxBytes: 10, wantErr: "larger than 10 bytes"},
+	}
+	server := httptest.NewServer(g)
+	defer server.Close()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := New()
+			store.Register("ipfs", IPFSFetcher{Gateway: server.URL}, Limits{MaxBytes: tt.maxBytes})
+			data, err := store.Fetch(context.Background(), tt.address, 0)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Fatalf("got %q, want %q", data, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Fetcher fetches s3://bucket/key addresses from an S3 compatible
+// service, path style, with AWS Signature Version 4. Without AccessKey the
+// request is sent unsigned, for public buckets.
+type S3Fetcher struct {
+	Endpoint     string // e.g. https://s3.eu-west-1.amazonaws.com or http://127.0.0.1:9000, empty for AWS in Region
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Client       *http.Client
+}
+
+func (f S3Fetcher) endpoint() string {
+	if f.Endpoint != "" {
+		return strings.TrimRight(f.Endpoint, "/")
+	}
+	return "https://s3." + f.Region + ".amazonaws.com"
+}
+
+func (f S3Fetcher) Fetch(ctx context.Context, u *url.URL, maxBytes int64) ([]byte, error) {
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, fmt.Errorf("s3 address must be s3://bucket/key")
+	}
+	if f.Region == "" {
+		return nil, fmt.Errorf("no s3 region")
+	}
+	endpoint, err := url.Parse(f.endpoint())
+	if err != nil {
+		return nil, fmt.Errorf("s3 endpoint format error: %s", f.Endpoint)
+	}
+	canonicalURI := strings.TrimRight(endpoint.EscapedPath(), "/") + "/" + s3Escape(u.Host) + "/" + s3Escape(key)
+	header := make(http.Header)
+	if f.AccessKey != "" {
+		f.sign(header, endpoint.Host, canonicalURI, time.Now().UTC())
+	}
+	return httpGet(ctx, f.Client, endpoint.Scheme+"://"+endpoint.Host+canonicalURI, header, maxBytes)
+}
+
+// sign adds the Signature Version 4 headers of a GET of canonicalURI with an unsigned payload
+func (f S3Fetcher) sign(header http.Header, host string, canonicalURI string, now time.Time) {
+	headers := map[string]string{
+		"host":                 host,
+		"x-amz-content-sha256": "UNSIGNED-PAYLOAD",
+		"x-amz-date":           now.Format("20060102T150405Z"),
+	}
+	if f.SessionToken != "" {
+		headers["x-amz-security-token"] = f.SessionToken
+	}
+	authorization := signV4(f.AccessKey, f.SecretKey, f.Region, "GET", canonicalURI, headers, "UNSIGNED-PAYLOAD", now)
+	for name, value := range headers {
+		if name != "host" {
+			header.Set(name, value)
+		}
+	}
+	header.Set("Authorization", authorization)
+}
+
+// signV4 returns the Authorization header of an s3 request signed with
+// Signature Version 4 over headers, whose names are in lower case
+func signV4(accessKey string, secretKey string, region string, method string, canonicalURI string, headers map[string]string, payloadHash string, now time.Time) string {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{method, canonicalURI, "", canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	return "AWS4-HMAC-SHA256 Credential=" + accessKey + "/" + scope + ", SignedHeaders=" + signedHeaders + ", Signature=" + signature
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape URI encodes every byte but the unreserved characters, keeping the slashes of a key
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,128 @@
+// Package storage fetches the off-chain files a commitment points to. The
+// scheme of the address selects the backend: http and https, ipfs, s3 and
+// file. Addresses without a scheme are the legacy "host/path" form and are
+// fetched over http.
+//
+// Every fetch runs under the timeout and byte limit of its backend. The
+// backends only fetch, the caller checks the content against its commitment.
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_TIMEOUT   = time.Minute
+	DEFAULT_MAX_BYTES = 1 << 30
+)
+
+// Limits bound a single fetch. Zero values take the defaults.
+type Limits struct {
+	Timeout  time.Duration
+	MaxBytes int64
+}
+
+func (l Limits) timeout() time.Duration {
+	if l.Timeout <= 0 {
+		return DEFAULT_TIMEOUT
+	}
+	return l.Timeout
+}
+
+func (l Limits) maxBytes() int64 {
+	if l.MaxBytes <= 0 {
+		return DEFAULT_MAX_BYTES
+	}
+	return l.MaxBytes
+}
+
+// Fetcher reads the content at u. It returns ErrTooLarge when the content
+// is longer than maxBytes, and gives up when ctx is done.
+type Fetcher interface {
+	Fetch(ctx context.Context, u *url.URL, maxBytes int64) ([]byte, error)
+}
+
+// ErrTooLarge is returned for content over the byte limit
+type ErrTooLarge struct {
+	MaxBytes int64
+}
+
+func (e ErrTooLarge) Error() string {
+	return fmt.Sprintf("content is larger than %d bytes", e.MaxBytes)
+}
+
+type backend struct {
+	fetcher Fetcher
+	limits  Limits
+}
+
+// Storage selects a Fetcher by the scheme of an address
+type Storage struct {
+	backends map[string]backend
+}
+
+func New() *Storage {
+	return &Storage{backends: make(map[string]backend)}
+}
+
+// Register makes f fetch the addresses of scheme, within limits
+func (s *Storage) Register(scheme string, f Fetcher, limits Limits) {
+	s.backends[strings.ToLower(scheme)] = backend{fetcher: f, limits: limits}
+}
+
+// Fetch reads the content at address, at most maxBytes of it, or the byte
+// limit of the backend if that is lower. maxBytes <= 0 means no extra bound.
+func (s *Storage) Fetch(ctx context.Context, address string, maxBytes int64) ([]byte, error) {
+	u, err := parseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := s.backends[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("no storage backend for scheme %s of %s", u.Scheme, address)
+	}
+	limit := b.limits.maxBytes()
+	if maxBytes > 0 && maxBytes < limit {
+		limit = maxBytes
+	}
+	ctx, cancel := context.WithTimeout(ctx, b.limits.timeout())
+	defer cancel()
+	data, err := b.fetcher.Fetch(ctx, u, limit)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %v", address, err)
+	}
+	return data, nil
+}
+
+func parseAddress(address string) (*url.URL, error) {
+	if address == "" {
+		return nil, fmt.Errorf("empty address")
+	}
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("address format error: %s", address)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	return u, nil
+}
+
+// readLimited reads r to the end, failing once it passes maxBytes
+func readLimited(r io.Reader, maxBytes int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, ErrTooLarge{MaxBytes: maxBytes}
+	}
+	return data, nil
+}